@@ -0,0 +1,231 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-25 09:48:30
+ * @LastEditTime: 2024-09-25 15:36:12
+ * @FilePath: \UserFeedBack\archive.go
+ * @Description: 反馈附件打包下载
+ */
+package main
+
+import (
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 一次最多打包的反馈数
+const maxArchiveFeedbacks = 100
+
+/**
+ * @description: 单个反馈的附件打包下载接口
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func downloadFeedbackArchive(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	feedbackID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid feedback id", http.StatusBadRequest)
+		return
+	}
+
+	writeFeedbackArchive(w, []int{feedbackID}, fmt.Sprintf("feedback-%d.zip", feedbackID))
+}
+
+/**
+ * @description: 多个反馈的附件打包下载接口，反馈id通过ids参数以逗号分隔传入，每个反馈单独一个目录
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func downloadFeedbacksArchive(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []int
+	for _, item := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		id, err := strconv.Atoi(item)
+		if err != nil {
+			http.Error(w, "Invalid feedback id", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		http.Error(w, "Missing feedback ids", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxArchiveFeedbacks {
+		http.Error(w, fmt.Sprintf("At most %d feedbacks per archive", maxArchiveFeedbacks), http.StatusBadRequest)
+		return
+	}
+
+	writeFeedbackArchive(w, ids, "feedback-"+time.Now().Format("20060102150405")+".zip")
+}
+
+/**
+ * @description: 边从存储读取边写出zip，不在内存或磁盘上缓存整个压缩包
+ * @param {http.ResponseWriter} w
+ * @param {[]int} ids 反馈id
+ * @param {string} fileName 压缩包文件名
+ * @return {*}
+ */
+func writeFeedbackArchive(w http.ResponseWriter, ids []int, fileName string) {
+	feedbacks, err := dbwrapper.QueryFeedbackByIDs(ids)
+	if err != nil {
+		logwrapper.Logger.Error("error querying feedback:", err)
+		http.Error(w, "Failed to query feedback", http.StatusInternalServerError)
+		return
+	}
+	if len(feedbacks) == 0 {
+		http.Error(w, "Feedback not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+fileName+`"`)
+
+	archive := zip.NewWriter(w)
+	// 响应头已发出，之后的失败只能记录日志并写入压缩包内的错误清单
+	var failures []string
+	for _, feedback := range feedbacks {
+		// 只有一个反馈时不额外建目录
+		dir := ""
+		if len(ids) > 1 {
+			dir = strconv.Itoa(feedback.FeedbackID) + "/"
+		}
+
+		failures, err = writeFeedbackEntries(archive, dir, feedback, failures)
+		if err != nil {
+			logwrapper.Logger.Error("error writing archive:", err)
+			return
+		}
+	}
+
+	if len(failures) > 0 {
+		entry, err := archive.Create("errors.txt")
+		if err != nil {
+			logwrapper.Logger.Error("error writing archive:", err)
+			return
+		}
+		if _, err = io.WriteString(entry, strings.Join(failures, "\n")+"\n"); err != nil {
+			logwrapper.Logger.Error("error writing archive:", err)
+			return
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		logwrapper.Logger.Error("error writing archive:", err)
+	}
+}
+
+/**
+ * @description: 写入单个反馈的feedback.json和附件
+ * @param {*zip.Writer} archive 压缩包
+ * @param {string} dir 压缩包内的目录
+ * @param {dto.FeedbackQueryOne} feedback 反馈信息
+ * @param {[]string} failures 读取失败的附件
+ * @return {*} 追加后的读取失败附件，写出压缩包失败时返回error
+ */
+func writeFeedbackEntries(archive *zip.Writer, dir string, feedback dto.FeedbackQueryOne, failures []string) ([]string, error) {
+	timeStamp := time.UnixMilli(feedback.TimeStamp)
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     dir + "feedback.json",
+		Method:   zip.Deflate,
+		Modified: timeStamp,
+	})
+	if err != nil {
+		return failures, err
+	}
+
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(feedback); err != nil {
+		return failures, err
+	}
+
+	used := make(map[string]bool)
+	for _, file := range feedback.Files {
+		name := archiveEntryName(file.FileName, used)
+		if file.Missing {
+			failures = append(failures, fmt.Sprintf("%sfiles/%s: missing in storage", dir, name))
+			continue
+		}
+		if file.Expired {
+			failures = append(failures, fmt.Sprintf("%sfiles/%s: expired", dir, name))
+			continue
+		}
+		if !scanAllowsDownload(file.ScanStatus) {
+			failures = append(failures, fmt.Sprintf("%sfiles/%s: scan status %q", dir, name, file.ScanStatus))
+			continue
+		}
+
+		reader, err := osswrapper.Current().Open(file.FilePathOnOss)
+		if err != nil {
+			logwrapper.Logger.Warn("error opening attachment ", file.FilePathOnOss, ": ", err)
+			failures = append(failures, fmt.Sprintf("%sfiles/%s: %v", dir, name, err))
+			continue
+		}
+
+		entry, err = archive.CreateHeader(&zip.FileHeader{
+			Name:     dir + "files/" + name,
+			Method:   zip.Deflate,
+			Modified: timeStamp,
+		})
+		if err == nil {
+			_, err = io.Copy(entry, reader)
+		}
+		reader.Close()
+		if err != nil {
+			return failures, err
+		}
+	}
+
+	return failures, nil
+}
+
+/**
+ * @description: 生成压缩包内的附件文件名，去掉目录部分，同名时追加序号
+ * @param {string} fileName 原始文件名
+ * @param {map[string]bool} used 已使用的文件名
+ * @return {*}
+ */
+func archiveEntryName(fileName string, used map[string]bool) string {
+	name := path.Base(strings.ReplaceAll(fileName, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		name = "file"
+	}
+
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+	used[name] = true
+
+	return name
+}
@@ -0,0 +1,345 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-30 14:08:52
+ * @LastEditTime: 2024-09-30 17:26:48
+ * @FilePath: \UserFeedBack\archiveindex.go
+ * @Description: 日志压缩包的异步索引、文件列表与内容搜索接口
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 轮询间隔
+	archivePollInterval = time.Minute
+	// 每批处理的条数
+	archiveBatchSize = 5
+	// 默认单个压缩包最多记录的文件数
+	defaultArchiveMembers = 10000
+	// 默认单个文本文件最多索引的内容，单位：字节
+	defaultArchiveMemberText = 1 << 20
+	// 默认单个压缩包最多索引的内容，单位：字节
+	defaultArchiveTotalText = 32 << 20
+	// 搜索默认返回的条数
+	defaultSearchLimit = 50
+	// 搜索最多返回的条数
+	maxSearchLimit = 200
+)
+
+// 默认提取内容的文件扩展名
+var defaultArchiveTextExtensions = []string{".log", ".txt"}
+
+// 压缩包中的文件数超出限制，停止遍历
+var errArchiveMembersExceeded = errors.New("archive members exceeded")
+
+// 有新的压缩包附件时唤醒执行
+var archiveWakeup = make(chan struct{}, 1)
+
+/**
+ * @description: 通知有新的压缩包附件需要建立索引
+ * @return {*}
+ */
+func notifyArchiveIndex() {
+	select {
+	case archiveWakeup <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * @description: 持续为新提交的压缩包附件建立索引
+ * @return {*}
+ */
+func runArchiveIndexer() {
+	ticker := time.NewTicker(archivePollInterval)
+	defer ticker.Stop()
+
+	for {
+		// 一批处理满时说明可能还有积压，继续处理
+		for processArchives() == archiveBatchSize {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-archiveWakeup:
+		}
+	}
+}
+
+/**
+ * @description: 处理一批待建立索引的压缩包
+ * @return {*} 本批处理的条数
+ */
+func processArchives() int {
+	tasks, err := dbwrapper.QueryPendingArchives(archiveBatchSize)
+	if err != nil {
+		logwrapper.Logger.Error("error querying pending archives:", err)
+		return 0
+	}
+
+	for _, task := range tasks {
+		entries, err := indexArchive(task)
+		if err == nil {
+			err = dbwrapper.SaveArchiveIndex(task.FilePath, entries)
+		}
+		if err == nil {
+			continue
+		}
+
+		logwrapper.Logger.Error("error indexing archive ", task.FilePath, ": ", err)
+		if err = dbwrapper.FinishArchive(task.FilePath, dto.ArchiveIndexFailed); err != nil {
+			logwrapper.Logger.Error("error updating archive index:", err)
+		}
+	}
+
+	return len(tasks)
+}
+
+/**
+ * @description: 读取压缩包的文件列表，并提取文本文件的内容
+ * @param {dbwrapper.ArchiveTask} task 待建立索引的压缩包
+ * @return {*}
+ */
+func indexArchive(task dbwrapper.ArchiveTask) ([]dbwrapper.ArchiveEntry, error) {
+	cfg := configwrapper.Cfg.Archive
+	maxMembers := cfg.MaxMembers
+	if maxMembers <= 0 {
+		maxMembers = defaultArchiveMembers
+	}
+	maxMemberText := cfg.MaxMemberTextSize
+	if maxMemberText <= 0 {
+		maxMemberText = defaultArchiveMemberText
+	}
+	remainingText := cfg.MaxTotalTextSize
+	if remainingText <= 0 {
+		remainingText = defaultArchiveTotalText
+	}
+	extensions := cfg.TextExtensions
+	if len(extensions) == 0 {
+		extensions = defaultArchiveTextExtensions
+	}
+
+	entries := []dbwrapper.ArchiveEntry{}
+	err := osswrapper.WalkArchive(task.FilePath, task.FileName, task.FileSize, func(member *osswrapper.ArchiveEntry, reader io.Reader) error {
+		if len(entries) >= maxMembers {
+			return errArchiveMembersExceeded
+		}
+
+		entry := dbwrapper.ArchiveEntry{Path: member.Path, Size: member.Size, ModifiedAt: member.ModifiedAt}
+		ext := strings.ToLower(path.Ext(member.Path))
+		// 超出总量后的文本文件只记录文件信息
+		if reader != nil && remainingText > 0 && slices.Contains(extensions, ext) {
+			data, err := io.ReadAll(io.LimitReader(reader, min(maxMemberText, remainingText)))
+			if err != nil {
+				return err
+			}
+			remainingText -= int64(len(data))
+
+			// 数据库按utf8存储，去掉无效字符和NUL
+			entry.Content = strings.ReplaceAll(strings.ToValidUTF8(string(data), ""), "\x00", "")
+			entry.Indexed = true
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if errors.Is(err, errArchiveMembersExceeded) {
+		logwrapper.Logger.Warn("archive ", task.FilePath, " has more than ", maxMembers, " members, the rest are not indexed")
+		err = nil
+	}
+
+	return entries, err
+}
+
+/**
+ * @description: 查询路径中属于反馈的压缩包附件，失败时直接写入错误响应
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func loadArchiveAttachment(w http.ResponseWriter, r *http.Request) (*dbwrapper.FileDetail, bool) {
+	file, ok := loadFeedbackAttachment(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if !osswrapper.IsArchiveCandidate(file.FileName, file.ContentType) {
+		http.Error(w, "File is not an archive", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return file, true
+}
+
+/**
+ * @description: 压缩包文件列表接口，返回建立索引时记录的文件
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func listArchiveMembers(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, ok := loadArchiveAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := dbwrapper.QueryArchiveMembers(file.FilePath)
+	if err != nil {
+		logwrapper.Logger.Error("error querying archive members:", err)
+		http.Error(w, "Failed to query archive members", http.StatusInternalServerError)
+		return
+	}
+
+	// 设置响应头
+	w.Header().Set("Content-Type", "application/json")
+
+	// 将结果编码为JSON并写入响应
+	if err := json.NewEncoder(w).Encode(members); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 压缩包中单个文件的下载接口，只解压该文件，不下载整个压缩包
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func downloadArchiveMember(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, ok := loadArchiveAttachment(w, r)
+	if !ok || !checkFileAvailable(w, file) {
+		return
+	}
+
+	memberID, err := strconv.ParseInt(r.PathValue("memberID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid member id", http.StatusBadRequest)
+		return
+	}
+
+	member, err := dbwrapper.QueryArchiveMember(file.FilePath, memberID)
+	if errors.Is(err, dbwrapper.ErrArchiveMemberNotFound) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error querying archive member:", err)
+		http.Error(w, "Failed to query archive member", http.StatusInternalServerError)
+		return
+	}
+
+	reader, size, err := osswrapper.OpenArchiveMember(file.FilePath, file.FileName, file.FileSize, member.Path)
+	if errors.Is(err, osswrapper.ErrArchiveMemberNotFound) || errors.Is(err, osswrapper.ErrObjectNotFound) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error opening archive member:", err)
+		http.Error(w, "Failed to read archive member", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	name := path.Base(member.Path)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "true" {
+		disposition = "attachment"
+	}
+	// 文件名含非ASCII字符时会按RFC 2231编码
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": name}); value != "" {
+		disposition = value
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", osswrapper.SafeContentType(contentType))
+	header.Set("Content-Disposition", disposition)
+	header.Set("Content-Length", strconv.FormatInt(size, 10))
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "sandbox")
+	header.Set("Cache-Control", "private, no-cache")
+
+	// 响应头已发出，传输中断时只能记录日志
+	if _, err = io.CopyN(w, reader, size); err != nil {
+		logwrapper.Logger.Warn("error streaming archive member:", err)
+	}
+}
+
+/**
+ * @description: 在已索引的压缩包内容中搜索关键字，参数q为关键字，limit为最多返回的条数
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func searchArchives(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyword := strings.TrimSpace(r.URL.Query().Get("q"))
+	if keyword == "" {
+		http.Error(w, "Missing search keyword", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxSearchLimit)
+	}
+
+	hits, err := dbwrapper.SearchArchives(keyword, limit)
+	if err != nil {
+		logwrapper.Logger.Error("error searching archives:", err)
+		http.Error(w, "Failed to search archives", http.StatusInternalServerError)
+		return
+	}
+
+	// 设置响应头
+	w.Header().Set("Content-Type", "application/json")
+
+	// 将结果编码为JSON并写入响应
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
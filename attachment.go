@@ -0,0 +1,300 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-23 11:30:02
+ * @LastEditTime: 2024-09-24 16:12:09
+ * @FilePath: \UserFeedBack\attachment.go
+ * @Description: 附件下载接口
+ */
+package main
+
+import (
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Range请求的区间无法满足
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+/**
+ * @description: 查询路径中fileID对应的附件，失败时直接写入错误响应
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func loadAttachment(w http.ResponseWriter, r *http.Request) (*dbwrapper.FileDetail, bool) {
+	fileID, err := strconv.Atoi(r.PathValue("fileID"))
+	if err != nil {
+		http.Error(w, "Invalid file id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	file, err := dbwrapper.QueryFileByID(fileID)
+	if errors.Is(err, dbwrapper.ErrFileNotFound) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error querying file:", err)
+		http.Error(w, "Failed to query file", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return file, true
+}
+
+/**
+ * @description: 查询路径中属于反馈id的附件fileID，失败时直接写入错误响应
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func loadFeedbackAttachment(w http.ResponseWriter, r *http.Request) (*dbwrapper.FileDetail, bool) {
+	feedbackID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid feedback id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	file, ok := loadAttachment(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	// 附件必须属于路径中的反馈
+	if file.FeedbackID != feedbackID {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return file, true
+}
+
+/**
+ * @description: 检查附件是否可以下载，已过期或未通过扫描时直接写入错误响应
+ * @param {http.ResponseWriter} w
+ * @param {*dbwrapper.FileDetail} file 附件
+ * @return {*}
+ */
+func checkFileAvailable(w http.ResponseWriter, file *dbwrapper.FileDetail) bool {
+	if file.Expired {
+		http.Error(w, "File expired", http.StatusGone)
+		return false
+	}
+
+	return checkScanStatus(w, file.ScanStatus)
+}
+
+/**
+ * @description: 附件下载接口，鉴权后跳转到临时签名的下载地址
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func redirectAttachment(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, ok := loadAttachment(w, r)
+	if !ok || !checkFileAvailable(w, file) {
+		return
+	}
+
+	signedUrl, err := osswrapper.ObjectURL(file.FilePath)
+	if err != nil {
+		logwrapper.Logger.Error("error signing download url:", err)
+		http.Error(w, "Failed to sign download url", http.StatusInternalServerError)
+		return
+	}
+
+	// 签名地址有时效，不允许缓存跳转
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, signedUrl, http.StatusFound)
+}
+
+/**
+ * @description: 附件下载接口，由服务端从存储读取后转发，支持Range和If-None-Match，
+ * 下载参数download=true时以附件形式下载，否则在浏览器中直接打开
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, ok := loadFeedbackAttachment(w, r)
+	if !ok || !checkFileAvailable(w, file) {
+		return
+	}
+
+	info, err := osswrapper.Current().Stat(file.FilePath)
+	if errors.Is(err, osswrapper.ErrObjectNotFound) {
+		http.Error(w, "File not found in storage", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error querying object:", err)
+		http.Error(w, "Failed to query file", http.StatusInternalServerError)
+		return
+	}
+
+	etag := `"` + strings.Trim(info.ETag, `"`) + `"`
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	header.Set("Cache-Control", "private, no-cache")
+
+	// 客户端缓存的版本与存储一致
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	// 内容寻址的对象路径没有扩展名，按原始文件名推断
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byName := mime.TypeByExtension(path.Ext(file.FileName)); byName != "" {
+			contentType = byName
+		}
+	}
+
+	disposition := "inline"
+	if r.URL.Query().Get("download") == "true" {
+		disposition = "attachment"
+	}
+	// 文件名含非ASCII字符时会按RFC 2231编码
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": file.FileName}); value != "" {
+		disposition = value
+	}
+
+	header.Set("Content-Type", osswrapper.SafeContentType(contentType))
+	header.Set("Content-Disposition", disposition)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "sandbox")
+	header.Set("Accept-Ranges", "bytes")
+
+	// If-Range与当前版本不一致时忽略Range，返回完整内容
+	offset, length, partial := int64(0), info.Size, false
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && info.Size > 0 {
+		if ifRange := r.Header.Get("If-Range"); ifRange == "" || ifRange == etag {
+			offset, length, partial, err = parseRange(rangeHeader, info.Size)
+			if err != nil {
+				header.Set("Content-Range", "bytes */"+strconv.FormatInt(info.Size, 10))
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if partial {
+		status = http.StatusPartialContent
+		header.Set("Content-Range", "bytes "+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+length-1, 10)+"/"+strconv.FormatInt(info.Size, 10))
+	}
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(status)
+		return
+	}
+
+	var reader io.ReadCloser
+	if partial {
+		reader, err = osswrapper.Current().OpenRange(file.FilePath, offset, length)
+	} else {
+		reader, err = osswrapper.Current().Open(file.FilePath)
+	}
+	if err != nil {
+		header.Del("Content-Length")
+		header.Del("Content-Range")
+		logwrapper.Logger.Error("error opening object:", err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	w.WriteHeader(status)
+	// 响应头已发出，传输中断时只能记录日志
+	if _, err = io.CopyN(w, reader, length); err != nil {
+		logwrapper.Logger.Warn("error streaming attachment:", err)
+	}
+}
+
+/**
+ * @description: 解析单个区间的Range请求头，多区间或格式不支持时返回完整内容
+ * @param {string} value Range请求头
+ * @param {int64} size 对象大小
+ * @return {*} 起始位置、长度、是否为部分内容
+ */
+func parseRange(value string, size int64) (int64, int64, bool, error) {
+	spec, found := strings.CutPrefix(value, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+
+	startText, endText, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, size, false, nil
+	}
+
+	// bytes=-n 表示最后n个字节
+	if startText == "" {
+		suffix, err := strconv.ParseInt(endText, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true, nil
+	}
+
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, errUnsatisfiableRange
+	}
+
+	end := size - 1
+	if endText != "" {
+		end, err = strconv.ParseInt(endText, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		end = min(end, size-1)
+	}
+
+	return start, end - start + 1, true, nil
+}
+
+/**
+ * @description: 判断If-None-Match中是否包含当前版本
+ * @param {string} value If-None-Match请求头
+ * @param {string} etag 当前版本
+ * @return {*}
+ */
+func etagMatch(value string, etag string) bool {
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimPrefix(strings.TrimSpace(item), "W/")
+		if item == "*" || item == etag {
+			return true
+		}
+	}
+
+	return false
+}
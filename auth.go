@@ -0,0 +1,60 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-23 10:21:16
+ * @LastEditTime: 2024-09-23 14:57:40
+ * @FilePath: \UserFeedBack\auth.go
+ * @Description: 管理接口鉴权
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+/**
+ * @description: 校验请求是否携带有效的管理令牌，未配置令牌时不鉴权
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func authorized(r *http.Request) bool {
+	tokens := configwrapper.Cfg.Auth.AdminTokens
+	if len(tokens) == 0 {
+		return true
+	}
+
+	// 优先使用Authorization头，浏览器直接打开的下载链接可通过token参数传递
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return false
+	}
+
+	for _, item := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(item)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * @description: 为管理接口包装鉴权
+ * @param {http.HandlerFunc} handler 接口响应函数
+ * @return {*}
+ */
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
@@ -10,6 +10,7 @@ package configwrapper
 import (
 	logger "UserFeedBack/logwrapper"
 	"encoding/json"
+	"fmt"
 	"os"
 )
 
@@ -24,23 +25,133 @@ type Oss struct {
 	RoleSessionName         string `json:"roleSessionName"`
 	AdminOssAccessKeyId     string `json:"adminAccessKeyId"`
 	AdminOssAccessKeySecret string `json:"adminAccessKeySecret"`
+	UrlExpireSeconds        int64  `json:"urlExpireSeconds"`
 }
 
 type Database struct {
-	User     string `json:"user"`
-	Host     string `json:"host"`
-	Port     string `json:"port"`
-	Schema   string `json:"schema"`
-	Password string `json:"password"`
+	Driver      string `json:"driver"` // 数据库：mysql、sqlite、postgres，为空时默认为mysql
+	User        string `json:"user"`
+	Host        string `json:"host"`
+	Port        string `json:"port"`
+	Schema      string `json:"schema"`
+	Password    string `json:"password"`
+	Path        string `json:"path"`        // SQLite数据库文件的路径，为空时默认为data/feedback.db，:memory:为内存数据库
+	SSLMode     string `json:"sslMode"`     // PostgreSQL的sslmode，如disable、require，为空时使用驱动默认值
+	AutoMigrate bool   `json:"autoMigrate"` // 启动时自动执行未执行的迁移，关闭时需先执行migrate up
+}
+
+// 本地磁盘存储配置
+type Local struct {
+	RootDir          string `json:"rootDir"`          // 附件存放的根目录
+	PublicUrl        string `json:"publicUrl"`        // 客户端访问本服务的地址，如http://127.0.0.1:8080
+	SignSecret       string `json:"signSecret"`       // 上传下载地址的签名密钥，为空时启动时随机生成
+	UrlExpireSeconds int64  `json:"urlExpireSeconds"` // 签名地址的有效期，单位：秒
+}
+
+// S3兼容存储配置（AWS S3、MinIO等）
+type S3 struct {
+	Endpoint         string `json:"endpoint"`         // 服务地址，如s3.amazonaws.com、127.0.0.1:9000，不带协议头
+	Region           string `json:"region"`           // 区域，MinIO可留空
+	UseSSL           bool   `json:"useSSL"`           // 是否使用https
+	PathStyle        bool   `json:"pathStyle"`        // 是否使用path-style访问，MinIO一般需要开启
+	AccessKeyId      string `json:"accessKeyId"`      // 访问密钥
+	AccessKeySecret  string `json:"accessKeySecret"`  // 访问密钥
+	BucketName       string `json:"bucketName"`       // 存储桶
+	PublicUrl        string `json:"publicUrl"`        // 下载地址使用的协议和主机，如https://files.example.com，须是保留Host头转发到存储的反向代理；下载地址仍按此主机预签名并会过期
+	UrlExpireSeconds int64  `json:"urlExpireSeconds"` // 预签名地址的有效期，单位：秒
+}
+
+// 附件存储配置
+type Storage struct {
+	Backend            string `json:"backend"`            // 存储后端：oss、s3、local，为空时默认为oss
+	DeleteConcurrency  int    `json:"deleteConcurrency"`  // 批量删除时同时进行的请求数
+	HealthCheckSeconds int64  `json:"healthCheckSeconds"` // 存储自检的间隔，单位：秒，为0时默认5分钟
+	Local              Local  `json:"local"`
+	S3                 S3     `json:"s3"`
+}
+
+// 附件上传限制
+type Upload struct {
+	TokenDurationSeconds int64    `json:"tokenDurationSeconds"` // 上传凭证有效期，单位：秒
+	AllowedContentTypes  []string `json:"allowedContentTypes"`  // 允许上传的内容类型，为空时不限制，直传的凭证无法完全限制，以提交反馈时的校验为准
+	MaxFileSize          int64    `json:"maxFileSize"`          // 单个文件的最大尺寸，单位：字节，为0时不限制，直传的凭证无法完全限制，以提交反馈时的校验为准
+	TicketExpireSeconds  int64    `json:"ticketExpireSeconds"`  // 上传登记的有效期，超时未提交反馈的文件不再被接受，单位：秒
+	MaxRequestSize       int64    `json:"maxRequestSize"`       // 经服务端上传时单次请求的最大尺寸，单位：字节，为0时不限制
+	PartSize             int64    `json:"partSize"`             // 分片上传时单个分片的最大尺寸，单位：字节
+	SessionExpireSeconds int64    `json:"sessionExpireSeconds"` // 分片上传会话无进展超过该时长后自动放弃，单位：秒
+	MaxFiles             int      `json:"maxFiles"`             // 单次反馈最多的附件数，为0时不限制
+	MaxReportSize        int64    `json:"maxReportSize"`        // 单次反馈附件的总尺寸，单位：字节，为0时不限制
+	AllowedExtensions    []string `json:"allowedExtensions"`    // 允许上传的扩展名，如.log、.png，为空时不限制
+	AllowedSniffedTypes  []string `json:"allowedSniffedTypes"`  // 按文件内容识别出的允许类型，支持image/*形式，为空时不识别
+}
+
+// 接口鉴权配置
+type Auth struct {
+	AdminTokens []string `json:"adminTokens"` // 允许访问查询、下载、删除等管理接口的令牌，为空时不鉴权
+}
+
+// 孤立附件清理配置
+type Gc struct {
+	IntervalSeconds int64 `json:"intervalSeconds"` // 自动清理的间隔，单位：秒，为0时不自动清理
+	GraceSeconds    int64 `json:"graceSeconds"`    // 未被引用的对象至少存在该时长后才会被删除，单位：秒
+	DryRun          bool  `json:"dryRun"`          // 只报告不删除
+}
+
+// 图片缩略图配置
+type Thumbnail struct {
+	Disabled        bool  `json:"disabled"`        // 关闭缩略图生成
+	MaxDimension    int   `json:"maxDimension"`    // 缩略图最长边，单位：像素
+	MaxSourceSize   int64 `json:"maxSourceSize"`   // 超过该尺寸的原图不生成缩略图，单位：字节
+	MaxSourcePixels int64 `json:"maxSourcePixels"` // 超过该像素数的原图不生成缩略图，避免解码时占用过多内存
+}
+
+// 日志压缩包索引配置
+type ArchiveIndex struct {
+	Disabled          bool     `json:"disabled"`          // 关闭压缩包索引
+	MaxMembers        int      `json:"maxMembers"`        // 单个压缩包最多记录的文件数
+	MaxMemberTextSize int64    `json:"maxMemberTextSize"` // 单个文本文件最多索引的内容，单位：字节
+	MaxTotalTextSize  int64    `json:"maxTotalTextSize"`  // 单个压缩包最多索引的内容，单位：字节
+	TextExtensions    []string `json:"textExtensions"`    // 需要提取内容的文件扩展名，为空时为.log和.txt
+}
+
+// 附件病毒扫描配置
+type Scan struct {
+	Scanner        string `json:"scanner"`        // 扫描器：clamd、stub，为空时不扫描
+	ClamdAddress   string `json:"clamdAddress"`   // clamd地址，如tcp://127.0.0.1:3310或unix:///var/run/clamav/clamd.ctl
+	TimeoutSeconds int64  `json:"timeoutSeconds"` // 单个文件的扫描超时，单位：秒
+	MaxSize        int64  `json:"maxSize"`        // 超过该大小的文件不扫描并标记为扫描失败，应与clamd的StreamMaxLength一致
+	QuarantineDir  string `json:"quarantineDir"`  // 染毒文件的隔离目录，不能位于附件目录下，为空时为quarantine
+}
+
+// 附件保留策略配置，超出策略的附件从存储上删除，反馈内容保留
+type Retention struct {
+	IntervalSeconds int64            `json:"intervalSeconds"` // 自动执行的间隔，单位：秒，为0时不自动执行
+	DryRun          bool             `json:"dryRun"`          // 只报告不删除
+	MaxAgeDays      int              `json:"maxAgeDays"`      // 附件保留天数，为0时不限制
+	ModuleQuota     int64            `json:"moduleQuota"`     // 每个影响模块的附件总大小上限，超出时从最早的附件开始删除，单位：字节，为0时不限制
+	ModuleQuotas    map[string]int64 `json:"moduleQuotas"`    // 按影响模块单独指定的上限，覆盖moduleQuota
+	VersionQuota    int64            `json:"versionQuota"`    // 每个版本的附件总大小上限，单位：字节，为0时不限制
+	VersionQuotas   map[string]int64 `json:"versionQuotas"`   // 按版本单独指定的上限，覆盖versionQuota
 }
 
 type Config struct {
-	Oss      Oss      `json:"oss"`
-	Database Database `json:"database"`
+	Oss       Oss          `json:"oss"`
+	Upload    Upload       `json:"upload"`
+	Storage   Storage      `json:"storage"`
+	Gc        Gc           `json:"gc"`
+	Thumbnail Thumbnail    `json:"thumbnail"`
+	Archive   ArchiveIndex `json:"archive"`
+	Scan      Scan         `json:"scan"`
+	Retention Retention    `json:"retention"`
+	Auth      Auth         `json:"auth"`
+	Database  Database     `json:"database"`
 }
 
 var Cfg *Config
 
+// 配置文件路径，重新加载时使用
+var configPath string
+
 /**
  * @description: 读取初始化文件到结构体
  * @param {string} configFilePath config文件路径
@@ -48,6 +159,7 @@ var Cfg *Config
  */
 func Init(configFilePath string) error {
 	Cfg = &Config{}
+	configPath = configFilePath
 
 	configData, err := os.ReadFile(configFilePath)
 	if err != nil {
@@ -61,3 +173,21 @@ func Init(configFilePath string) error {
 
 	return nil
 }
+
+/**
+ * @description: 重新读取配置文件，返回新的配置，不替换Cfg，由调用方决定哪些配置运行时生效
+ * @return {*}
+ */
+func Reload() (*Config, error) {
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	cfg := &Config{}
+	if err = json.Unmarshal(configData, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,233 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-30 10:55:17
+ * @LastEditTime: 2024-09-30 17:26:48
+ * @FilePath: \UserFeedBack\dbwrapper\archive.go
+ * @Description: 压缩包文件列表与内容索引
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 压缩包中不存在该文件
+var ErrArchiveMemberNotFound = errors.New("archive member not found")
+
+// 搜索结果中关键字前后保留的字符数
+const snippetContext = 80
+
+// 待建立索引的压缩包，引用同一对象的附件记录共用一份索引
+type ArchiveTask struct {
+	FilePath string
+	FileName string
+	FileSize int64
+}
+
+// 写入索引的压缩包文件
+type ArchiveEntry struct {
+	Path       string
+	Size       int64
+	ModifiedAt time.Time
+	Content    string
+	Indexed    bool
+}
+
+/**
+ * @description: 查询待建立索引的压缩包
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func QueryPendingArchives(limit int) ([]ArchiveTask, error) {
+	rows, err := db.Query("SELECT file_path, MIN(file_name), MAX(file_size) FROM file WHERE archive_status = ? AND expired_at IS NULL GROUP BY file_path LIMIT ?",
+		dto.ArchiveIndexPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []ArchiveTask{}
+	for rows.Next() {
+		var (
+			task     ArchiveTask
+			fileSize sql.NullInt64
+		)
+		if err = rows.Scan(&task.FilePath, &task.FileName, &fileSize); err != nil {
+			return nil, err
+		}
+		task.FileSize = fileSize.Int64
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+/**
+ * @description: 写入压缩包的文件列表和内容，替换已有的索引
+ * @param {string} filePath 对象路径
+ * @param {[]ArchiveEntry} entries 压缩包中的文件
+ * @return {*}
+ */
+func SaveArchiveIndex(filePath string, entries []ArchiveEntry) error {
+	// 开启事务
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// 确保失败时能正确回滚
+	defer tx.Rollback()
+
+	if err = deleteArchiveMembers(tx, []string{filePath}); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		var modifiedAt sql.NullTime
+		if !entry.ModifiedAt.IsZero() {
+			modifiedAt = sql.NullTime{Time: entry.ModifiedAt, Valid: true}
+		}
+
+		var content sql.NullString
+		if entry.Indexed {
+			content = sql.NullString{String: entry.Content, Valid: true}
+		}
+
+		_, err = tx.Exec("INSERT INTO archive_member (file_path, member_path, member_size, modified_at, content) VALUES (?, ?, ?, ?, ?)",
+			filePath, entry.Path, entry.Size, modifiedAt, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE file SET archive_status = ? WHERE file_path = ? AND archive_status = ?",
+		dto.ArchiveIndexReady, filePath, dto.ArchiveIndexPending)
+	if err != nil {
+		return err
+	}
+
+	// 提交事务
+	return tx.Commit()
+}
+
+/**
+ * @description: 记录压缩包无法建立索引
+ * @param {string} filePath 对象路径
+ * @param {string} status 索引状态
+ * @return {*}
+ */
+func FinishArchive(filePath string, status string) error {
+	_, err := db.Exec("UPDATE file SET archive_status = ? WHERE file_path = ? AND archive_status = ?",
+		status, filePath, dto.ArchiveIndexPending)
+	return err
+}
+
+/**
+ * @description: 查询压缩包中的文件列表
+ * @param {string} filePath 对象路径
+ * @return {*}
+ */
+func QueryArchiveMembers(filePath string) ([]dto.ArchiveMember, error) {
+	rows, err := db.Query("SELECT member_id, member_path, member_size, modified_at, content IS NOT NULL FROM archive_member WHERE file_path = ? ORDER BY member_id",
+		filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []dto.ArchiveMember{}
+	for rows.Next() {
+		var (
+			member     dto.ArchiveMember
+			modifiedAt sql.NullTime
+		)
+		if err = rows.Scan(&member.MemberID, &member.Path, &member.Size, &modifiedAt, &member.Indexed); err != nil {
+			return nil, err
+		}
+		member.ModifiedAt = modifiedAt.Time
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+/**
+ * @description: 查询压缩包中的单个文件
+ * @param {string} filePath 压缩包的对象路径
+ * @param {int64} memberID 文件id
+ * @return {*}
+ */
+func QueryArchiveMember(filePath string, memberID int64) (*dto.ArchiveMember, error) {
+	var (
+		member     dto.ArchiveMember
+		modifiedAt sql.NullTime
+	)
+	err := db.QueryRow("SELECT member_id, member_path, member_size, modified_at, content IS NOT NULL FROM archive_member WHERE file_path = ? AND member_id = ?",
+		filePath, memberID).Scan(&member.MemberID, &member.Path, &member.Size, &modifiedAt, &member.Indexed)
+	if err == sql.ErrNoRows {
+		return nil, ErrArchiveMemberNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	member.ModifiedAt = modifiedAt.Time
+
+	return &member, nil
+}
+
+/**
+ * @description: 在已索引的压缩包内容中搜索关键字，按反馈从新到旧返回
+ * @param {string} keyword 关键字
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func SearchArchives(keyword string, limit int) ([]dto.ArchiveSearchHit, error) {
+	pattern := "%" + escapeLike(keyword) + "%"
+
+	rows, err := db.Query(`
+        SELECT
+            fl.feedback_id, fl.file_id, fl.file_name, m.member_id, m.member_path,
+            `+sqlDialect.snippet("m.content")+`
+        FROM
+            archive_member m
+        JOIN
+            file fl ON fl.file_path = m.file_path
+        WHERE
+            m.content LIKE ? ESCAPE '!' AND fl.expired_at IS NULL
+        ORDER BY
+            fl.feedback_id DESC, m.member_id
+        LIMIT ?`,
+		keyword, snippetContext, snippetContext, keyword, snippetContext, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hits := []dto.ArchiveSearchHit{}
+	for rows.Next() {
+		var hit dto.ArchiveSearchHit
+		if err = rows.Scan(&hit.FeedbackID, &hit.FileID, &hit.FileName, &hit.MemberID, &hit.MemberPath, &hit.Snippet); err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit)
+	}
+
+	return hits, rows.Err()
+}
+
+/**
+ * @description: 在事务中删除压缩包的索引
+ * @param {*sqlTx} tx 事务
+ * @param {[]string} filePaths 对象路径
+ * @return {*}
+ */
+func deleteArchiveMembers(tx *sqlTx, filePaths []string) error {
+	if len(filePaths) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM archive_member WHERE file_path IN ("+placeholders(len(filePaths))+")", stringArgs(filePaths)...)
+	return err
+}
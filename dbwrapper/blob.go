@@ -0,0 +1,257 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-26 10:08:52
+ * @LastEditTime: 2024-09-26 17:31:05
+ * @FilePath: \UserFeedBack\dbwrapper\blob.go
+ * @Description: 内容寻址附件的引用计数
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"UserFeedBack/osswrapper"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+)
+
+/**
+ * @description: 查询已有附件记录引用且存储上未丢失的sha256，这些内容无需再次上传
+ * @param {[]string} hashes sha256
+ * @return {*}
+ */
+func QueryExistingBlobs(hashes []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	if len(hashes) == 0 {
+		return existing, nil
+	}
+
+	rows, err := db.Query("SELECT DISTINCT sha256 FROM file WHERE missing_at IS NULL AND quarantine_path IS NULL AND expired_at IS NULL AND sha256 IN ("+placeholders(len(hashes))+")",
+		stringArgs(hashes)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sha256 string
+		if err = rows.Scan(&sha256); err != nil {
+			return nil, err
+		}
+		existing[sha256] = true
+	}
+
+	return existing, rows.Err()
+}
+
+/**
+ * @description: 在事务中查询其中仍被引用的对象路径，删除前用于再次确认，避免删除刚被新反馈引用的共享对象
+ * @param {*sqlTx} tx 事务
+ * @param {[]string} objectKeys 对象路径
+ * @param {time.Time} now 当前时间，用于判断上传登记是否过期
+ * @return {*}
+ */
+func objectReferences(tx *sqlTx, objectKeys []string, now time.Time) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	if len(objectKeys) == 0 {
+		return referenced, nil
+	}
+
+	type referenceQuery struct {
+		query string
+		args  []any
+	}
+
+	in := placeholders(len(objectKeys))
+	keyArgs := stringArgs(objectKeys)
+	queries := []referenceQuery{
+		{"SELECT DISTINCT file_path FROM file WHERE expired_at IS NULL AND file_path IN (" + in + ")", keyArgs},
+		{"SELECT DISTINCT thumbnail_path FROM file WHERE expired_at IS NULL AND thumbnail_path IN (" + in + ")", keyArgs},
+		{"SELECT DISTINCT quarantine_path FROM file WHERE expired_at IS NULL AND quarantine_path IN (" + in + ")", keyArgs},
+		{"SELECT DISTINCT object_key FROM upload_ticket WHERE feedback_id IS NULL AND expires_at > ? AND object_key IN (" + in + ")", append([]any{now}, keyArgs...)},
+		{"SELECT DISTINCT object_key FROM upload_session WHERE status = ? AND object_key IN (" + in + ")", append([]any{dto.UploadSessionUploading}, keyArgs...)},
+	}
+
+	// 声明了相同sha256的登记上传到暂存路径，提交时会复制到共用对象，同样视为引用
+	blobKeys := make(map[string]string)
+	for _, objectKey := range objectKeys {
+		if sha256, ok := osswrapper.BlobSha256(objectKey); ok {
+			blobKeys[sha256] = objectKey
+		}
+	}
+	if len(blobKeys) > 0 {
+		hashes := make([]string, 0, len(blobKeys))
+		for sha256 := range blobKeys {
+			hashes = append(hashes, sha256)
+		}
+		queries = append(queries, referenceQuery{"SELECT DISTINCT sha256 FROM upload_ticket WHERE feedback_id IS NULL AND expires_at > ? AND sha256 IN (" + placeholders(len(hashes)) + ")", append([]any{now}, stringArgs(hashes)...)})
+	}
+
+	for _, item := range queries {
+		rows, err := tx.Query(item.query, item.args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var value string
+			if err = rows.Scan(&value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if objectKey, ok := blobKeys[value]; ok {
+				value = objectKey
+			}
+			referenced[value] = true
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return referenced, nil
+}
+
+// 附件记录引用的对象及其派生对象
+type fileObjects struct {
+	filePaths    []string
+	derivedPaths map[string][]string // 缩略图和隔离的副本
+}
+
+/**
+ * @description: 在事务中查询符合条件的附件引用的对象，同时锁住引用相同对象的记录
+ * @param {*sqlTx} tx 事务
+ * @param {string} condition 附件记录的筛选条件
+ * @param {...any} args 条件参数
+ * @return {*}
+ */
+func lockFileObjects(tx *sqlTx, condition string, args ...any) (*fileObjects, error) {
+	rows, err := tx.Query("SELECT file_path, thumbnail_path, quarantine_path FROM file WHERE file_path IN (SELECT file_path FROM file WHERE "+condition+")"+sqlDialect.forUpdate(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := &fileObjects{derivedPaths: make(map[string][]string)}
+	for rows.Next() {
+		var (
+			filePath       string
+			thumbnailPath  sql.NullString
+			quarantinePath sql.NullString
+		)
+		if err = rows.Scan(&filePath, &thumbnailPath, &quarantinePath); err != nil {
+			return nil, err
+		}
+		objects.filePaths = append(objects.filePaths, filePath)
+		for _, derived := range []sql.NullString{thumbnailPath, quarantinePath} {
+			if derived.Valid && !slices.Contains(objects.derivedPaths[filePath], derived.String) {
+				objects.derivedPaths[filePath] = append(objects.derivedPaths[filePath], derived.String)
+			}
+		}
+	}
+
+	return objects, rows.Err()
+}
+
+/**
+ * @description: 在事务中把已没有附件记录引用的对象及其派生对象加入待删除队列，并删除压缩包的索引
+ * @param {*sqlTx} tx 事务
+ * @param {*fileObjects} objects 删除或过期前附件记录引用的对象
+ * @return {*}
+ */
+func releaseFileObjects(tx *sqlTx, objects *fileObjects) error {
+	filePaths, err := unreferencedObjectKeys(tx, objects.filePaths)
+	if err != nil {
+		return err
+	}
+
+	// 缩略图和隔离的副本随原图一起删除
+	objectKeys := slices.Clone(filePaths)
+	for _, filePath := range filePaths {
+		objectKeys = append(objectKeys, objects.derivedPaths[filePath]...)
+	}
+	if err = enqueueObjectDeletion(tx, objectKeys); err != nil {
+		return err
+	}
+
+	// 压缩包的索引随对象一起删除
+	return deleteArchiveMembers(tx, filePaths)
+}
+
+/**
+ * @description: 在事务中筛选出已没有未过期的附件记录引用的对象
+ * @param {*sqlTx} tx 事务
+ * @param {[]string} objectKeys 对象路径，可重复
+ * @return {*}
+ */
+func unreferencedObjectKeys(tx *sqlTx, objectKeys []string) ([]string, error) {
+	result := []string{}
+	seen := make(map[string]bool)
+	for _, objectKey := range objectKeys {
+		if seen[objectKey] {
+			continue
+		}
+		seen[objectKey] = true
+
+		// 聚合查询不能加锁，锁住引用的记录后再判断是否存在
+		var fileID int
+		err := tx.QueryRow("SELECT file_id FROM file WHERE file_path = ? AND expired_at IS NULL LIMIT 1"+sqlDialect.forUpdate(), objectKey).Scan(&fileID)
+		if err == sql.ErrNoRows {
+			result = append(result, objectKey)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+/**
+ * @description: 判断sha256对应的内容是否已经校验过，有附件记录即说明写入时已校验，条件与QueryExistingBlobs一致，
+ * 隔离后共用对象已被删除，需要重新校验并复制
+ * @param {string} sha256
+ * @return {*}
+ */
+func blobVerified(sha256 string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM file WHERE sha256 = ? AND missing_at IS NULL AND quarantine_path IS NULL AND expired_at IS NULL", sha256).Scan(&count)
+	return count > 0, err
+}
+
+/**
+ * @description: 生成n个参数的占位符
+ * @param {int} n 参数个数
+ * @return {*}
+ */
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+/**
+ * @description: 字符串切片转换为查询参数
+ * @param {[]string} values
+ * @return {*}
+ */
+func stringArgs(values []string) []any {
+	args := make([]any, 0, len(values))
+	for _, value := range values {
+		args = append(args, value)
+	}
+
+	return args
+}
+
+/**
+ * @description: 空字符串写入数据库时存为NULL
+ * @param {string} value
+ * @return {*}
+ */
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
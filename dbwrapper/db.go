@@ -11,83 +11,85 @@ import (
 	"UserFeedBack/configwrapper"
 	"UserFeedBack/dto"
 	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
 	"database/sql"
+	"errors"
 	"fmt"
-	"sort"
-	"strings"
 	"sync"
 	"time"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
+// 反馈不存在
+var ErrFeedbackNotFound = errors.New("feedback not found")
+
 var (
-	// 数据库单例
-	db *sql.DB
+	// 当前使用的反馈存储
+	store *sqlStore
+	// 数据库单例，与store使用同一个连接
+	db *sqlDB
+	// 当前数据库的方言
+	sqlDialect dialect
 	// 单例标志
 	once sync.Once
 )
 
 /**
- * @description: 初始化数据库连接
+ * @description: 按配置连接数据库，不检查表结构，供迁移命令使用
  * @return {*}
  */
-func InitDB() {
+func OpenDB() error {
+	var err error
 	once.Do(func() {
-		var err error
-		// 连接到 MySQL 数据库
-		address := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-			configwrapper.Cfg.Database.User,
-			configwrapper.Cfg.Database.Password,
-			configwrapper.Cfg.Database.Host,
-			configwrapper.Cfg.Database.Port,
-			configwrapper.Cfg.Database.Schema)
-		db, err = sql.Open("mysql", address)
+		cfg := configwrapper.Cfg.Database
+		switch cfg.Driver {
+		case "", DriverMySQL:
+			store, err = newMySQLStore(cfg)
+		case DriverSQLite:
+			store, err = newSQLiteStore(cfg)
+		case DriverPostgres:
+			store, err = newPostgresStore(cfg)
+		default:
+			err = fmt.Errorf("unknown database driver: %s", cfg.Driver)
+		}
 		if err != nil {
-			logwrapper.Logger.Fatalf("Failed to connect to database: %v", err)
+			return
 		}
 
-		// 检查连接是否成功
-		if err = db.Ping(); err != nil {
-			logwrapper.Logger.Fatalf("Failed to ping database: %v", err)
-		}
+		db = store.db
+		sqlDialect = store.dialect
+		logwrapper.Logger.Infof("database driver: %s", store.Name())
+	})
 
-		// 检查 FeedBack 表是否存在，如果不存在则创建它
-		createTabFeedback := `
-		CREATE TABLE IF NOT EXISTS feedback (
-			feedback_id INT AUTO_INCREMENT PRIMARY KEY,
-			bug_description TEXT NOT NULL,
-			impacted_module TEXT NOT NULL,
-			occurring_frequency INT NOT NULL,
-			reproduce_steps TEXT NOT NULL,
-			user_info TEXT,
-			process_info TEXT,
-			email TEXT,
-			app_version TEXT,
-			time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-		`
-
-		if _, err := db.Exec(createTabFeedback); err != nil {
-			logwrapper.Logger.Fatalf("Failed to create table: %v", err)
-		}
+	return err
+}
 
-		// 检查 File 表是否存在，如果不存在则创建它
-		createTabFile := `
-		CREATE TABLE IF NOT EXISTS file (
-	    	file_id INT AUTO_INCREMENT PRIMARY KEY,
-			feedback_id INT,
-			file_name VARCHAR(255) NOT NULL,
-			file_path VARCHAR(255) NOT NULL,
-			file_size BIGINT,
-			FOREIGN KEY (feedback_id) REFERENCES feedback(feedback_id) ON DELETE CASCADE
-		);
-		`
-
-		if _, err := db.Exec(createTabFile); err != nil {
-			logwrapper.Logger.Fatalf("Failed to create table: %v", err)
+/**
+ * @description: 连接数据库，开启自动迁移时执行未执行的迁移，否则要求表结构已是最新
+ * @return {*}
+ */
+func InitDB() {
+	if err := OpenDB(); err != nil {
+		logwrapper.Logger.Fatalf("Failed to open database: %v", err)
+	}
+
+	if configwrapper.Cfg.Database.AutoMigrate {
+		migrations, err := MigrateUp()
+		if err != nil {
+			logwrapper.Logger.Fatalf("Failed to migrate database: %v", err)
 		}
-	})
+		for _, migration := range migrations {
+			logwrapper.Logger.Infof("applied migration %d_%s", migration.Version, migration.Name)
+		}
+		return
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		logwrapper.Logger.Fatalf("Failed to query migrations: %v", err)
+	}
+	if len(pending) > 0 {
+		logwrapper.Logger.Fatalf("Database schema is not up to date, %d migrations pending, run \"migrate up\" or enable database.autoMigrate", len(pending))
+	}
 }
 
 /**
@@ -95,25 +97,76 @@ func InitDB() {
  * @return {*}
  */
 func CloseDB() error {
-	return db.Close()
+	return store.Close()
 }
 
 /**
- * @description: 提交反馈数据到数据库
+ * @description: 提交反馈数据到数据库，附件须已通过上传登记，文件信息以存储上的为准
  * @param {dto.FeedbackUpload} feedback
  * @return {*}
  */
-func InsertFeedback(feedback dto.FeedbackUpload) error {
+func (s *sqlStore) InsertFeedback(feedback dto.FeedbackUpload) error {
+	// 只接受已登记且确实已上传的文件，收集所有未通过的附件一并返回；
+	// 读取存储的校验在开启事务前完成，事务中只再次确认登记
+	var (
+		rejections    []dto.FileRejection
+		verifiedFiles []*verifiedFile
+		uniqueFiles   []*verifiedFile
+	)
+	prepared := make(map[string]*verifiedFile)
+	for _, fileInfo := range feedback.Files {
+		// 同一登记的文件可被多个附件引用，只校验一次
+		if verified, ok := prepared[fileInfo.FilePathOnOss]; ok {
+			verifiedFiles = append(verifiedFiles, verified)
+			continue
+		}
+
+		verified, err := prepareTicketFile(feedback.UploadTicket, fileInfo)
+		var attachmentErr *AttachmentError
+		if errors.As(err, &attachmentErr) {
+			rejections = append(rejections, attachmentErr.Rejections...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		prepared[fileInfo.FilePathOnOss] = verified
+		uniqueFiles = append(uniqueFiles, verified)
+		verifiedFiles = append(verifiedFiles, verified)
+	}
+
+	// 按附件策略校验实际上传的文件
+	specs := make([]osswrapper.FileSpec, 0, len(verifiedFiles))
+	for _, verified := range verifiedFiles {
+		specs = append(specs, osswrapper.FileSpec{Name: verified.FileName, ObjectKey: verified.ObjectKey, Size: verified.Size, ContentType: verified.ContentType})
+	}
+	rejections = append(rejections, osswrapper.CheckFiles(specs)...)
+
+	for _, verified := range uniqueFiles {
+		reason, err := osswrapper.CheckObjectContent(verified.ObjectKey, verified.Size)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			rejections = append(rejections, dto.FileRejection{File: verified.FileName, ObjectKey: verified.ObjectKey, Reason: reason})
+		}
+	}
+
+	if len(rejections) > 0 {
+		return &AttachmentError{Rejections: rejections}
+	}
+
 	// 开启事务
-	tx, err := db.Begin()
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
 	// 确保失败时能正确回滚
 	defer tx.Rollback()
 
-	// 插入反馈数据
-	result, err := tx.Exec("INSERT INTO feedback (bug_description, impacted_module, occurring_frequency, reproduce_steps, user_info, process_info, email, app_version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+	// 插入反馈数据，并获取到插入的主键ID，也就是feedbackID
+	feedbackID, err := s.dialect.insertID(tx, "INSERT INTO feedback (bug_description, impacted_module, occurring_frequency, reproduce_steps, user_info, process_info, email, app_version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", "feedback_id",
 		feedback.BugDescription,
 		feedback.ImpactedModule,
 		feedback.OccurringFrequency,
@@ -126,19 +179,52 @@ func InsertFeedback(feedback dto.FeedbackUpload) error {
 		return err
 	}
 
-	// 获取到最后插入的主键ID，也就是feedbackID
-	feedbackID, err := result.LastInsertId()
-	if err != nil {
-		return err
+	// 校验期间登记可能已过期或被其他反馈使用
+	for _, verified := range verifiedFiles {
+		err = recheckTicketFile(tx, feedback.UploadTicket, verified.TicketKey, feedbackID)
+		var attachmentErr *AttachmentError
+		if errors.As(err, &attachmentErr) {
+			rejections = append(rejections, attachmentErr.Rejections...)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(rejections) > 0 {
+		return &AttachmentError{Rejections: rejections}
 	}
 
-	// 插入文件数据
-	for _, fileInfo := range feedback.Files {
-		_, err = tx.Exec("INSERT INTO file (feedback_id, file_name, file_path, file_size) VALUES (?, ?, ?, ?)",
-			feedbackID, fileInfo.FileName, fileInfo.FilePathOnOss, fileInfo.FileSize)
+	// 插入文件数据，附件等待病毒扫描，图片附件等待生成缩略图，压缩包等待建立索引
+	for _, verified := range verifiedFiles {
+		var thumbnailStatus, archiveStatus string
+		if osswrapper.IsThumbnailCandidate(verified.FileName, verified.ContentType) {
+			thumbnailStatus = dto.ThumbnailPending
+		}
+		if osswrapper.IsArchiveCandidate(verified.FileName, verified.ContentType) {
+			archiveStatus = dto.ArchiveIndexPending
+		}
+
+		_, err = tx.Exec("INSERT INTO file (feedback_id, file_name, file_path, file_size, etag, content_type, sha256, thumbnail_status, archive_status, scan_status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			feedbackID, verified.FileName, verified.ObjectKey, verified.Size, verified.ETag, verified.ContentType, nullString(verified.Sha256), nullString(thumbnailStatus), nullString(archiveStatus), dto.ScanPending)
 		if err != nil {
 			return err
 		}
+
+		if err = consumeTicketFile(tx, feedback.UploadTicket, verified.TicketKey, feedbackID); err != nil {
+			return err
+		}
+	}
+
+	// 内容已复制到共用对象，暂存的对象不再需要
+	stagingKeys := []string{}
+	for _, verified := range uniqueFiles {
+		if verified.TicketKey != verified.ObjectKey {
+			stagingKeys = append(stagingKeys, verified.TicketKey)
+		}
+	}
+	if err = enqueueObjectDeletion(tx, stagingKeys); err != nil {
+		return err
 	}
 
 	// 提交事务
@@ -150,59 +236,85 @@ func InsertFeedback(feedback dto.FeedbackUpload) error {
 }
 
 /**
- * @description: 查询所有反馈信息
+ * @description: 按条件分页查询反馈信息
+ * @param {dto.FeedbackFilter} filter 查询条件和排序
  * @param {int} pageIndex 分页索引
  * @param {int} pageSize 分页大小
  * @return {*}
  */
-func QueryFeedback(pageIndex int, pageSize int) (dto.FeedbackQueryAll, error) {
-	var (
-		query      string
-		realResult dto.FeedbackQueryAll
-		result     []dto.FeedbackQueryOne
-		resultMap  map[int]*dto.FeedbackQueryOne
-	)
+func (s *sqlStore) QueryFeedback(filter dto.FeedbackFilter, pageIndex int, pageSize int) (dto.FeedbackQueryAll, error) {
+	var realResult dto.FeedbackQueryAll
+
+	where, args := feedbackConditions(filter)
+	orderBy, err := feedbackOrderBy(filter)
+	if err != nil {
+		return realResult, err
+	}
 
-	// 查询feedback表的总条数
+	// 查询符合条件的总条数
 	var totalCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM feedback").Scan(&totalCount)
+	err = s.db.QueryRow("SELECT COUNT(*) FROM feedback f"+where, args...).Scan(&totalCount)
 	if err != nil {
 		return realResult, err
 	}
 
+	// 没有符合条件的反馈时直接返回空页
+	if totalCount == 0 {
+		realResult.PageData = []dto.FeedbackQueryOne{}
+		return realResult, nil
+	}
+
 	// 越界时修正为最后的index
-	if pageIndex*pageSize > totalCount {
-		pageIndex = (totalCount+pageSize-1)/pageSize - 1
+	if pageIndex*pageSize >= totalCount {
+		pageIndex = max(0, (totalCount+pageSize-1)/pageSize-1)
 	}
 
 	// 按分页大小和索引查询对应的反馈信息
-	var limit string
-	if pageIndex >= 0 {
-		limit = fmt.Sprintf(" LIMIT %d OFFSET %d", pageSize, pageIndex*pageSize)
-	}
-
-	query = fmt.Sprintf(`  
-        SELECT  
-            f.feedback_id, f.bug_description, f.impacted_module, f.occurring_frequency, f.reproduce_steps, f.user_info, f.process_info, f.email, f.app_version, f.time_stamp,  
-            fl.file_name, fl.file_path, fl.file_size  
-        FROM  
-            (SELECT feedback_id FROM feedback ORDER BY feedback_id%s) AS sub  
-        JOIN  
-            feedback f ON sub.feedback_id = f.feedback_id  
-        LEFT JOIN  
-            file fl ON f.feedback_id = fl.feedback_id  
-        ORDER BY  
-            f.feedback_id;  
-    `, limit)
-
-	rows, err := db.Query(query)
+	limit := " LIMIT ? OFFSET ?"
+	args = append(args, pageSize, pageIndex*pageSize)
+
+	query := `
+        SELECT
+            f.feedback_id, f.bug_description, f.impacted_module, f.occurring_frequency, f.reproduce_steps, f.user_info, f.process_info, f.email, f.app_version, f.time_stamp,
+            fl.file_id, fl.file_name, fl.file_path, fl.file_size, fl.content_type, fl.missing_at, fl.thumbnail_path, fl.thumbnail_status, fl.archive_status, fl.scan_status, fl.scan_result, fl.expired_at
+        FROM
+            (SELECT f.feedback_id FROM feedback f` + where + ` ORDER BY ` + orderBy + limit + `) AS sub
+        JOIN
+            feedback f ON sub.feedback_id = f.feedback_id
+        LEFT JOIN
+            file fl ON f.feedback_id = fl.feedback_id
+        ORDER BY
+            ` + orderBy + `, fl.file_id`
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return realResult, err
 	}
 	defer rows.Close()
 
-	result = []dto.FeedbackQueryOne{}
-	resultMap = make(map[int]*dto.FeedbackQueryOne)
+	result, err := scanFeedbackRows(rows)
+	if err != nil {
+		return realResult, err
+	}
+
+	// 填充反馈结果
+	realResult.PageData = result
+	realResult.TotalSize = totalCount
+	realResult.CurrentPageIndex = pageIndex
+
+	return realResult, nil
+}
+
+/**
+ * @description: 将反馈与附件的连接查询结果按反馈id聚合
+ * @param {*sql.Rows} rows 查询结果
+ * @return {*}
+ */
+func scanFeedbackRows(rows *sql.Rows) ([]dto.FeedbackQueryOne, error) {
+	result := []dto.FeedbackQueryOne{}
+	resultMap := make(map[int]*dto.FeedbackQueryOne)
+	// 反馈id在查询结果中首次出现的顺序
+	order := []int{}
 
 	// 处理查询结果
 	for rows.Next() {
@@ -217,12 +329,21 @@ func QueryFeedback(pageIndex int, pageSize int) (dto.FeedbackQueryAll, error) {
 			email              string
 			appVersion         string
 			timeStamp          time.Time
+			fileID             sql.NullInt64
 			filename           sql.NullString
 			filePathOnOss      sql.NullString
 			fileSize           sql.NullInt64
+			contentType        sql.NullString
+			missingAt          sql.NullTime
+			thumbnailPath      sql.NullString
+			thumbnailStatus    sql.NullString
+			archiveStatus      sql.NullString
+			scanStatus         sql.NullString
+			scanResult         sql.NullString
+			expiredAt          sql.NullTime
 		)
 
-		err = rows.Scan(
+		err := rows.Scan(
 			&feedbackID,
 			&bugDescription,
 			&impactedModule,
@@ -233,33 +354,61 @@ func QueryFeedback(pageIndex int, pageSize int) (dto.FeedbackQueryAll, error) {
 			&email,
 			&appVersion,
 			&timeStamp,
+			&fileID,
 			&filename,
 			&filePathOnOss,
 			&fileSize,
+			&contentType,
+			&missingAt,
+			&thumbnailPath,
+			&thumbnailStatus,
+			&archiveStatus,
+			&scanStatus,
+			&scanResult,
+			&expiredAt,
 		)
 		if err != nil {
-			return realResult, err
+			return nil, err
 		}
 
 		// 如果已经有了该feedbackID的记录，则追加文件信息
 		if feedback, exists := resultMap[feedbackID]; exists {
 			if filename.Valid {
 				feedback.Files = append(feedback.Files, dto.FeedbackFile{
-					FileName:      filename.String,
-					FilePathOnOss: "https://" + configwrapper.Cfg.Oss.BucketName + "." + configwrapper.Cfg.Oss.OssEndpoint + "/" + filePathOnOss.String,
-					FileSize:      fileSize.Int64,
+					FileID:          int(fileID.Int64),
+					FileName:        filename.String,
+					FilePathOnOss:   filePathOnOss.String,
+					FileSize:        fileSize.Int64,
+					ContentType:     contentType.String,
+					Missing:         missingAt.Valid,
+					Expired:         expiredAt.Valid,
+					ThumbnailUrl:    thumbnailPath.String,
+					ThumbnailStatus: thumbnailStatus.String,
+					ArchiveStatus:   archiveStatus.String,
+					ScanStatus:      scanStatus.String,
+					ScanResult:      scanResult.String,
 				})
 			}
 		} else { // 如果还没有该feedbackID的记录，则创建新的记录
 			files := []dto.FeedbackFile{}
 			if filename.Valid {
 				files = append(files, dto.FeedbackFile{
-					FileName:      filename.String,
-					FilePathOnOss: "https://" + configwrapper.Cfg.Oss.BucketName + "." + configwrapper.Cfg.Oss.OssEndpoint + "/" + filePathOnOss.String,
-					FileSize:      fileSize.Int64,
+					FileID:          int(fileID.Int64),
+					FileName:        filename.String,
+					FilePathOnOss:   filePathOnOss.String,
+					FileSize:        fileSize.Int64,
+					ContentType:     contentType.String,
+					Missing:         missingAt.Valid,
+					Expired:         expiredAt.Valid,
+					ThumbnailUrl:    thumbnailPath.String,
+					ThumbnailStatus: thumbnailStatus.String,
+					ArchiveStatus:   archiveStatus.String,
+					ScanStatus:      scanStatus.String,
+					ScanResult:      scanResult.String,
 				})
 			}
 
+			order = append(order, feedbackID)
 			resultMap[feedbackID] = &dto.FeedbackQueryOne{
 				FeedbackID:         feedbackID,
 				AppVersion:         appVersion,
@@ -276,24 +425,47 @@ func QueryFeedback(pageIndex int, pageSize int) (dto.FeedbackQueryAll, error) {
 		}
 	}
 
-	// map是无序的，这里需要对key排序后遍历
-	keys := make([]int, 0, len(resultMap))
-	for k := range resultMap {
-		keys = append(keys, k)
+	// 按查询结果中首次出现的顺序返回，保留查询的排序
+	for _, k := range order {
+		result = append(result, *resultMap[k])
 	}
 
-	sort.Ints(keys)
+	return result, rows.Err()
+}
 
-	for _, k := range keys {
-		result = append(result, *resultMap[k])
+/**
+ * @description: 按id查询反馈信息，不存在的id会被忽略
+ * @param {[]int} ids 反馈id
+ * @return {*}
+ */
+func (s *sqlStore) QueryFeedbackByIDs(ids []int) ([]dto.FeedbackQueryOne, error) {
+	if len(ids) == 0 {
+		return []dto.FeedbackQueryOne{}, nil
 	}
 
-	// 填充反馈结果
-	realResult.PageData = result
-	realResult.TotalSize = totalCount
-	realResult.CurrentPageIndex = pageIndex
+	args := make([]any, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
 
-	return realResult, nil
+	rows, err := s.db.Query(`
+        SELECT
+            f.feedback_id, f.bug_description, f.impacted_module, f.occurring_frequency, f.reproduce_steps, f.user_info, f.process_info, f.email, f.app_version, f.time_stamp,
+            fl.file_id, fl.file_name, fl.file_path, fl.file_size, fl.content_type, fl.missing_at, fl.thumbnail_path, fl.thumbnail_status, fl.archive_status, fl.scan_status, fl.scan_result, fl.expired_at
+        FROM
+            feedback f
+        LEFT JOIN
+            file fl ON f.feedback_id = fl.feedback_id
+        WHERE
+            f.feedback_id IN (`+placeholders(len(ids))+`)
+        ORDER BY
+            f.feedback_id, fl.file_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanFeedbackRows(rows)
 }
 
 type FeedbackRelatedFile struct {
@@ -306,7 +478,7 @@ type FeedbackRelatedFile struct {
  * @param {[]int} feedbackIDs 要查询的feedbackid数组
  * @return {*}
  */
-func QueryRelatedFilesByFeedbackID(feedbackIDs []int) []FeedbackRelatedFile {
+func (s *sqlStore) QueryRelatedFilesByFeedbackID(feedbackIDs []int) []FeedbackRelatedFile {
 	var feedbackRelatedFiles []FeedbackRelatedFile
 
 	if len(feedbackIDs) == 0 {
@@ -322,7 +494,7 @@ func QueryRelatedFilesByFeedbackID(feedbackIDs []int) []FeedbackRelatedFile {
 			FileOssPath: []string{},
 		})
 
-		rows, err := db.Query(query, feedbackID)
+		rows, err := s.db.Query(query, feedbackID)
 		if err != nil {
 			logwrapper.Logger.Error(err)
 			return feedbackRelatedFiles
@@ -350,24 +522,70 @@ func QueryRelatedFilesByFeedbackID(feedbackIDs []int) []FeedbackRelatedFile {
 }
 
 /**
- * @description: 删除feedback表
+ * @description: 逐条删除反馈，每条反馈在一个事务中删除记录并将其附件加入待删除队列
  * @param {[]int} feedbackIDs feedbackid数组
- * @return {*}
+ * @return {*} 每条反馈的删除结果
  */
-func DeleteFeedbackByID(feedbackIDs []int) {
-	// 构造删除语句
-	var builder strings.Builder
-	builder.WriteString("DELETE FROM feedback WHERE feedback_id IN (")
-
-	for i, id := range feedbackIDs {
-		builder.WriteString(fmt.Sprintf("%d", id))
-		if i < len(feedbackIDs)-1 {
-			builder.WriteString(",")
+func (s *sqlStore) DeleteFeedbackByID(feedbackIDs []int) []dto.DeleteFeedbackResult {
+	results := make([]dto.DeleteFeedbackResult, 0, len(feedbackIDs))
+
+	for _, feedbackID := range feedbackIDs {
+		result := dto.DeleteFeedbackResult{FeedbackID: feedbackID}
+
+		if err := s.deleteFeedback(feedbackID); err != nil {
+			if err != ErrFeedbackNotFound {
+				logwrapper.Logger.Error("error deleting feedback:", feedbackID, err)
+			}
+			result.Error = err.Error()
+		} else {
+			result.Deleted = true
 		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+/**
+ * @description: 删除单条反馈，附件由待删除队列异步从存储上删除
+ * @param {int} feedbackID 反馈id
+ * @return {*}
+ */
+func (s *sqlStore) deleteFeedback(feedbackID int) error {
+	// 开启事务
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// 确保失败时能正确回滚
+	defer tx.Rollback()
+
+	// 查询关联的文件，同时锁住引用相同对象的记录，避免并发删除时都认为对象仍被引用
+	objects, err := lockFileObjects(tx, "feedback_id = ?", feedbackID)
+	if err != nil {
+		return err
 	}
 
-	builder.WriteString(")")
+	// 删除反馈，文件记录级联删除
+	result, err := tx.Exec("DELETE FROM feedback WHERE feedback_id = ?", feedbackID)
+	if err != nil {
+		return err
+	}
 
-	// 执行删除语句
-	db.Exec(builder.String())
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrFeedbackNotFound
+	}
+
+	// 不再被其他反馈引用的附件加入待删除队列
+	if err = releaseFileObjects(tx, objects); err != nil {
+		return err
+	}
+
+	// 提交事务
+	return tx.Commit()
 }
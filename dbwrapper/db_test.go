@@ -0,0 +1,453 @@
+package dbwrapper
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/**
+ * @description: 使用内存SQLite和临时目录下的本地存储，执行全部迁移
+ * @param {*testing.T} t
+ * @return {*}
+ */
+func newTestStore(t *testing.T) {
+	t.Helper()
+
+	logwrapper.Logger = logrus.New()
+	configwrapper.Cfg = &configwrapper.Config{}
+	configwrapper.Cfg.Storage.Backend = osswrapper.BackendLocal
+	configwrapper.Cfg.Storage.Local.RootDir = t.TempDir()
+	configwrapper.Cfg.Storage.Local.SignSecret = "test"
+	if err := osswrapper.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	testStore, err := newSQLiteStore(configwrapper.Database{Driver: DriverSQLite, Path: sqliteMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testStore.Close() })
+
+	store = testStore
+	db = testStore.db
+	sqlDialect = testStore.dialect
+
+	if _, err = MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/**
+ * @description: 写入对象并登记，返回提交反馈时引用的附件
+ * @param {*testing.T} t
+ * @param {string} objectKey 登记的上传路径
+ * @param {string} content 文件内容
+ * @param {string} sha256 声明的sha256，不按内容寻址时为空
+ * @return {*}
+ */
+func uploadTestFile(t *testing.T, objectKey string, content string, sha256 string) (string, dto.FeedbackFile) {
+	t.Helper()
+
+	if content != "" {
+		if err := osswrapper.Current().Put(objectKey, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ticketID, err := CreateUploadTicket([]dto.UploadTicketFile{{ObjectKey: objectKey, FileName: "log.txt", Sha256: sha256}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ticketID, dto.FeedbackFile{FilePathOnOss: objectKey}
+}
+
+/**
+ * @description: 提交一条反馈，返回其id
+ * @param {*testing.T} t
+ * @param {string} module 影响模块
+ * @param {string} ticketID 上传登记id
+ * @param {...dto.FeedbackFile} files 附件
+ * @return {*}
+ */
+func insertTestFeedback(t *testing.T, module string, ticketID string, files ...dto.FeedbackFile) int {
+	t.Helper()
+
+	err := InsertFeedback(dto.FeedbackUpload{
+		AppVersion:     "1.0.0",
+		ImpactedModule: module,
+		BugDescription: "crash on start",
+		ReproduceSteps: "open the app",
+		UploadTicket:   ticketID,
+		Files:          files,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var feedbackID int
+	if err = db.QueryRow("SELECT MAX(feedback_id) FROM feedback").Scan(&feedbackID); err != nil {
+		t.Fatal(err)
+	}
+
+	return feedbackID
+}
+
+func testSha256(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func queuedObjects(t *testing.T) []string {
+	t.Helper()
+
+	rows, err := db.Query("SELECT object_key FROM storage_outbox ORDER BY object_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	objectKeys := []string{}
+	for rows.Next() {
+		var objectKey string
+		if err = rows.Scan(&objectKey); err != nil {
+			t.Fatal(err)
+		}
+		objectKeys = append(objectKeys, objectKey)
+	}
+
+	return objectKeys
+}
+
+func noBackoff(int) time.Duration {
+	return 0
+}
+
+func TestInsertAndQueryFeedback(t *testing.T) {
+	newTestStore(t)
+
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/log.txt", "hello", "")
+	feedbackID := insertTestFeedback(t, "editor", ticketID, file)
+
+	result, err := QueryFeedback(dto.FeedbackFilter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalSize != 1 || len(result.PageData) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	feedback := result.PageData[0]
+	if feedback.FeedbackID != feedbackID || feedback.ImpactedModule != "editor" || len(feedback.Files) != 1 {
+		t.Fatalf("unexpected feedback: %+v", feedback)
+	}
+	stored := feedback.Files[0]
+	if stored.FileName != "log.txt" || stored.FilePathOnOss != "feedback/r1/f1/log.txt" || stored.FileSize != 5 || stored.ScanStatus != dto.ScanPending {
+		t.Errorf("unexpected file: %+v", stored)
+	}
+
+	// 同一登记不能再被其他反馈使用
+	err = InsertFeedback(dto.FeedbackUpload{ImpactedModule: "editor", UploadTicket: ticketID, Files: []dto.FeedbackFile{file}})
+	if !errors.Is(err, ErrInvalidAttachment) {
+		t.Errorf("reusing a consumed ticket returned %v, want ErrInvalidAttachment", err)
+	}
+}
+
+func TestInsertFeedbackRejectsUnuploadedFile(t *testing.T) {
+	newTestStore(t)
+
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/log.txt", "", "")
+	err := InsertFeedback(dto.FeedbackUpload{ImpactedModule: "editor", UploadTicket: ticketID, Files: []dto.FeedbackFile{file}})
+
+	var attachmentErr *AttachmentError
+	if !errors.As(err, &attachmentErr) || len(attachmentErr.Rejections) != 1 || attachmentErr.Rejections[0].Reason != "file has not been uploaded" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 未通过校验时不写入反馈
+	result, err := QueryFeedback(dto.FeedbackFilter{}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalSize != 0 {
+		t.Errorf("feedback inserted despite the rejected attachment: %+v", result)
+	}
+}
+
+func TestQueryFeedbackPaging(t *testing.T) {
+	newTestStore(t)
+
+	// 没有反馈时返回空的第一页
+	result, err := QueryFeedback(dto.FeedbackFilter{}, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalSize != 0 || result.CurrentPageIndex != 0 || result.PageData == nil || len(result.PageData) != 0 {
+		t.Fatalf("unexpected empty result: %+v", result)
+	}
+
+	var ids []int
+	for i := 0; i < 5; i++ {
+		ids = append(ids, insertTestFeedback(t, "editor", ""))
+	}
+
+	cases := []struct {
+		pageIndex int
+		wantIndex int
+		wantCount int
+	}{
+		{0, 0, 2},
+		{1, 1, 2},
+		{2, 2, 1},
+		// 越界时修正为最后一页
+		{9, 2, 1},
+	}
+	for _, item := range cases {
+		result, err = QueryFeedback(dto.FeedbackFilter{SortBy: dto.SortByFeedbackID}, item.pageIndex, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.TotalSize != 5 || result.CurrentPageIndex != item.wantIndex || len(result.PageData) != item.wantCount {
+			t.Errorf("page %d: total %d, index %d, count %d", item.pageIndex, result.TotalSize, result.CurrentPageIndex, len(result.PageData))
+		}
+	}
+
+	// 条件过滤后再分页
+	result, err = QueryFeedback(dto.FeedbackFilter{FeedbackIDs: ids[:3]}, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TotalSize != 3 || len(result.PageData) != 2 {
+		t.Errorf("filtered: total %d, count %d", result.TotalSize, len(result.PageData))
+	}
+}
+
+func TestQueryRelatedFilesAndDeleteFeedback(t *testing.T) {
+	newTestStore(t)
+
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/log.txt", "hello", "")
+	withFile := insertTestFeedback(t, "editor", ticketID, file)
+	withoutFile := insertTestFeedback(t, "editor", "")
+
+	related := QueryRelatedFilesByFeedbackID([]int{withFile, withoutFile})
+	if len(related) != 2 || !slices.Equal(related[0].FileOssPath, []string{"feedback/r1/f1/log.txt"}) || len(related[1].FileOssPath) != 0 {
+		t.Fatalf("unexpected related files: %+v", related)
+	}
+
+	results := DeleteFeedbackByID([]int{withFile, withFile})
+	if !results[0].Deleted || results[1].Deleted || results[1].Error != ErrFeedbackNotFound.Error() {
+		t.Fatalf("unexpected delete results: %+v", results)
+	}
+
+	// 附件加入待删除队列，由队列从存储上删除
+	if queued := queuedObjects(t); !slices.Equal(queued, []string{"feedback/r1/f1/log.txt"}) {
+		t.Fatalf("queued objects = %v", queued)
+	}
+	if count, err := ProcessDueOutbox(time.Now(), 10, noBackoff); err != nil || count != 1 {
+		t.Fatalf("processed %d, err %v", count, err)
+	}
+	if _, err := osswrapper.Current().Stat("feedback/r1/f1/log.txt"); !errors.Is(err, osswrapper.ErrObjectNotFound) {
+		t.Errorf("stat after outbox returned %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestSharedBlobReferenceCounting(t *testing.T) {
+	newTestStore(t)
+
+	content := "shared crash dump"
+	sha := testSha256(content)
+	blobKey := osswrapper.BlobObjectKey(sha)
+
+	// 首次上传到暂存路径，提交时校验后复制到共用对象
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/dump.txt", content, sha)
+	first := insertTestFeedback(t, "editor", ticketID, file)
+	if _, err := osswrapper.Current().Stat(blobKey); err != nil {
+		t.Fatalf("blob not copied: %v", err)
+	}
+	if queued := queuedObjects(t); !slices.Equal(queued, []string{"feedback/r1/f1/dump.txt"}) {
+		t.Fatalf("staging object not queued: %v", queued)
+	}
+	if _, err := ProcessDueOutbox(time.Now(), 10, noBackoff); err != nil {
+		t.Fatal(err)
+	}
+
+	// 内容已存在时直接引用共用对象
+	existing, err := QueryExistingBlobs([]string{sha})
+	if err != nil || !existing[sha] {
+		t.Fatalf("existing blobs = %v, err %v", existing, err)
+	}
+	ticketID, file = uploadTestFile(t, blobKey, "", sha)
+	second := insertTestFeedback(t, "editor", ticketID, file)
+
+	related := QueryRelatedFilesByFeedbackID([]int{first, second})
+	if related[0].FileOssPath[0] != blobKey || related[1].FileOssPath[0] != blobKey {
+		t.Fatalf("unexpected related files: %+v", related)
+	}
+
+	// 仍被另一条反馈引用时不删除共用对象
+	if results := DeleteFeedbackByID([]int{first}); !results[0].Deleted {
+		t.Fatalf("unexpected delete results: %+v", results)
+	}
+	if queued := queuedObjects(t); len(queued) != 0 {
+		t.Fatalf("shared blob queued while still referenced: %v", queued)
+	}
+
+	// 最后一个引用删除后加入待删除队列
+	if results := DeleteFeedbackByID([]int{second}); !results[0].Deleted {
+		t.Fatalf("unexpected delete results: %+v", results)
+	}
+	if queued := queuedObjects(t); !slices.Equal(queued, []string{blobKey}) {
+		t.Fatalf("queued objects = %v", queued)
+	}
+
+	// 有声明相同sha256的登记尚未提交时，共用对象仍视为被引用
+	pendingTicket, _ := uploadTestFile(t, "feedback/r2/f1/dump.txt", content, sha)
+	if _, err = ProcessDueOutbox(time.Now(), 10, noBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = osswrapper.Current().Stat(blobKey); err != nil {
+		t.Fatalf("blob deleted while a pending ticket declares its sha256: %v", err)
+	}
+
+	// 登记过期后共用对象被删除
+	if _, err = db.Exec("UPDATE upload_ticket SET expires_at = ? WHERE ticket_id = ?", time.Now().Add(-time.Minute), pendingTicket); err != nil {
+		t.Fatal(err)
+	}
+	if err = enqueueTestDeletion(blobKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ProcessDueOutbox(time.Now(), 10, noBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = osswrapper.Current().Stat(blobKey); !errors.Is(err, osswrapper.ErrObjectNotFound) {
+		t.Errorf("stat after outbox returned %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestSettleBlobCancelsPendingDeletion(t *testing.T) {
+	newTestStore(t)
+
+	content := "crash dump"
+	sha := testSha256(content)
+	blobKey := osswrapper.BlobObjectKey(sha)
+
+	// 共用对象已在待删除队列中，新的上传复制前取消删除
+	if err := enqueueTestDeletion(blobKey); err != nil {
+		t.Fatal(err)
+	}
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/dump.txt", content, sha)
+	insertTestFeedback(t, "editor", ticketID, file)
+
+	if queued := queuedObjects(t); slices.Contains(queued, blobKey) {
+		t.Fatalf("blob deletion not cancelled: %v", queued)
+	}
+	if _, err := ProcessDueOutbox(time.Now(), 10, noBackoff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := osswrapper.Current().Stat(blobKey); err != nil {
+		t.Errorf("blob deleted after being linked: %v", err)
+	}
+}
+
+func TestSettleBlobRejectsMismatchedContent(t *testing.T) {
+	newTestStore(t)
+
+	sha := testSha256("expected content")
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/dump.txt", "poisoned content", sha)
+	err := InsertFeedback(dto.FeedbackUpload{ImpactedModule: "editor", UploadTicket: ticketID, Files: []dto.FeedbackFile{file}})
+
+	var attachmentErr *AttachmentError
+	if !errors.As(err, &attachmentErr) || attachmentErr.Rejections[0].Reason != "content does not match the declared sha256" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = osswrapper.Current().Stat(osswrapper.BlobObjectKey(sha)); !errors.Is(err, osswrapper.ErrObjectNotFound) {
+		t.Errorf("mismatched content written to the blob: %v", err)
+	}
+}
+
+func TestAddUploadTicketFilesRequiresUsableTicket(t *testing.T) {
+	newTestStore(t)
+
+	files := []dto.UploadTicketFile{{ObjectKey: "feedback/r1/f2/log.txt", FileName: "log.txt"}}
+	if err := AddUploadTicketFiles("never-issued", files); !errors.Is(err, ErrInvalidUploadTicket) {
+		t.Errorf("unknown ticket returned %v, want ErrInvalidUploadTicket", err)
+	}
+
+	ticketID, file := uploadTestFile(t, "feedback/r1/f1/log.txt", "hello", "")
+	if err := AddUploadTicketFiles(ticketID, files); err != nil {
+		t.Fatal(err)
+	}
+
+	// 已被反馈使用的登记不能再追加文件
+	insertTestFeedback(t, "editor", ticketID, file)
+	if err := CheckUploadTicket(ticketID); !errors.Is(err, ErrInvalidUploadTicket) {
+		t.Errorf("consumed ticket returned %v, want ErrInvalidUploadTicket", err)
+	}
+	if err := AddUploadTicketFiles(ticketID, files); !errors.Is(err, ErrInvalidUploadTicket) {
+		t.Errorf("consumed ticket returned %v, want ErrInvalidUploadTicket", err)
+	}
+}
+
+/**
+ * @description: 直接把对象加入待删除队列
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func enqueueTestDeletion(objectKey string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = enqueueObjectDeletion(tx, []string{objectKey}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func TestMigrationsRoundTrip(t *testing.T) {
+	newTestStore(t)
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 全部回滚后再执行一次，各迁移的down和up都能在SQLite上执行
+	reverted, err := MigrateDown(len(migrations))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Fatalf("reverted %d migrations, want %d", len(reverted), len(migrations))
+	}
+
+	applied, err := MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+
+	pending, err := PendingMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("pending migrations after migrate up: %+v", pending)
+	}
+}
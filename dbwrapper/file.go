@@ -0,0 +1,78 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-23 11:05:38
+ * @LastEditTime: 2024-09-23 14:57:40
+ * @FilePath: \UserFeedBack\dbwrapper\file.go
+ * @Description: 附件查询
+ */
+package dbwrapper
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// 附件不存在
+var ErrFileNotFound = errors.New("file not found")
+
+// 附件详情
+type FileDetail struct {
+	FileID      int
+	FeedbackID  int
+	FileName    string
+	FilePath    string
+	FileSize    int64
+	ETag        string
+	ContentType string
+	Missing     bool
+	ScanStatus  string
+	Expired     bool
+}
+
+/**
+ * @description: 按附件id查询附件
+ * @param {int} fileID 附件id
+ * @return {*}
+ */
+func QueryFileByID(fileID int) (*FileDetail, error) {
+	var (
+		file        FileDetail
+		feedbackID  sql.NullInt64
+		fileSize    sql.NullInt64
+		etag        sql.NullString
+		contentType sql.NullString
+		missingAt   sql.NullTime
+		scanStatus  sql.NullString
+		expiredAt   sql.NullTime
+	)
+
+	err := db.QueryRow("SELECT file_id, feedback_id, file_name, file_path, file_size, etag, content_type, missing_at, scan_status, expired_at FROM file WHERE file_id = ?",
+		fileID).Scan(
+		&file.FileID,
+		&feedbackID,
+		&file.FileName,
+		&file.FilePath,
+		&fileSize,
+		&etag,
+		&contentType,
+		&missingAt,
+		&scanStatus,
+		&expiredAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file.FeedbackID = int(feedbackID.Int64)
+	file.FileSize = fileSize.Int64
+	file.ETag = etag.String
+	file.ContentType = contentType.String
+	file.Missing = missingAt.Valid
+	file.ScanStatus = scanStatus.String
+	file.Expired = expiredAt.Valid
+
+	return &file, nil
+}
@@ -0,0 +1,147 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-15 10:26:44
+ * @LastEditTime: 2024-10-15 16:38:12
+ * @FilePath: \UserFeedBack\dbwrapper\filter.go
+ * @Description: 反馈查询条件和排序
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"errors"
+	"strings"
+)
+
+// 不支持的排序字段
+var ErrInvalidSortField = errors.New("invalid sort field")
+
+// 排序字段对应的列，可为空的列按空字符串排序，使各数据库中空值的位置一致
+var feedbackSortColumns = map[string]string{
+	"":                           "f.feedback_id",
+	dto.SortByFeedbackID:         "f.feedback_id",
+	dto.SortByTimeStamp:          "f.time_stamp",
+	dto.SortByImpactedModule:     "f.impacted_module",
+	dto.SortByOccurringFrequency: "f.occurring_frequency",
+	dto.SortByAppVersion:         "COALESCE(f.app_version, '')",
+	dto.SortByEmail:              "COALESCE(f.email, '')",
+}
+
+/**
+ * @description: 把查询条件转为feedback表（别名f）上的WHERE子句，所有值都通过参数传递
+ * @param {dto.FeedbackFilter} filter 查询条件
+ * @return {*} WHERE子句，没有条件时为空，以及对应的参数
+ */
+func feedbackConditions(filter dto.FeedbackFilter) (string, []any) {
+	var (
+		conditions []string
+		args       []any
+	)
+
+	add := func(condition string, values ...any) {
+		conditions = append(conditions, condition)
+		args = append(args, values...)
+	}
+
+	if len(filter.FeedbackIDs) > 0 {
+		ids := make([]any, 0, len(filter.FeedbackIDs))
+		for _, id := range filter.FeedbackIDs {
+			ids = append(ids, id)
+		}
+		add("f.feedback_id IN ("+placeholders(len(ids))+")", ids...)
+	}
+	if filter.MinFeedbackID > 0 {
+		add("f.feedback_id >= ?", filter.MinFeedbackID)
+	}
+	if filter.MaxFeedbackID > 0 {
+		add("f.feedback_id <= ?", filter.MaxFeedbackID)
+	}
+	if len(filter.ImpactedModules) > 0 {
+		add("f.impacted_module IN ("+placeholders(len(filter.ImpactedModules))+")", stringArgs(filter.ImpactedModules)...)
+	}
+	if filter.MinFrequency > 0 {
+		add("f.occurring_frequency >= ?", filter.MinFrequency)
+	}
+	if filter.MaxFrequency > 0 {
+		add("f.occurring_frequency <= ?", filter.MaxFrequency)
+	}
+	if len(filter.AppVersions) > 0 {
+		add("f.app_version IN ("+placeholders(len(filter.AppVersions))+")", stringArgs(filter.AppVersions)...)
+	}
+	if filter.AppVersionPrefix != "" {
+		add("f.app_version LIKE ? ESCAPE '!'", escapeLike(filter.AppVersionPrefix)+"%")
+	}
+	if len(filter.Emails) > 0 {
+		add("f.email IN ("+placeholders(len(filter.Emails))+")", stringArgs(filter.Emails)...)
+	}
+
+	// 长文本按包含匹配
+	contains := []struct {
+		column string
+		value  string
+	}{
+		{"f.bug_description", filter.BugDescription},
+		{"f.reproduce_steps", filter.ReproduceSteps},
+		{"f.user_info", filter.UserInfo},
+		{"f.process_info", filter.ProcessInfo},
+	}
+	for _, item := range contains {
+		if item.value != "" {
+			add(item.column+" LIKE ? ESCAPE '!'", "%"+escapeLike(item.value)+"%")
+		}
+	}
+
+	// SQLite的提交时间按UTC写入，统一使用UTC比较
+	if filter.Since != nil {
+		add("f.time_stamp >= ?", filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		add("f.time_stamp < ?", filter.Until.UTC())
+	}
+
+	if filter.HasFiles != nil {
+		exists := "EXISTS (SELECT 1 FROM file fl WHERE fl.feedback_id = f.feedback_id)"
+		if !*filter.HasFiles {
+			exists = "NOT " + exists
+		}
+		add(exists)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+/**
+ * @description: 排序子句，排序字段相同时按反馈id排序，保证分页稳定
+ * @param {dto.FeedbackFilter} filter 查询条件
+ * @return {*}
+ */
+func feedbackOrderBy(filter dto.FeedbackFilter) (string, error) {
+	column, ok := feedbackSortColumns[filter.SortBy]
+	if !ok {
+		return "", ErrInvalidSortField
+	}
+
+	direction := " ASC"
+	if filter.Descending {
+		direction = " DESC"
+	}
+
+	if column == "f.feedback_id" {
+		return column + direction, nil
+	}
+
+	return column + direction + ", f.feedback_id" + direction, nil
+}
+
+/**
+ * @description: 转义LIKE中的通配符，各数据库默认的转义字符不同，统一指定为!
+ * @param {string} value 原始值
+ * @return {*}
+ */
+func escapeLike(value string) string {
+	return strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`).Replace(value)
+}
@@ -0,0 +1,456 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-14 10:12:36
+ * @LastEditTime: 2024-10-14 18:20:51
+ * @FilePath: \UserFeedBack\dbwrapper\migrate.go
+ * @Description: 版本化的表结构迁移
+ */
+package dbwrapper
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 各数据库的迁移脚本，文件名为<版本号>_<名称>.up.sql和<版本号>_<名称>.down.sql
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+// 迁移锁的名称
+const migrationLockName = "user_feedback_schema_migrations"
+
+// 等待其他实例释放迁移锁的最长时间
+const migrationLockTimeout = 60 * time.Second
+
+// 初始迁移的版本号，引入迁移前自行建表的数据库在执行它之后补齐表结构
+const baselineVersion = 1
+
+// 迁移脚本文件名
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var (
+	// 其他实例正在迁移
+	ErrMigrationLocked = errors.New("another instance is migrating the database")
+	// 迁移没有回滚脚本
+	ErrIrreversibleMigration = errors.New("migration has no down script")
+	// 数据库中存在本程序不认识的迁移
+	ErrUnknownMigration = errors.New("database has migrations unknown to this binary")
+	// 指定的版本不存在
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// 迁移
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+// 迁移的执行状态
+type MigrationState struct {
+	Version   int64     `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"appliedAt,omitempty"`
+	Unknown   bool      `json:"unknown,omitempty"` // 数据库中有记录但本程序没有该迁移，通常是由更新的版本执行的
+}
+
+// 引入迁移前已有数据库的补齐方式，只有需要兼容旧数据库的方言实现
+type legacyUpgrader interface {
+	upgradeLegacySchema(conn schemaExecer) error
+}
+
+/**
+ * @description: 读取当前数据库的迁移脚本，按版本号排序
+ * @return {*}
+ */
+func loadMigrations() ([]Migration, error) {
+	dir := "migrations/" + sqlDialect.name()
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s, %s", version, migration.Name, match[2])
+		}
+
+		content, err := fs.ReadFile(migrationFS, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			migration.up = string(content)
+		} else {
+			migration.down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return int(a.Version - b.Version)
+	})
+
+	return migrations, nil
+}
+
+/**
+ * @description: 创建记录已执行迁移的表
+ * @return {*}
+ */
+func createMigrationTable() error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL)")
+	return err
+}
+
+/**
+ * @description: 查询已执行的迁移
+ * @return {*} 版本号->执行时间
+ */
+func queryAppliedMigrations() (map[int64]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var (
+			version   int64
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+/**
+ * @description: 查询所有迁移的执行状态，包括数据库中有记录但本程序不认识的迁移
+ * @return {*}
+ */
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = createMigrationTable(); err != nil {
+		return nil, err
+	}
+
+	applied, err := queryAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, migration := range migrations {
+		appliedAt, ok := applied[migration.Version]
+		states = append(states, MigrationState{Version: migration.Version, Name: migration.Name, Applied: ok, AppliedAt: appliedAt})
+		delete(applied, migration.Version)
+	}
+	for version, appliedAt := range applied {
+		states = append(states, MigrationState{Version: version, Applied: true, AppliedAt: appliedAt, Unknown: true})
+	}
+	slices.SortFunc(states, func(a, b MigrationState) int {
+		return int(a.Version - b.Version)
+	})
+
+	return states, nil
+}
+
+/**
+ * @description: 查询尚未执行的迁移
+ * @return {*}
+ */
+func PendingMigrations() ([]MigrationState, error) {
+	states, err := MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []MigrationState{}
+	for _, state := range states {
+		if !state.Applied {
+			pending = append(pending, state)
+		}
+	}
+
+	return pending, nil
+}
+
+/**
+ * @description: 执行所有未执行的迁移，更新的版本执行过的迁移保持不变
+ * @return {*} 本次执行的迁移
+ */
+func MigrateUp() ([]Migration, error) {
+	return migrate(func(migrations []Migration, applied []int64) (int64, error) {
+		latest := migrations[len(migrations)-1].Version
+		if len(applied) > 0 {
+			latest = max(latest, applied[len(applied)-1])
+		}
+		return latest, nil
+	})
+}
+
+/**
+ * @description: 从最新的迁移开始回滚指定数量的迁移
+ * @param {int} steps 回滚的数量
+ * @return {*} 本次回滚的迁移
+ */
+func MigrateDown(steps int) ([]Migration, error) {
+	return migrate(func(migrations []Migration, applied []int64) (int64, error) {
+		if steps >= len(applied) {
+			return 0, nil
+		}
+		return applied[len(applied)-steps-1], nil
+	})
+}
+
+/**
+ * @description: 迁移到指定版本，高于该版本的迁移被回滚，不高于的被执行
+ * @param {int64} version 目标版本，0表示回滚全部
+ * @return {*} 本次执行或回滚的迁移
+ */
+func MigrateTo(version int64) ([]Migration, error) {
+	return migrate(func(migrations []Migration, applied []int64) (int64, error) {
+		if version != 0 && !slices.ContainsFunc(migrations, func(migration Migration) bool { return migration.Version == version }) {
+			return 0, ErrUnknownVersion
+		}
+		return version, nil
+	})
+}
+
+/**
+ * @description: 持有迁移锁后确定目标版本，先从新到旧回滚高于目标版本的迁移，再从旧到新执行不高于目标版本的迁移
+ * @param {func} target 根据所有迁移和已执行的版本（升序）确定目标版本
+ * @return {*} 本次执行或回滚的迁移
+ */
+func migrate(target func(migrations []Migration, applied []int64) (int64, error)) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		return nil, nil
+	}
+
+	unlock, err := sqlDialect.lockMigrations(db.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err = createMigrationTable(); err != nil {
+		return nil, err
+	}
+
+	appliedAt, err := queryAppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]int64, 0, len(appliedAt))
+	for version := range appliedAt {
+		applied = append(applied, version)
+	}
+	slices.Sort(applied)
+
+	version, err := target(migrations, applied)
+	if err != nil {
+		return nil, err
+	}
+
+	// 不认识的迁移无法回滚
+	for _, appliedVersion := range applied {
+		known := slices.ContainsFunc(migrations, func(migration Migration) bool { return migration.Version == appliedVersion })
+		if !known && appliedVersion > version {
+			return nil, fmt.Errorf("%w: %d", ErrUnknownMigration, appliedVersion)
+		}
+	}
+
+	done := []Migration{}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := appliedAt[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+		if err = revertMigration(migration); err != nil {
+			return done, fmt.Errorf("revert migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+
+	for _, migration := range migrations {
+		if _, ok := appliedAt[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+		if err = applyMigration(migration); err != nil {
+			return done, fmt.Errorf("apply migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+/**
+ * @description: 在事务中执行迁移并记录，MySQL的表结构变更会隐式提交，失败时需要人工确认已执行的部分
+ * @param {Migration} migration 迁移
+ * @return {*}
+ */
+func applyMigration(migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 持有锁之前可能已被其他实例执行
+	var count int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", migration.Version).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	for _, statement := range splitStatements(migration.up) {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	if upgrader, ok := sqlDialect.(legacyUpgrader); ok && migration.Version == baselineVersion {
+		if err = upgrader.upgradeLegacySchema(tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, CURRENT_TIMESTAMP)", migration.Version, migration.Name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/**
+ * @description: 在事务中回滚迁移并删除记录
+ * @param {Migration} migration 迁移
+ * @return {*}
+ */
+func revertMigration(migration Migration) error {
+	if migration.down == "" {
+		return ErrIrreversibleMigration
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range splitStatements(migration.down) {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 脚本中整体执行的语句块的起止标记，块内的分号不拆分，用于触发器等包含多条子语句的定义
+const (
+	statementBlockBegin = "-- +begin"
+	statementBlockEnd   = "-- +end"
+)
+
+/**
+ * @description: 按分号拆分脚本中的语句，忽略字符串常量中的分号和--注释，-- +begin和-- +end之间的内容作为一条语句
+ * @param {string} script 脚本
+ * @return {*}
+ */
+func splitStatements(script string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+		quoted     bool
+		block      bool
+	)
+
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case !quoted && c == '-' && strings.HasPrefix(script[i:], "--"):
+			// 跳过注释到行尾
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			switch strings.TrimSpace(script[i : i+end]) {
+			case statementBlockBegin:
+				flush()
+				block = true
+			case statementBlockEnd:
+				flush()
+				block = false
+			}
+			i += end - 1
+			continue
+		case !quoted && !block && c == ';':
+			flush()
+			continue
+		}
+		current.WriteByte(c)
+	}
+	flush()
+
+	return statements
+}
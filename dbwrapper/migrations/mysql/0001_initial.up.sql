@@ -0,0 +1,85 @@
+-- 初始表结构，已存在的表保持不变
+
+CREATE TABLE IF NOT EXISTS feedback (
+    feedback_id INT AUTO_INCREMENT PRIMARY KEY,
+    bug_description TEXT NOT NULL,
+    impacted_module TEXT NOT NULL,
+    occurring_frequency INT NOT NULL,
+    reproduce_steps TEXT NOT NULL,
+    user_info TEXT,
+    process_info TEXT,
+    email TEXT,
+    app_version TEXT,
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS file (
+    file_id INT AUTO_INCREMENT PRIMARY KEY,
+    feedback_id INT,
+    file_name VARCHAR(255) NOT NULL,
+    file_path VARCHAR(255) NOT NULL,
+    file_size BIGINT,
+    etag VARCHAR(128),
+    content_type VARCHAR(255),
+    missing_at DATETIME,
+    sha256 CHAR(64),
+    thumbnail_path VARCHAR(255),
+    thumbnail_status VARCHAR(16),
+    archive_status VARCHAR(16),
+    scan_status VARCHAR(16),
+    scan_result VARCHAR(255),
+    quarantine_path VARCHAR(255),
+    expired_at DATETIME,
+    INDEX idx_file_file_path (file_path),
+    INDEX idx_file_sha256 (sha256),
+    INDEX idx_file_thumbnail_status (thumbnail_status),
+    INDEX idx_file_archive_status (archive_status),
+    INDEX idx_file_scan_status (scan_status),
+    FOREIGN KEY (feedback_id) REFERENCES feedback(feedback_id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS archive_member (
+    member_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    file_path VARCHAR(255) NOT NULL,
+    member_path VARCHAR(1024) NOT NULL,
+    member_size BIGINT NOT NULL DEFAULT 0,
+    modified_at DATETIME,
+    content MEDIUMTEXT,
+    INDEX idx_archive_member_file_path (file_path)
+);
+
+CREATE TABLE IF NOT EXISTS upload_ticket (
+    ticket_id VARCHAR(64) NOT NULL,
+    object_key VARCHAR(255) NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    sha256 CHAR(64),
+    feedback_id INT,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (ticket_id, object_key),
+    INDEX idx_upload_ticket_object_key (object_key)
+);
+
+CREATE TABLE IF NOT EXISTS upload_session (
+    upload_id VARCHAR(64) PRIMARY KEY,
+    object_key VARCHAR(255) NOT NULL,
+    storage_upload_id VARCHAR(255) NOT NULL,
+    ticket_id VARCHAR(64),
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255),
+    total_size BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(16) NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    INDEX idx_upload_session_status (status, updated_at)
+);
+
+CREATE TABLE IF NOT EXISTS storage_outbox (
+    outbox_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    object_key VARCHAR(255) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX idx_storage_outbox_next_attempt_at (next_attempt_at)
+);
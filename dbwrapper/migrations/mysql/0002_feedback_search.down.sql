@@ -0,0 +1,5 @@
+-- 删除全文检索
+
+ALTER TABLE feedback DROP INDEX ft_feedback_search_text;
+
+ALTER TABLE feedback DROP COLUMN search_text;
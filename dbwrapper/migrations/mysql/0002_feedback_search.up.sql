@@ -0,0 +1,5 @@
+-- 全文检索，search_text保存程序分词后的文本，ngram解析器按二元组切分，支持中文检索
+
+ALTER TABLE feedback ADD COLUMN search_text MEDIUMTEXT;
+
+ALTER TABLE feedback ADD FULLTEXT INDEX ft_feedback_search_text (search_text) WITH PARSER ngram;
@@ -0,0 +1,85 @@
+-- 初始表结构，已存在的表保持不变
+
+CREATE TABLE IF NOT EXISTS feedback (
+    feedback_id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    bug_description TEXT NOT NULL,
+    impacted_module TEXT NOT NULL,
+    occurring_frequency INTEGER NOT NULL,
+    reproduce_steps TEXT NOT NULL,
+    user_info TEXT,
+    process_info TEXT,
+    email TEXT,
+    app_version TEXT,
+    time_stamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS file (
+    file_id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    feedback_id INTEGER REFERENCES feedback(feedback_id) ON DELETE CASCADE,
+    file_name VARCHAR(255) NOT NULL,
+    file_path VARCHAR(255) NOT NULL,
+    file_size BIGINT,
+    etag VARCHAR(128),
+    content_type VARCHAR(255),
+    missing_at TIMESTAMPTZ,
+    sha256 CHAR(64),
+    thumbnail_path VARCHAR(255),
+    thumbnail_status VARCHAR(16),
+    archive_status VARCHAR(16),
+    scan_status VARCHAR(16),
+    scan_result VARCHAR(255),
+    quarantine_path VARCHAR(255),
+    expired_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_file_feedback_id ON file (feedback_id);
+CREATE INDEX IF NOT EXISTS idx_file_file_path ON file (file_path);
+CREATE INDEX IF NOT EXISTS idx_file_sha256 ON file (sha256);
+CREATE INDEX IF NOT EXISTS idx_file_thumbnail_status ON file (thumbnail_status);
+CREATE INDEX IF NOT EXISTS idx_file_archive_status ON file (archive_status);
+CREATE INDEX IF NOT EXISTS idx_file_scan_status ON file (scan_status);
+
+CREATE TABLE IF NOT EXISTS archive_member (
+    member_id BIGSERIAL PRIMARY KEY,
+    file_path VARCHAR(255) NOT NULL,
+    member_path VARCHAR(1024) NOT NULL,
+    member_size BIGINT NOT NULL DEFAULT 0,
+    modified_at TIMESTAMPTZ,
+    content TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_archive_member_file_path ON archive_member (file_path);
+
+CREATE TABLE IF NOT EXISTS upload_ticket (
+    ticket_id VARCHAR(64) NOT NULL,
+    object_key VARCHAR(255) NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    sha256 CHAR(64),
+    feedback_id INTEGER,
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (ticket_id, object_key)
+);
+CREATE INDEX IF NOT EXISTS idx_upload_ticket_object_key ON upload_ticket (object_key);
+
+CREATE TABLE IF NOT EXISTS upload_session (
+    upload_id VARCHAR(64) PRIMARY KEY,
+    object_key VARCHAR(255) NOT NULL,
+    storage_upload_id VARCHAR(255) NOT NULL,
+    ticket_id VARCHAR(64),
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255),
+    total_size BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(16) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_upload_session_status ON upload_session (status, updated_at);
+
+CREATE TABLE IF NOT EXISTS storage_outbox (
+    outbox_id BIGSERIAL PRIMARY KEY,
+    object_key VARCHAR(255) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_storage_outbox_next_attempt_at ON storage_outbox (next_attempt_at);
@@ -0,0 +1,7 @@
+-- 删除全文检索
+
+DROP INDEX IF EXISTS idx_feedback_search_vector;
+
+ALTER TABLE feedback DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE feedback DROP COLUMN IF EXISTS search_text;
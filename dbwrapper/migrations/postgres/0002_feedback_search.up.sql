@@ -0,0 +1,7 @@
+-- 全文检索，search_text保存程序分词后的文本，按空格切分即可，不依赖数据库的中文分词扩展
+
+ALTER TABLE feedback ADD COLUMN search_text TEXT;
+
+ALTER TABLE feedback ADD COLUMN search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(search_text, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_feedback_search_vector ON feedback USING GIN (search_vector);
@@ -0,0 +1,5 @@
+-- 删除扫描重试记录
+
+ALTER TABLE file DROP COLUMN IF EXISTS scan_retry_at;
+
+ALTER TABLE file DROP COLUMN IF EXISTS scan_attempts;
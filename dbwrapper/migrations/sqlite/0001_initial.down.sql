@@ -0,0 +1,8 @@
+-- 删除全部表
+
+DROP TABLE IF EXISTS storage_outbox;
+DROP TABLE IF EXISTS upload_session;
+DROP TABLE IF EXISTS upload_ticket;
+DROP TABLE IF EXISTS archive_member;
+DROP TABLE IF EXISTS file;
+DROP TABLE IF EXISTS feedback;
@@ -0,0 +1,85 @@
+-- 初始表结构，已存在的表保持不变
+
+CREATE TABLE IF NOT EXISTS feedback (
+    feedback_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    bug_description TEXT NOT NULL,
+    impacted_module TEXT NOT NULL,
+    occurring_frequency INTEGER NOT NULL,
+    reproduce_steps TEXT NOT NULL,
+    user_info TEXT,
+    process_info TEXT,
+    email TEXT,
+    app_version TEXT,
+    time_stamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS file (
+    file_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    feedback_id INTEGER REFERENCES feedback(feedback_id) ON DELETE CASCADE,
+    file_name TEXT NOT NULL,
+    file_path TEXT NOT NULL,
+    file_size INTEGER,
+    etag TEXT,
+    content_type TEXT,
+    missing_at DATETIME,
+    sha256 TEXT,
+    thumbnail_path TEXT,
+    thumbnail_status TEXT,
+    archive_status TEXT,
+    scan_status TEXT,
+    scan_result TEXT,
+    quarantine_path TEXT,
+    expired_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS idx_file_feedback_id ON file (feedback_id);
+CREATE INDEX IF NOT EXISTS idx_file_file_path ON file (file_path);
+CREATE INDEX IF NOT EXISTS idx_file_sha256 ON file (sha256);
+CREATE INDEX IF NOT EXISTS idx_file_thumbnail_status ON file (thumbnail_status);
+CREATE INDEX IF NOT EXISTS idx_file_archive_status ON file (archive_status);
+CREATE INDEX IF NOT EXISTS idx_file_scan_status ON file (scan_status);
+
+CREATE TABLE IF NOT EXISTS archive_member (
+    member_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    file_path TEXT NOT NULL,
+    member_path TEXT NOT NULL,
+    member_size INTEGER NOT NULL DEFAULT 0,
+    modified_at DATETIME,
+    content TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_archive_member_file_path ON archive_member (file_path);
+
+CREATE TABLE IF NOT EXISTS upload_ticket (
+    ticket_id TEXT NOT NULL,
+    object_key TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    sha256 TEXT,
+    feedback_id INTEGER,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (ticket_id, object_key)
+);
+CREATE INDEX IF NOT EXISTS idx_upload_ticket_object_key ON upload_ticket (object_key);
+
+CREATE TABLE IF NOT EXISTS upload_session (
+    upload_id TEXT PRIMARY KEY,
+    object_key TEXT NOT NULL,
+    storage_upload_id TEXT NOT NULL,
+    ticket_id TEXT,
+    file_name TEXT NOT NULL,
+    content_type TEXT,
+    total_size INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_upload_session_status ON upload_session (status, updated_at);
+
+CREATE TABLE IF NOT EXISTS storage_outbox (
+    outbox_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    object_key TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_storage_outbox_next_attempt_at ON storage_outbox (next_attempt_at);
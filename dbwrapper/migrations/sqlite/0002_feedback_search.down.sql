@@ -0,0 +1,9 @@
+-- 删除全文检索
+
+DROP TRIGGER IF EXISTS feedback_fts_delete;
+
+DROP TRIGGER IF EXISTS feedback_fts_update;
+
+DROP TABLE IF EXISTS feedback_fts;
+
+ALTER TABLE feedback DROP COLUMN search_text;
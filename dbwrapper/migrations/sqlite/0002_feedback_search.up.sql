@@ -0,0 +1,20 @@
+-- 全文检索，search_text保存程序分词后的文本，由触发器同步到FTS5索引，rowid即反馈id
+
+ALTER TABLE feedback ADD COLUMN search_text TEXT;
+
+CREATE VIRTUAL TABLE IF NOT EXISTS feedback_fts USING fts5(search_text, tokenize = 'unicode61');
+
+-- +begin
+CREATE TRIGGER IF NOT EXISTS feedback_fts_update AFTER UPDATE OF search_text ON feedback
+BEGIN
+    DELETE FROM feedback_fts WHERE rowid = old.feedback_id;
+    INSERT INTO feedback_fts (rowid, search_text) VALUES (new.feedback_id, new.search_text);
+END;
+-- +end
+
+-- +begin
+CREATE TRIGGER IF NOT EXISTS feedback_fts_delete AFTER DELETE ON feedback
+BEGIN
+    DELETE FROM feedback_fts WHERE rowid = old.feedback_id;
+END;
+-- +end
@@ -0,0 +1,5 @@
+-- 扫描器或存储暂时不可用时记录失败次数和下次重试时间，不阻塞其他附件的扫描
+
+ALTER TABLE file ADD COLUMN scan_attempts INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE file ADD COLUMN scan_retry_at DATETIME;
@@ -0,0 +1,269 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-11 10:06:18
+ * @LastEditTime: 2024-10-11 15:42:30
+ * @FilePath: \UserFeedBack\dbwrapper\mysql.go
+ * @Description: MySQL实现
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/configwrapper"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// MySQL方言
+type mysqlDialect struct{}
+
+func (mysqlDialect) name() string {
+	return DriverMySQL
+}
+
+func (mysqlDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (mysqlDialect) month(column string) string {
+	return "DATE_FORMAT(" + column + ", '%Y-%m')"
+}
+
+func (mysqlDialect) rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) insertID(tx *sqlTx, query string, idColumn string, args ...any) (int64, error) {
+	return lastInsertID(tx, query, args...)
+}
+
+/**
+ * @description: 布尔模式全文检索，每个检索词都必须出现，ngram解析器下短语匹配即为包含匹配，单字的检索词按前缀匹配
+ * @param {[]string} terms 检索词
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func (mysqlDialect) searchQuery(terms []string, limit int) (string, []any) {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		// ngram解析器无法匹配短于二元组的短语，单字改用前缀匹配
+		if utf8.RuneCountInString(term) < 2 {
+			parts = append(parts, "+"+term+"*")
+		} else {
+			parts = append(parts, `+"`+term+`"`)
+		}
+	}
+	against := strings.Join(parts, " ")
+
+	return "SELECT feedback_id, MATCH(search_text) AGAINST (? IN BOOLEAN MODE) AS score FROM feedback " +
+		"WHERE MATCH(search_text) AGAINST (? IN BOOLEAN MODE) ORDER BY score DESC, feedback_id DESC LIMIT ?", []any{against, against, limit}
+}
+
+func (mysqlDialect) snippet(column string) string {
+	return "SUBSTRING(" + column + ", GREATEST(LOCATE(?, " + column + ") - ?, 1), ? + CHAR_LENGTH(?) + ?)"
+}
+
+/**
+ * @description: 通过命名锁互斥，锁与会话绑定，持有期间占用一个连接
+ * @param {*sql.DB} conn 数据库连接
+ * @return {*}
+ */
+func (mysqlDialect) lockMigrations(conn *sql.DB) (func(), error) {
+	session, err := conn.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	var locked sql.NullInt64
+	err = session.QueryRowContext(context.Background(), "SELECT GET_LOCK(?, ?)", migrationLockName, int(migrationLockTimeout.Seconds())).Scan(&locked)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		session.Close()
+		return nil, ErrMigrationLocked
+	}
+
+	return func() {
+		session.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+		session.Close()
+	}, nil
+}
+
+/**
+ * @description: 连接MySQL数据库
+ * @param {configwrapper.Database} cfg 数据库配置
+ * @return {*}
+ */
+func newMySQLStore(cfg configwrapper.Database) (*sqlStore, error) {
+	// 连接到 MySQL 数据库
+	address := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		cfg.User,
+		cfg.Password,
+		cfg.Host,
+		cfg.Port,
+		cfg.Schema)
+	conn, err := sql.Open("mysql", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查连接是否成功
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: &sqlDB{DB: conn, dialect: mysqlDialect{}}, dialect: mysqlDialect{}}, nil
+}
+
+// 执行表结构变更的连接或事务
+type schemaExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+/**
+ * @description: 引入迁移前的数据库由各版本启动时自行建表，初始迁移执行后补齐这些库缺少的列、索引和主键
+ * @param {schemaExecer} conn 数据库连接
+ * @return {*}
+ */
+func (mysqlDialect) upgradeLegacySchema(conn schemaExecer) error {
+	// 已存在的表补充新增的列，已有的附件扫描状态为空，启用扫描后补扫
+	columns := []struct{ table, column, definition string }{
+		{"file", "etag", "VARCHAR(128)"},
+		{"file", "content_type", "VARCHAR(255)"},
+		{"file", "missing_at", "DATETIME"},
+		{"file", "sha256", "CHAR(64)"},
+		{"file", "thumbnail_path", "VARCHAR(255)"},
+		{"file", "thumbnail_status", "VARCHAR(16)"},
+		{"file", "archive_status", "VARCHAR(16)"},
+		{"file", "scan_status", "VARCHAR(16)"},
+		{"file", "scan_result", "VARCHAR(255)"},
+		{"file", "quarantine_path", "VARCHAR(255)"},
+		{"file", "expired_at", "DATETIME"},
+		{"upload_ticket", "sha256", "CHAR(64)"},
+	}
+	for _, column := range columns {
+		if err := ensureColumn(conn, column.table, column.column, column.definition); err != nil {
+			return fmt.Errorf("failed to alter table: %w", err)
+		}
+	}
+
+	// 内容寻址的对象会被多个上传登记引用，主键改为登记id+对象路径
+	if err := ensurePrimaryKey(conn, "upload_ticket", "ticket_id", "object_key"); err != nil {
+		return fmt.Errorf("failed to alter table: %w", err)
+	}
+
+	indexes := []struct{ table, index, columns string }{
+		{"file", "idx_file_file_path", "file_path"},
+		{"file", "idx_file_sha256", "sha256"},
+		{"file", "idx_file_thumbnail_status", "thumbnail_status"},
+		{"file", "idx_file_archive_status", "archive_status"},
+		{"file", "idx_file_scan_status", "scan_status"},
+		{"upload_ticket", "idx_upload_ticket_object_key", "object_key"},
+	}
+	for _, index := range indexes {
+		if err := ensureIndex(conn, index.table, index.index, index.columns); err != nil {
+			return fmt.Errorf("failed to alter table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * @description: 表中不存在该列时补充添加
+ * @param {schemaExecer} conn 数据库连接
+ * @param {string} table 表名
+ * @param {string} column 列名
+ * @param {string} definition 列定义
+ * @return {*}
+ */
+func ensureColumn(conn schemaExecer, table string, column string, definition string) error {
+	var count int
+	err := conn.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+/**
+ * @description: 表中不存在该索引时补充添加
+ * @param {schemaExecer} conn 数据库连接
+ * @param {string} table 表名
+ * @param {string} index 索引名
+ * @param {string} columns 索引列
+ * @return {*}
+ */
+func ensureIndex(conn schemaExecer, table string, index string, columns string) error {
+	var count int
+	err := conn.QueryRow("SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?",
+		table, index).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = conn.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", index, table, columns))
+	return err
+}
+
+/**
+ * @description: 主键与期望的列不一致时重建主键
+ * @param {schemaExecer} conn 数据库连接
+ * @param {string} table 表名
+ * @param {...string} columns 主键列，按顺序
+ * @return {*}
+ */
+func ensurePrimaryKey(conn schemaExecer, table string, columns ...string) error {
+	rows, err := conn.Query("SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' ORDER BY ORDINAL_POSITION",
+		table)
+	if err != nil {
+		return err
+	}
+
+	var current []string
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, column)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if slices.Equal(current, columns) {
+		return nil
+	}
+
+	statement := fmt.Sprintf("ALTER TABLE %s ADD PRIMARY KEY (%s)", table, strings.Join(columns, ", "))
+	if len(current) > 0 {
+		statement = fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY, ADD PRIMARY KEY (%s)", table, strings.Join(columns, ", "))
+	}
+
+	_, err = conn.Exec(statement)
+	return err
+}
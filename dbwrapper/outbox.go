@@ -0,0 +1,141 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-19 10:14:27
+ * @LastEditTime: 2024-09-19 17:48:33
+ * @FilePath: \UserFeedBack\dbwrapper\outbox.go
+ * @Description: 存储对象待删除队列
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/osswrapper"
+	"time"
+)
+
+// 待删除的存储对象
+type OutboxItem struct {
+	OutboxID  int64
+	ObjectKey string
+	Attempts  int
+}
+
+/**
+ * @description: 在事务中将存储对象加入待删除队列
+ * @param {*sqlTx} tx 事务
+ * @param {[]string} objectKeys 对象路径
+ * @return {*}
+ */
+func enqueueObjectDeletion(tx *sqlTx, objectKeys []string) error {
+	now := time.Now()
+	for _, objectKey := range objectKeys {
+		_, err := tx.Exec("INSERT INTO storage_outbox (object_key, attempts, next_attempt_at, created_at) VALUES (?, 0, ?, ?)",
+			objectKey, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * @description: 处理一批到期的待删除对象。在事务中锁住队列记录后再确认引用并删除，
+ * 提交前共用对象无法被取消删除，避免与提交反馈时复制共用对象交错
+ * @param {time.Time} now 当前时间
+ * @param {int} limit 最多处理的条数
+ * @param {func(int) time.Duration} backoff 第attempts次失败后的重试间隔
+ * @return {*} 本批处理的条数
+ */
+func ProcessDueOutbox(now time.Time, limit int, backoff func(attempts int) time.Duration) (int, error) {
+	// 开启事务
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	// 确保失败时能正确回滚
+	defer tx.Rollback()
+
+	items, err := lockDueOutbox(tx, now, limit)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+
+	objectKeys := make([]string, 0, len(items))
+	for _, item := range items {
+		objectKeys = append(objectKeys, item.ObjectKey)
+	}
+
+	// 内容寻址的对象入队后可能又被新的反馈引用，删除前再确认一次
+	referenced, err := objectReferences(tx, objectKeys, now)
+	if err != nil {
+		return 0, err
+	}
+
+	unreferenced := make([]string, 0, len(objectKeys))
+	for _, objectKey := range objectKeys {
+		if !referenced[objectKey] {
+			unreferenced = append(unreferenced, objectKey)
+		}
+	}
+
+	// 批量删除，只重试失败的对象，仍被引用的对象直接移出队列
+	result := osswrapper.DeleteObjects(unreferenced)
+	for _, item := range items {
+		if reason, failed := result.Failed[item.ObjectKey]; failed {
+			_, err = tx.Exec("UPDATE storage_outbox SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE outbox_id = ?",
+				time.Now().Add(backoff(item.Attempts)), reason, item.OutboxID)
+		} else {
+			_, err = tx.Exec("DELETE FROM storage_outbox WHERE outbox_id = ?", item.OutboxID)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(items), nil
+}
+
+/**
+ * @description: 在事务中查询并锁住到期需要执行的待删除对象
+ * @param {*sqlTx} tx 事务
+ * @param {time.Time} now 当前时间
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func lockDueOutbox(tx *sqlTx, now time.Time, limit int) ([]OutboxItem, error) {
+	rows, err := tx.Query("SELECT outbox_id, object_key, attempts FROM storage_outbox WHERE next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?"+sqlDialect.forUpdate(),
+		now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []OutboxItem{}
+	for rows.Next() {
+		var item OutboxItem
+		if err = rows.Scan(&item.OutboxID, &item.ObjectKey, &item.Attempts); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+/**
+ * @description: 取消对象的待删除记录，正在执行删除时等待其完成，之后重新写入的对象不会再被删除
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func cancelObjectDeletion(objectKey string) error {
+	_, err := db.Exec("DELETE FROM storage_outbox WHERE object_key = ?", objectKey)
+	return err
+}
@@ -0,0 +1,162 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-12 09:48:13
+ * @LastEditTime: 2024-10-12 17:05:41
+ * @FilePath: \UserFeedBack\dbwrapper\postgres.go
+ * @Description: PostgreSQL实现
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/configwrapper"
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgreSQL方言
+type postgresDialect struct{}
+
+func (postgresDialect) name() string {
+	return DriverPostgres
+}
+
+func (postgresDialect) forUpdate() string {
+	return " FOR UPDATE"
+}
+
+func (postgresDialect) month(column string) string {
+	return "to_char(" + column + ", 'YYYY-MM')"
+}
+
+// 参数类型无法从上下文推断时显式转换
+func (postgresDialect) snippet(column string) string {
+	return "substr(" + column + ", greatest(strpos(" + column + ", CAST(? AS TEXT)) - CAST(? AS INTEGER), 1), CAST(? AS INTEGER) + length(CAST(? AS TEXT)) + CAST(? AS INTEGER))"
+}
+
+/**
+ * @description: 把?占位符按顺序改写为$1、$2……，跳过字符串常量中的?
+ * @param {string} query 语句
+ * @return {*}
+ */
+func (postgresDialect) rebind(query string) string {
+	var (
+		builder strings.Builder
+		index   int
+		quoted  bool
+	)
+	builder.Grow(len(query) + 16)
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			index++
+			builder.WriteByte('$')
+			builder.WriteString(strconv.Itoa(index))
+			continue
+		}
+		builder.WriteByte(c)
+	}
+
+	return builder.String()
+}
+
+/**
+ * @description: 通过tsvector检索，检索词之间为与的关系，按前缀匹配，按ts_rank排序
+ * @param {[]string} terms 检索词
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func (postgresDialect) searchQuery(terms []string, limit int) (string, []any) {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		// 检索词只包含字母和数字，加引号后不会被当作运算符
+		parts = append(parts, "'"+term+"':*")
+	}
+
+	return "SELECT feedback_id, ts_rank(search_vector, query) AS score FROM feedback, to_tsquery('simple', ?) AS query " +
+		"WHERE search_vector @@ query ORDER BY score DESC, feedback_id DESC LIMIT ?", []any{strings.Join(parts, " & "), limit}
+}
+
+// PostgreSQL不支持LastInsertId，通过RETURNING取得主键
+func (postgresDialect) insertID(tx *sqlTx, query string, idColumn string, args ...any) (int64, error) {
+	var id int64
+	err := tx.QueryRow(query+" RETURNING "+idColumn, args...).Scan(&id)
+	return id, err
+}
+
+/**
+ * @description: 通过会话级的咨询锁互斥，锁被占用时每秒重试一次，持有期间占用一个连接
+ * @param {*sql.DB} conn 数据库连接
+ * @return {*}
+ */
+func (postgresDialect) lockMigrations(conn *sql.DB) (func(), error) {
+	session, err := conn.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	// 锁的键取锁名的哈希
+	key := fmt.Sprintf("hashtext('%s')", migrationLockName)
+	deadline := time.Now().Add(migrationLockTimeout)
+	for {
+		var locked bool
+		if err = session.QueryRowContext(context.Background(), "SELECT pg_try_advisory_lock("+key+")").Scan(&locked); err != nil {
+			session.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			session.Close()
+			return nil, ErrMigrationLocked
+		}
+		time.Sleep(time.Second)
+	}
+
+	return func() {
+		session.ExecContext(context.Background(), "SELECT pg_advisory_unlock("+key+")")
+		session.Close()
+	}, nil
+}
+
+/**
+ * @description: 连接PostgreSQL数据库
+ * @param {configwrapper.Database} cfg 数据库配置
+ * @return {*}
+ */
+func newPostgresStore(cfg configwrapper.Database) (*sqlStore, error) {
+	address := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(cfg.User, cfg.Password),
+		Host:   net.JoinHostPort(cfg.Host, cfg.Port),
+		Path:   "/" + cfg.Schema,
+	}
+	if cfg.SSLMode != "" {
+		address.RawQuery = url.Values{"sslmode": {cfg.SSLMode}}.Encode()
+	}
+
+	conn, err := sql.Open("pgx", address.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// 检查连接是否成功
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: &sqlDB{DB: conn, dialect: postgresDialect{}}, dialect: postgresDialect{}}, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-18 09:47:15
+ * @LastEditTime: 2024-09-18 16:35:52
+ * @FilePath: \UserFeedBack\dbwrapper\reconcile.go
+ * @Description: 附件与存储对账
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// file表中的一条附件记录
+type FileObject struct {
+	FileID     int
+	FeedbackID int
+	FilePath   string
+	Missing    bool
+}
+
+/**
+ * @description: 查询仍被引用的对象路径，包括未过期的附件及其缩略图和隔离副本、未过期的上传登记和上传中的分片会话
+ * @param {time.Time} now 当前时间，用于判断上传登记是否过期
+ * @return {*}
+ */
+func QueryReferencedObjectKeys(now time.Time) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	queries := []struct {
+		query string
+		args  []any
+	}{
+		{"SELECT file_path FROM file WHERE expired_at IS NULL", nil},
+		{"SELECT thumbnail_path FROM file WHERE thumbnail_path IS NOT NULL AND expired_at IS NULL", nil},
+		{"SELECT quarantine_path FROM file WHERE quarantine_path IS NOT NULL AND expired_at IS NULL", nil},
+		{"SELECT object_key FROM upload_ticket WHERE feedback_id IS NULL AND expires_at > ?", []any{now}},
+		{"SELECT object_key FROM upload_session WHERE status = ?", []any{dto.UploadSessionUploading}},
+	}
+
+	for _, item := range queries {
+		rows, err := db.Query(item.query, item.args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var objectKey string
+			if err = rows.Scan(&objectKey); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			referenced[objectKey] = true
+		}
+
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return referenced, nil
+}
+
+/**
+ * @description: 查询所有附件记录
+ * @return {*}
+ */
+func QueryFileObjects() ([]FileObject, error) {
+	// 已隔离或已过期的附件原对象已移走，不算丢失
+	rows, err := db.Query("SELECT file_id, feedback_id, file_path, missing_at FROM file WHERE quarantine_path IS NULL AND expired_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []FileObject{}
+	for rows.Next() {
+		var (
+			file       FileObject
+			feedbackID sql.NullInt64
+			missingAt  sql.NullTime
+		)
+
+		if err = rows.Scan(&file.FileID, &feedbackID, &file.FilePath, &missingAt); err != nil {
+			return nil, err
+		}
+
+		file.FeedbackID = int(feedbackID.Int64)
+		file.Missing = missingAt.Valid
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+/**
+ * @description: 标记或取消标记附件在存储上已丢失
+ * @param {[]int} fileIDs 附件id
+ * @param {bool} missing 是否丢失
+ * @return {*}
+ */
+func MarkFilesMissing(fileIDs []int, missing bool) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(fileIDs)), ",")
+	args := make([]any, 0, len(fileIDs)+1)
+	if missing {
+		args = append(args, time.Now())
+	} else {
+		args = append(args, nil)
+	}
+	for _, id := range fileIDs {
+		args = append(args, id)
+	}
+
+	_, err := db.Exec("UPDATE file SET missing_at = ? WHERE file_id IN ("+placeholders+")", args...)
+	return err
+}
+
+/**
+ * @description: 删除过期的上传登记
+ * @param {time.Time} before 过期时间早于该时间的登记会被删除
+ * @return {*} 删除的条数
+ */
+func DeleteExpiredUploadTickets(before time.Time) (int64, error) {
+	result, err := db.Exec("DELETE FROM upload_ticket WHERE expires_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,200 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-09 10:26:31
+ * @LastEditTime: 2024-10-09 17:13:45
+ * @FilePath: \UserFeedBack\dbwrapper\retention.go
+ * @Description: 附件保留策略与用量统计
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+	"time"
+)
+
+// 按配额统计附件用量的维度
+type UsageScope int
+
+const (
+	ScopeModule UsageScope = iota
+	ScopeVersion
+)
+
+// 统计维度对应的反馈字段，版本可能为空
+var scopeColumns = map[UsageScope]string{
+	ScopeModule:  "f.impacted_module",
+	ScopeVersion: "COALESCE(f.app_version, '')",
+}
+
+// 保留策略处理的附件
+type RetentionFile struct {
+	FileID   int
+	FileSize int64
+}
+
+/**
+ * @description: 查询反馈提交时间早于指定时间、尚未过期的附件
+ * @param {time.Time} before 截止时间
+ * @return {*}
+ */
+func QueryFilesSubmittedBefore(before time.Time) ([]RetentionFile, error) {
+	// SQLite的提交时间按UTC写入，统一使用UTC比较
+	rows, err := db.Query("SELECT fl.file_id, fl.file_size FROM file fl JOIN feedback f ON f.feedback_id = fl.feedback_id WHERE fl.expired_at IS NULL AND f.time_stamp < ? ORDER BY fl.file_id",
+		before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRetentionFiles(rows)
+}
+
+/**
+ * @description: 按维度统计未过期附件的总大小
+ * @param {UsageScope} scope 统计维度
+ * @return {*} 维度取值到总大小的映射
+ */
+func QueryUsageByScope(scope UsageScope) (map[string]int64, error) {
+	column := scopeColumns[scope]
+	rows, err := db.Query("SELECT " + column + ", SUM(fl.file_size) FROM file fl JOIN feedback f ON f.feedback_id = fl.feedback_id WHERE fl.expired_at IS NULL GROUP BY " + column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]int64)
+	for rows.Next() {
+		var (
+			value string
+			size  sql.NullInt64
+		)
+		if err = rows.Scan(&value, &size); err != nil {
+			return nil, err
+		}
+		usage[value] = size.Int64
+	}
+
+	return usage, rows.Err()
+}
+
+/**
+ * @description: 查询维度取值下未过期的附件，按反馈从新到旧排列
+ * @param {UsageScope} scope 统计维度
+ * @param {string} value 维度取值
+ * @return {*}
+ */
+func QueryScopeFiles(scope UsageScope, value string) ([]RetentionFile, error) {
+	rows, err := db.Query("SELECT fl.file_id, fl.file_size FROM file fl JOIN feedback f ON f.feedback_id = fl.feedback_id WHERE fl.expired_at IS NULL AND "+scopeColumns[scope]+" = ? ORDER BY f.time_stamp DESC, fl.file_id DESC",
+		value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRetentionFiles(rows)
+}
+
+/**
+ * @description: 读取附件id和大小
+ * @param {*sql.Rows} rows 查询结果
+ * @return {*}
+ */
+func scanRetentionFiles(rows *sql.Rows) ([]RetentionFile, error) {
+	files := []RetentionFile{}
+	for rows.Next() {
+		var (
+			file     RetentionFile
+			fileSize sql.NullInt64
+		)
+		if err := rows.Scan(&file.FileID, &fileSize); err != nil {
+			return nil, err
+		}
+		file.FileSize = fileSize.Int64
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+/**
+ * @description: 标记附件已过期，不再被未过期记录引用的对象加入待删除队列，反馈内容保留
+ * @param {[]int} fileIDs 附件id
+ * @param {time.Time} now 过期时间
+ * @return {*}
+ */
+func ExpireFiles(fileIDs []int, now time.Time) error {
+	if len(fileIDs) == 0 {
+		return nil
+	}
+
+	args := make([]any, 0, len(fileIDs))
+	for _, fileID := range fileIDs {
+		args = append(args, fileID)
+	}
+	in := placeholders(len(fileIDs))
+
+	// 开启事务
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// 确保失败时能正确回滚
+	defer tx.Rollback()
+
+	// 锁住引用相同对象的记录，避免对象刚被其他反馈引用时被删除
+	objects, err := lockFileObjects(tx, "file_id IN ("+in+")", args...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE file SET expired_at = ? WHERE expired_at IS NULL AND file_id IN ("+in+")", append([]any{now}, args...)...)
+	if err != nil {
+		return err
+	}
+
+	if err = releaseFileObjects(tx, objects); err != nil {
+		return err
+	}
+
+	// 提交事务
+	return tx.Commit()
+}
+
+/**
+ * @description: 按反馈提交月份、影响模块和版本统计未过期附件的数量和总大小
+ * @return {*}
+ */
+func QueryUsageReport() (*dto.UsageReport, error) {
+	rows, err := db.Query(`
+        SELECT
+            ` + sqlDialect.month("f.time_stamp") + ` AS month, f.impacted_module, COALESCE(f.app_version, ''),
+            COUNT(*), COALESCE(SUM(fl.file_size), 0)
+        FROM
+            file fl
+        JOIN
+            feedback f ON f.feedback_id = fl.feedback_id
+        WHERE
+            fl.expired_at IS NULL
+        GROUP BY
+            month, f.impacted_module, COALESCE(f.app_version, '')
+        ORDER BY
+            month DESC, f.impacted_module, COALESCE(f.app_version, '')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &dto.UsageReport{Rows: []dto.UsageRow{}}
+	for rows.Next() {
+		var row dto.UsageRow
+		if err = rows.Scan(&row.Month, &row.ImpactedModule, &row.AppVersion, &row.FileCount, &row.TotalSize); err != nil {
+			return nil, err
+		}
+		report.Rows = append(report.Rows, row)
+		report.FileCount += row.FileCount
+		report.TotalSize += row.TotalSize
+	}
+
+	return report, rows.Err()
+}
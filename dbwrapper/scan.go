@@ -0,0 +1,78 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-08 13:40:26
+ * @LastEditTime: 2024-10-08 16:52:37
+ * @FilePath: \UserFeedBack\dbwrapper\scan.go
+ * @Description: 附件病毒扫描任务
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+	"time"
+)
+
+// 待扫描的对象，引用同一对象的附件记录共用扫描结果
+type ScanTask struct {
+	FilePath string
+	FileSize int64
+	Attempts int // 已失败的次数
+}
+
+/**
+ * @description: 查询到期的待扫描对象，包括启用扫描前提交、扫描状态为空的附件，失败次数少的优先
+ * @param {time.Time} now 当前时间，未到重试时间的对象跳过
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func QueryPendingScans(now time.Time, limit int) ([]ScanTask, error) {
+	rows, err := db.Query("SELECT file_path, MAX(file_size), MAX(scan_attempts) FROM file WHERE (scan_status = ? OR scan_status IS NULL) AND (scan_retry_at IS NULL OR scan_retry_at <= ?) AND missing_at IS NULL AND expired_at IS NULL GROUP BY file_path ORDER BY MAX(scan_attempts), MIN(file_id) LIMIT ?",
+		dto.ScanPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []ScanTask{}
+	for rows.Next() {
+		var (
+			task     ScanTask
+			fileSize sql.NullInt64
+		)
+		if err = rows.Scan(&task.FilePath, &fileSize, &task.Attempts); err != nil {
+			return nil, err
+		}
+		task.FileSize = fileSize.Int64
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+/**
+ * @description: 扫描暂时失败，记录原因并推迟下次扫描，保持待扫描状态
+ * @param {string} filePath 对象路径
+ * @param {time.Time} retryAt 下次扫描时间
+ * @param {string} lastError 本次失败的原因
+ * @return {*}
+ */
+func RetryScan(filePath string, retryAt time.Time, lastError string) error {
+	_, err := db.Exec("UPDATE file SET scan_attempts = scan_attempts + 1, scan_retry_at = ?, scan_result = ? WHERE file_path = ? AND (scan_status = ? OR scan_status IS NULL)",
+		retryAt, nullString(lastError), filePath, dto.ScanPending)
+	return err
+}
+
+/**
+ * @description: 记录扫描结果
+ * @param {string} filePath 对象路径
+ * @param {string} status 扫描状态
+ * @param {string} result 病毒名或扫描失败的原因
+ * @param {string} quarantinePath 隔离后的对象路径，未隔离时为空
+ * @return {*}
+ */
+func FinishScan(filePath string, status string, result string, quarantinePath string) error {
+	_, err := db.Exec("UPDATE file SET scan_status = ?, scan_result = ?, quarantine_path = ? WHERE file_path = ? AND (scan_status = ? OR scan_status IS NULL)",
+		status, nullString(result), nullString(quarantinePath), filePath, dto.ScanPending)
+	return err
+}
@@ -0,0 +1,337 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-16 09:41:18
+ * @LastEditTime: 2024-10-16 17:22:35
+ * @FilePath: \UserFeedBack\dbwrapper\search.go
+ * @Description: 反馈全文检索
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// 一次检索最多使用的检索词数量，超出的部分忽略
+const maxSearchTerms = 32
+
+// 检索结果摘要的最大字符数
+const searchSnippetLength = 2 * snippetContext
+
+// 参与检索的字段
+type searchField struct {
+	name string
+	text string
+}
+
+/**
+ * @description: 统一字符的形式，全角字母数字转为半角并转为小写，逐字符转换以保持和原文的位置对应
+ * @param {rune} r 字符
+ * @return {*}
+ */
+func normalizeRune(r rune) rune {
+	switch {
+	case r == '　':
+		r = ' '
+	case r >= '！' && r <= '～':
+		r -= 0xfee0
+	}
+
+	return unicode.ToLower(r)
+}
+
+/**
+ * @description: 是否为中日韩文字，这些文字的词之间没有空格，按二元组切分
+ * @param {rune} r 字符
+ * @return {*}
+ */
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+/**
+ * @description: 分词，连续的字母数字作为一个词，中日韩文字按相邻两字切分，单独一个字时保留单字
+ * @param {string} text 文本
+ * @return {*}
+ */
+func tokenize(text string) []string {
+	var (
+		tokens []string
+		word   []rune
+		cjk    []rune
+	)
+
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		if len(cjk) == 1 {
+			tokens = append(tokens, string(cjk))
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens = append(tokens, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range text {
+		r = normalizeRune(r)
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+
+	return tokens
+}
+
+/**
+ * @description: 把检索内容切分为去重后的检索词
+ * @param {string} query 检索内容
+ * @return {*}
+ */
+func searchTerms(query string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, token := range tokenize(query) {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		terms = append(terms, token)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+
+	return terms
+}
+
+/**
+ * @description: 为尚未建立检索文本的反馈分词，写入search_text后由数据库的全文索引收录
+ * @param {int} limit 每次最多处理的条数
+ * @return {*} 处理的条数
+ */
+func BuildSearchIndex(limit int) (int, error) {
+	rows, err := db.Query("SELECT feedback_id, bug_description, reproduce_steps, user_info FROM feedback WHERE search_text IS NULL ORDER BY feedback_id LIMIT ?", limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		ids   []any
+		texts = map[int][]string{}
+	)
+	for rows.Next() {
+		var (
+			feedbackID     int
+			bugDescription string
+			reproduceSteps string
+			userInfo       sql.NullString
+		)
+		if err = rows.Scan(&feedbackID, &bugDescription, &reproduceSteps, &userInfo); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, feedbackID)
+		texts[feedbackID] = []string{bugDescription, reproduceSteps, userInfo.String}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// 附件的文件名一起收录
+	rows, err = db.Query("SELECT feedback_id, file_name FROM file WHERE feedback_id IN ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var (
+			feedbackID int
+			fileName   string
+		)
+		if err = rows.Scan(&feedbackID, &fileName); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		texts[feedbackID] = append(texts[feedbackID], fileName)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		// 各字段分开分词，避免字段首尾的文字拼成二元组
+		var tokens []string
+		for _, text := range texts[id.(int)] {
+			tokens = append(tokens, tokenize(text)...)
+		}
+		if _, err = db.Exec("UPDATE feedback SET search_text = ? WHERE feedback_id = ?", strings.Join(tokens, " "), id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+/**
+ * @description: 在问题描述、复现步骤、用户信息和附件文件名中全文检索，按相关度从高到低返回
+ * @param {string} query 检索内容，多个检索词之间为与的关系
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func SearchFeedback(query string, limit int) ([]dto.FeedbackSearchHit, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []dto.FeedbackSearchHit{}, nil
+	}
+
+	statement, args := sqlDialect.searchQuery(terms, limit)
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		ids    []int
+		scores = map[int]float64{}
+	)
+	for rows.Next() {
+		var (
+			feedbackID int
+			score      float64
+		)
+		if err = rows.Scan(&feedbackID, &score); err != nil {
+			return nil, err
+		}
+		ids = append(ids, feedbackID)
+		scores[feedbackID] = score
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	feedbacks, err := QueryFeedbackByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	details := make(map[int]dto.FeedbackQueryOne, len(feedbacks))
+	for _, feedback := range feedbacks {
+		details[feedback.FeedbackID] = feedback
+	}
+
+	// 按相关度的顺序输出，检索后被删除的反馈跳过
+	hits := []dto.FeedbackSearchHit{}
+	for _, id := range ids {
+		feedback, ok := details[id]
+		if !ok {
+			continue
+		}
+
+		hit := dto.FeedbackSearchHit{
+			FeedbackID:     feedback.FeedbackID,
+			AppVersion:     feedback.AppVersion,
+			TimeStamp:      feedback.TimeStamp,
+			ImpactedModule: feedback.ImpactedModule,
+			Score:          scores[id],
+			Highlights:     []dto.SearchHighlight{},
+		}
+		fields := []searchField{
+			{dto.SearchFieldBugDescription, feedback.BugDescription},
+			{dto.SearchFieldReproduceSteps, feedback.ReproduceSteps},
+			{dto.SearchFieldUserInfo, feedback.UserInfo},
+		}
+		for _, file := range feedback.Files {
+			fields = append(fields, searchField{dto.SearchFieldFileName, file.FileName})
+		}
+		for _, field := range fields {
+			if snippet, ok := highlight(field.text, terms); ok {
+				hit.Highlights = append(hit.Highlights, dto.SearchHighlight{Field: field.name, Snippet: snippet})
+			}
+		}
+		hits = append(hits, hit)
+	}
+
+	return hits, nil
+}
+
+/**
+ * @description: 截取第一个命中位置附近的内容，转义后用<mark></mark>标出命中的检索词，相邻的命中合并标记
+ * @param {string} text 原文
+ * @param {[]string} terms 检索词
+ * @return {*} 摘要，以及是否命中
+ */
+func highlight(text string, terms []string) (string, bool) {
+	runes := []rune(text)
+	normalized := make([]rune, len(runes))
+	for i, r := range runes {
+		normalized[i] = normalizeRune(r)
+	}
+
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		pattern := []rune(term)
+		for i := 0; i+len(pattern) <= len(normalized); i++ {
+			if string(normalized[i:i+len(pattern)]) != term {
+				continue
+			}
+			for j := i; j < i+len(pattern); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	start := max(first-snippetContext, 0)
+	end := min(start+searchSnippetLength, len(runes))
+
+	var builder strings.Builder
+	if start > 0 {
+		builder.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		segment := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			builder.WriteString("<mark>" + segment + "</mark>")
+		} else {
+			builder.WriteString(segment)
+		}
+		i = j
+	}
+	if end < len(runes) {
+		builder.WriteString("…")
+	}
+
+	return builder.String(), true
+}
@@ -0,0 +1,146 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-13 14:11:30
+ * @LastEditTime: 2024-09-13 18:03:14
+ * @FilePath: \UserFeedBack\dbwrapper\session.go
+ * @Description: 分片上传会话
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// 分片上传会话不存在
+var ErrUploadSessionNotFound = errors.New("upload session not found")
+
+/**
+ * @description: 记录新的分片上传会话
+ * @param {dto.UploadSession} session 上传会话
+ * @return {*}
+ */
+func CreateUploadSession(session dto.UploadSession) error {
+	_, err := db.Exec("INSERT INTO upload_session (upload_id, object_key, storage_upload_id, ticket_id, file_name, content_type, total_size, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		session.UploadID,
+		session.ObjectKey,
+		session.StorageUploadID,
+		session.TicketID,
+		session.FileName,
+		session.ContentType,
+		session.TotalSize,
+		session.Status,
+		session.CreatedAt,
+		session.UpdatedAt)
+	return err
+}
+
+/**
+ * @description: 查询分片上传会话
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func GetUploadSession(uploadID string) (*dto.UploadSession, error) {
+	sessions, err := queryUploadSessions("SELECT upload_id, object_key, storage_upload_id, ticket_id, file_name, content_type, total_size, status, created_at, updated_at FROM upload_session WHERE upload_id = ?",
+		uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sessions) == 0 {
+		return nil, ErrUploadSessionNotFound
+	}
+
+	return &sessions[0], nil
+}
+
+/**
+ * @description: 查询长时间没有进展的上传中会话
+ * @param {time.Time} before 最后更新时间早于该时间的视为过期
+ * @return {*}
+ */
+func QueryStaleUploadSessions(before time.Time) ([]dto.UploadSession, error) {
+	return queryUploadSessions("SELECT upload_id, object_key, storage_upload_id, ticket_id, file_name, content_type, total_size, status, created_at, updated_at FROM upload_session WHERE status = ? AND updated_at < ?",
+		dto.UploadSessionUploading, before)
+}
+
+/**
+ * @description: 刷新会话的最后更新时间
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func TouchUploadSession(uploadID string) error {
+	_, err := db.Exec("UPDATE upload_session SET updated_at = ? WHERE upload_id = ?", time.Now(), uploadID)
+	return err
+}
+
+/**
+ * @description: 结束上传中的会话，会话已结束时返回ErrUploadSessionNotFound
+ * @param {string} uploadID 上传id
+ * @param {string} status 结束状态
+ * @return {*}
+ */
+func FinishUploadSession(uploadID string, status string) error {
+	result, err := db.Exec("UPDATE upload_session SET status = ?, updated_at = ? WHERE upload_id = ? AND status = ?",
+		status, time.Now(), uploadID, dto.UploadSessionUploading)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUploadSessionNotFound
+	}
+
+	return nil
+}
+
+/**
+ * @description: 执行查询并解析会话列表
+ * @param {string} query 查询语句
+ * @param {...any} args 查询参数
+ * @return {*}
+ */
+func queryUploadSessions(query string, args ...any) ([]dto.UploadSession, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []dto.UploadSession{}
+	for rows.Next() {
+		var (
+			session     dto.UploadSession
+			ticketID    sql.NullString
+			contentType sql.NullString
+		)
+
+		err = rows.Scan(
+			&session.UploadID,
+			&session.ObjectKey,
+			&session.StorageUploadID,
+			&ticketID,
+			&session.FileName,
+			&contentType,
+			&session.TotalSize,
+			&session.Status,
+			&session.CreatedAt,
+			&session.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		session.TicketID = ticketID.String
+		session.ContentType = contentType.String
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
@@ -0,0 +1,118 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-11 11:20:44
+ * @LastEditTime: 2024-10-11 15:42:30
+ * @FilePath: \UserFeedBack\dbwrapper\sqlite.go
+ * @Description: 内嵌SQLite实现，本地运行和测试时无需数据库服务
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/configwrapper"
+	"database/sql"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// 未配置时SQLite数据库文件的路径
+const defaultSQLitePath = "data/feedback.db"
+
+// 内存数据库，进程退出后数据丢失
+const sqliteMemory = ":memory:"
+
+// SQLite方言
+type sqliteDialect struct{}
+
+func (sqliteDialect) name() string {
+	return DriverSQLite
+}
+
+// SQLite没有行锁，写事务以IMMEDIATE方式开始，整库串行
+func (sqliteDialect) forUpdate() string {
+	return ""
+}
+
+func (sqliteDialect) month(column string) string {
+	return "strftime('%Y-%m', " + column + ")"
+}
+
+func (sqliteDialect) rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) insertID(tx *sqlTx, query string, idColumn string, args ...any) (int64, error) {
+	return lastInsertID(tx, query, args...)
+}
+
+/**
+ * @description: 通过FTS5检索，空格分隔的检索词须全部命中，按前缀匹配，bm25越小越相关，取反作为相关度
+ * @param {[]string} terms 检索词
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func (sqliteDialect) searchQuery(terms []string, limit int) (string, []any) {
+	parts := make([]string, 0, len(terms))
+	for _, term := range terms {
+		parts = append(parts, `"`+term+`"*`)
+	}
+
+	return "SELECT rowid, -bm25(feedback_fts) AS score FROM feedback_fts WHERE feedback_fts MATCH ? " +
+		"ORDER BY score DESC, rowid DESC LIMIT ?", []any{strings.Join(parts, " "), limit}
+}
+
+func (sqliteDialect) snippet(column string) string {
+	return "substr(" + column + ", max(instr(" + column + ", ?) - ?, 1), ? + length(?) + ?)"
+}
+
+// 写事务以IMMEDIATE方式开始，各迁移的事务本身互斥，执行前会在事务中再确认一次未执行过
+func (sqliteDialect) lockMigrations(conn *sql.DB) (func(), error) {
+	return func() {}, nil
+}
+
+/**
+ * @description: 打开SQLite数据库文件，不存在时创建
+ * @param {configwrapper.Database} cfg 数据库配置
+ * @return {*}
+ */
+func newSQLiteStore(cfg configwrapper.Database) (*sqlStore, error) {
+	path := cfg.Path
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	if path != sqliteMemory {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	// 每个连接都打开外键约束，写事务开始时即加锁，时间统一按SQLite的文本格式写入以便比较
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Set("_txlock", "immediate")
+	params.Set("_time_format", "sqlite")
+	if path != sqliteMemory {
+		params.Add("_pragma", "journal_mode(WAL)")
+	}
+
+	conn, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// 内存数据库每个连接都是独立的库，只能使用一个连接
+	if path == sqliteMemory {
+		conn.SetMaxOpenConns(1)
+	}
+
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: &sqlDB{DB: conn, dialect: sqliteDialect{}}, dialect: sqliteDialect{}}, nil
+}
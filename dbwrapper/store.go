@@ -0,0 +1,188 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-11 09:32:05
+ * @LastEditTime: 2024-10-11 15:42:30
+ * @FilePath: \UserFeedBack\dbwrapper\store.go
+ * @Description: 反馈存储接口
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+)
+
+// 支持的数据库
+const (
+	DriverMySQL    = "mysql"
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// 反馈存储
+type FeedbackStore interface {
+	// 数据库名称
+	Name() string
+	// 提交反馈，附件须已通过上传登记
+	InsertFeedback(feedback dto.FeedbackUpload) error
+	// 按条件分页查询反馈
+	QueryFeedback(filter dto.FeedbackFilter, pageIndex int, pageSize int) (dto.FeedbackQueryAll, error)
+	// 按id查询反馈，不存在的id会被忽略
+	QueryFeedbackByIDs(ids []int) ([]dto.FeedbackQueryOne, error)
+	// 查询反馈关联的附件
+	QueryRelatedFilesByFeedbackID(feedbackIDs []int) []FeedbackRelatedFile
+	// 逐条删除反馈
+	DeleteFeedbackByID(feedbackIDs []int) []dto.DeleteFeedbackResult
+	// 关闭连接
+	Close() error
+}
+
+// 不同数据库之间有差异的SQL片段
+type dialect interface {
+	// 数据库名称
+	name() string
+	// 加锁读取时追加在语句末尾的子句
+	forUpdate() string
+	// 取时间列的年月，格式为2006-01
+	month(column string) string
+	// 截取关键字附近的内容，参数依次为关键字、前后保留的字符数、前后保留的字符数、关键字、前后保留的字符数
+	snippet(column string) string
+	// 把语句中的?占位符改写为数据库使用的占位符
+	rebind(query string) string
+	// 执行插入语句并返回自增主键
+	insertID(tx *sqlTx, query string, idColumn string, args ...any) (int64, error)
+	// 获取迁移锁，避免多个实例同时迁移，返回释放锁的函数
+	lockMigrations(conn *sql.DB) (func(), error)
+	// 全文检索语句，结果为反馈id和相关度，按相关度从高到低排列，terms为分词后的检索词，须全部命中
+	searchQuery(terms []string, limit int) (string, []any)
+}
+
+// 按方言改写占位符的数据库连接，语句统一使用?占位符
+type sqlDB struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (d *sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return d.DB.Query(d.dialect.rebind(query), args...)
+}
+
+func (d *sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	return d.DB.QueryRow(d.dialect.rebind(query), args...)
+}
+
+func (d *sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	return d.DB.Exec(d.dialect.rebind(query), args...)
+}
+
+func (d *sqlDB) Begin() (*sqlTx, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlTx{Tx: tx, dialect: d.dialect}, nil
+}
+
+// 按方言改写占位符的事务
+type sqlTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.Tx.Query(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.Tx.QueryRow(t.dialect.rebind(query), args...)
+}
+
+func (t *sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.Tx.Exec(t.dialect.rebind(query), args...)
+}
+
+/**
+ * @description: 执行插入语句并通过LastInsertId取得自增主键，适用于MySQL和SQLite
+ * @param {*sqlTx} tx 事务
+ * @param {string} query 插入语句
+ * @param {...any} args 参数
+ * @return {*}
+ */
+func lastInsertID(tx *sqlTx, query string, args ...any) (int64, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// 基于database/sql的反馈存储，各数据库只在连接方式、表结构和方言上不同
+type sqlStore struct {
+	db      *sqlDB
+	dialect dialect
+}
+
+func (s *sqlStore) Name() string {
+	return s.dialect.name()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+/**
+ * @description: 获取当前使用的反馈存储
+ * @return {*}
+ */
+func Current() FeedbackStore {
+	return store
+}
+
+/**
+ * @description: 提交反馈数据到数据库
+ * @param {dto.FeedbackUpload} feedback
+ * @return {*}
+ */
+func InsertFeedback(feedback dto.FeedbackUpload) error {
+	return store.InsertFeedback(feedback)
+}
+
+/**
+ * @description: 按条件分页查询反馈信息
+ * @param {dto.FeedbackFilter} filter 查询条件和排序
+ * @param {int} pageIndex 分页索引
+ * @param {int} pageSize 分页大小
+ * @return {*}
+ */
+func QueryFeedback(filter dto.FeedbackFilter, pageIndex int, pageSize int) (dto.FeedbackQueryAll, error) {
+	return store.QueryFeedback(filter, pageIndex, pageSize)
+}
+
+/**
+ * @description: 按id查询反馈信息，不存在的id会被忽略
+ * @param {[]int} ids 反馈id
+ * @return {*}
+ */
+func QueryFeedbackByIDs(ids []int) ([]dto.FeedbackQueryOne, error) {
+	return store.QueryFeedbackByIDs(ids)
+}
+
+/**
+ * @description: 查询feedbackid相关的文件
+ * @param {[]int} feedbackIDs 要查询的feedbackid数组
+ * @return {*}
+ */
+func QueryRelatedFilesByFeedbackID(feedbackIDs []int) []FeedbackRelatedFile {
+	return store.QueryRelatedFilesByFeedbackID(feedbackIDs)
+}
+
+/**
+ * @description: 逐条删除反馈
+ * @param {[]int} feedbackIDs feedbackid数组
+ * @return {*} 每条反馈的删除结果
+ */
+func DeleteFeedbackByID(feedbackIDs []int) []dto.DeleteFeedbackResult {
+	return store.DeleteFeedbackByID(feedbackIDs)
+}
@@ -0,0 +1,77 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-29 11:02:36
+ * @LastEditTime: 2024-09-29 17:05:26
+ * @FilePath: \UserFeedBack\dbwrapper\thumbnail.go
+ * @Description: 缩略图生成任务
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/dto"
+	"database/sql"
+)
+
+// 待生成缩略图的对象，引用同一对象的附件记录共用一个缩略图
+type ThumbnailTask struct {
+	FilePath string
+	FileSize int64
+}
+
+/**
+ * @description: 查询待生成缩略图的对象
+ * @param {int} limit 最多返回的条数
+ * @return {*}
+ */
+func QueryPendingThumbnails(limit int) ([]ThumbnailTask, error) {
+	rows, err := db.Query("SELECT file_path, MAX(file_size) FROM file WHERE thumbnail_status = ? AND expired_at IS NULL GROUP BY file_path LIMIT ?",
+		dto.ThumbnailPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []ThumbnailTask{}
+	for rows.Next() {
+		var (
+			task     ThumbnailTask
+			fileSize sql.NullInt64
+		)
+		if err = rows.Scan(&task.FilePath, &fileSize); err != nil {
+			return nil, err
+		}
+		task.FileSize = fileSize.Int64
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+/**
+ * @description: 查询对象已生成的缩略图，内容寻址的对象被再次引用时直接复用
+ * @param {string} filePath 对象路径
+ * @return {*} 缩略图的对象路径，没有时为空
+ */
+func QueryReadyThumbnail(filePath string) (string, error) {
+	var thumbnailPath string
+	err := db.QueryRow("SELECT thumbnail_path FROM file WHERE file_path = ? AND thumbnail_status = ? AND expired_at IS NULL LIMIT 1",
+		filePath, dto.ThumbnailReady).Scan(&thumbnailPath)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return thumbnailPath, err
+}
+
+/**
+ * @description: 记录缩略图的生成结果
+ * @param {string} filePath 对象路径
+ * @param {string} thumbnailPath 缩略图的对象路径，未生成时为空
+ * @param {string} status 缩略图状态
+ * @return {*}
+ */
+func FinishThumbnail(filePath string, thumbnailPath string, status string) error {
+	_, err := db.Exec("UPDATE file SET thumbnail_path = ?, thumbnail_status = ? WHERE file_path = ? AND thumbnail_status = ?",
+		nullString(thumbnailPath), status, filePath, dto.ThumbnailPending)
+	return err
+}
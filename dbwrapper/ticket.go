@@ -0,0 +1,339 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-12 10:05:41
+ * @LastEditTime: 2024-09-12 17:22:09
+ * @FilePath: \UserFeedBack\dbwrapper\ticket.go
+ * @Description: 上传登记
+ */
+package dbwrapper
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/osswrapper"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 上传登记默认有效期
+const defaultTicketExpire = 24 * time.Hour
+
+// 反馈中的附件未通过校验
+var ErrInvalidAttachment = errors.New("invalid attachment")
+
+// 上传登记不存在、已过期或已被反馈使用
+var ErrInvalidUploadTicket = errors.New("invalid upload ticket")
+
+// 数据库连接或事务
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// 附件未通过校验的详细原因
+type AttachmentError struct {
+	Rejections []dto.FileRejection
+}
+
+/**
+ * @description: 拼接各附件未通过的原因
+ * @return {*}
+ */
+func (e *AttachmentError) Error() string {
+	reasons := make([]string, 0, len(e.Rejections))
+	for _, item := range e.Rejections {
+		reasons = append(reasons, item.File+": "+item.Reason)
+	}
+
+	return ErrInvalidAttachment.Error() + ": " + strings.Join(reasons, "; ")
+}
+
+/**
+ * @description: 可通过errors.Is判断为ErrInvalidAttachment
+ * @return {*}
+ */
+func (e *AttachmentError) Unwrap() error {
+	return ErrInvalidAttachment
+}
+
+/**
+ * @description: 单个附件未通过校验
+ * @param {string} objectKey 对象路径
+ * @param {string} reason 原因
+ * @return {*}
+ */
+func rejectAttachment(objectKey string, reason string) error {
+	return &AttachmentError{Rejections: []dto.FileRejection{{File: objectKey, ObjectKey: objectKey, Reason: reason}}}
+}
+
+/**
+ * @description: 签发上传凭证时登记本次允许上传的文件
+ * @param {[]dto.UploadTicketFile} files 待上传文件
+ * @return {*} 上传登记id，提交反馈时需要带上
+ */
+func CreateUploadTicket(files []dto.UploadTicketFile) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	ticketID := hex.EncodeToString(idBytes)
+
+	// 开启事务
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	// 确保失败时能正确回滚
+	defer tx.Rollback()
+
+	if err = insertTicketFiles(tx, ticketID, files); err != nil {
+		return "", err
+	}
+
+	// 提交事务
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return ticketID, nil
+}
+
+/**
+ * @description: 检查上传登记存在、未过期且未被反馈使用，只有这样的登记可以追加文件
+ * @param {string} ticketID 上传登记id
+ * @return {*} 不可用时返回ErrInvalidUploadTicket
+ */
+func CheckUploadTicket(ticketID string) error {
+	return checkTicketUsable(db, ticketID, "")
+}
+
+/**
+ * @description: 向已有的上传登记中追加文件
+ * @param {string} ticketID 上传登记id
+ * @param {[]dto.UploadTicketFile} files 待上传文件
+ * @return {*} 登记不可用时返回ErrInvalidUploadTicket
+ */
+func AddUploadTicketFiles(ticketID string, files []dto.UploadTicketFile) error {
+	// 开启事务
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// 确保失败时能正确回滚
+	defer tx.Rollback()
+
+	// 锁住登记再检查，避免与提交反馈交错
+	if err = checkTicketUsable(tx, ticketID, sqlDialect.forUpdate()); err != nil {
+		return err
+	}
+
+	if err = insertTicketFiles(tx, ticketID, files); err != nil {
+		return err
+	}
+
+	// 提交事务
+	return tx.Commit()
+}
+
+/**
+ * @description: 检查上传登记存在未过期的文件，且没有文件已被反馈使用
+ * @param {queryer} conn 数据库连接或事务
+ * @param {string} ticketID 上传登记id
+ * @param {string} lock 加锁子句，不加锁时为空
+ * @return {*}
+ */
+func checkTicketUsable(conn queryer, ticketID string, lock string) error {
+	rows, err := conn.Query("SELECT feedback_id FROM upload_ticket WHERE ticket_id = ? AND (feedback_id IS NOT NULL OR expires_at > ?)"+lock,
+		ticketID, time.Now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	usable := false
+	for rows.Next() {
+		var feedbackID sql.NullInt64
+		if err = rows.Scan(&feedbackID); err != nil {
+			return err
+		}
+		if feedbackID.Valid {
+			return ErrInvalidUploadTicket
+		}
+		usable = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if !usable {
+		return ErrInvalidUploadTicket
+	}
+
+	return nil
+}
+
+/**
+ * @description: 在事务中写入上传登记的文件
+ * @param {*sqlTx} tx 事务
+ * @param {string} ticketID 上传登记id
+ * @param {[]dto.UploadTicketFile} files 待上传文件
+ * @return {*}
+ */
+func insertTicketFiles(tx *sqlTx, ticketID string, files []dto.UploadTicketFile) error {
+	expire := defaultTicketExpire
+	if configwrapper.Cfg.Upload.TicketExpireSeconds > 0 {
+		expire = time.Duration(configwrapper.Cfg.Upload.TicketExpireSeconds) * time.Second
+	}
+	now := time.Now()
+
+	for _, file := range files {
+		_, err := tx.Exec("INSERT INTO upload_ticket (ticket_id, object_key, file_name, sha256, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+			ticketID, file.ObjectKey, file.FileName, nullString(file.Sha256), now, now.Add(expire))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 经过校验的附件信息
+type verifiedFile struct {
+	FileName    string
+	TicketKey   string // 登记的上传路径
+	ObjectKey   string // 附件记录引用的路径，内容寻址的文件为共用对象的路径
+	Size        int64
+	ETag        string
+	ContentType string
+	Sha256      string
+}
+
+/**
+ * @description: 在事务外校验附件已登记且确实已上传，文件信息以登记和存储上的为准，
+ * 读取和复制对象较慢，放在事务外避免长时间持有数据库锁
+ * @param {string} ticketID 上传登记id
+ * @param {dto.FeedbackFile} file 客户端提交的附件
+ * @return {*}
+ */
+func prepareTicketFile(ticketID string, file dto.FeedbackFile) (*verifiedFile, error) {
+	// 登记存在、未被使用且未过期，提交时在事务中再次确认
+	var (
+		fileName string
+		sha256   sql.NullString
+	)
+	err := db.QueryRow("SELECT file_name, sha256 FROM upload_ticket WHERE ticket_id = ? AND object_key = ? AND feedback_id IS NULL AND expires_at > ?",
+		ticketID, file.FilePathOnOss, time.Now()).Scan(&fileName, &sha256)
+	if err == sql.ErrNoRows {
+		return nil, rejectAttachment(file.FilePathOnOss, "file was not issued for this upload ticket")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	objectKey := file.FilePathOnOss
+	if sha256.Valid {
+		objectKey, err = settleBlob(file.FilePathOnOss, sha256.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 存储上确实存在该对象
+	info, err := osswrapper.Current().Stat(objectKey)
+	if errors.Is(err, osswrapper.ErrObjectNotFound) {
+		return nil, rejectAttachment(file.FilePathOnOss, "file has not been uploaded")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &verifiedFile{
+		FileName:    fileName,
+		TicketKey:   file.FilePathOnOss,
+		ObjectKey:   objectKey,
+		Size:        info.Size,
+		ETag:        info.ETag,
+		ContentType: info.ContentType,
+		Sha256:      sha256.String,
+	}, nil
+}
+
+/**
+ * @description: 校验暂存路径中的内容与声明的sha256一致，再由存储复制到共用对象，
+ * 共用对象从不签发上传权限，只会写入校验过的内容
+ * @param {string} ticketKey 登记的上传路径
+ * @param {string} sha256 声明的sha256
+ * @return {*} 共用对象的路径
+ */
+func settleBlob(ticketKey string, sha256 string) (string, error) {
+	blobKey := osswrapper.BlobObjectKey(sha256)
+
+	// 已有附件记录引用说明共用对象已校验过，直接复用
+	verified, err := blobVerified(sha256)
+	if err != nil {
+		return "", err
+	}
+	if verified {
+		return blobKey, nil
+	}
+
+	actual, err := osswrapper.ObjectSha256(ticketKey)
+	if errors.Is(err, osswrapper.ErrObjectNotFound) {
+		return "", rejectAttachment(ticketKey, "file has not been uploaded")
+	}
+	if err != nil {
+		return "", err
+	}
+	if actual != sha256 {
+		return "", rejectAttachment(ticketKey, "content does not match the declared sha256")
+	}
+
+	// 旧的登记直接指向共用对象，校验后原地使用
+	if ticketKey != blobKey {
+		// 共用对象可能正在待删除队列中，先取消删除再写入
+		if err = cancelObjectDeletion(blobKey); err != nil {
+			return "", err
+		}
+		if err = osswrapper.CopyObject(ticketKey, blobKey); err != nil {
+			return "", err
+		}
+	}
+
+	return blobKey, nil
+}
+
+/**
+ * @description: 在事务中再次确认登记未过期且未被其他反馈使用，同时锁住登记
+ * @param {*sqlTx} tx 事务
+ * @param {string} ticketID 上传登记id
+ * @param {string} ticketKey 登记的上传路径
+ * @param {int64} feedbackID 本次插入的反馈id，同一反馈可多次引用同一登记
+ * @return {*}
+ */
+func recheckTicketFile(tx *sqlTx, ticketID string, ticketKey string, feedbackID int64) error {
+	var fileName string
+	err := tx.QueryRow("SELECT file_name FROM upload_ticket WHERE ticket_id = ? AND object_key = ? AND (feedback_id IS NULL OR feedback_id = ?) AND expires_at > ?"+sqlDialect.forUpdate(),
+		ticketID, ticketKey, feedbackID, time.Now()).Scan(&fileName)
+	if err == sql.ErrNoRows {
+		return rejectAttachment(ticketKey, "file was not issued for this upload ticket")
+	}
+
+	return err
+}
+
+/**
+ * @description: 将上传登记标记为已被反馈使用
+ * @param {*sqlTx} tx 事务
+ * @param {string} ticketID 上传登记id
+ * @param {string} objectKey 对象路径
+ * @param {int64} feedbackID 反馈id
+ * @return {*}
+ */
+func consumeTicketFile(tx *sqlTx, ticketID string, objectKey string, feedbackID int64) error {
+	_, err := tx.Exec("UPDATE upload_ticket SET feedback_id = ? WHERE ticket_id = ? AND object_key = ?",
+		feedbackID, ticketID, objectKey)
+	return err
+}
@@ -7,10 +7,21 @@
  */
 package dto
 
+import "time"
+
 type FeedbackFile struct {
-	FileName      string `json:"fileName"`
-	FilePathOnOss string `json:"filePathOnOss"`
-	FileSize      int64  `json:"fileSize"`
+	FileID          int    `json:"fileID,omitempty"`
+	FileName        string `json:"fileName"`
+	FilePathOnOss   string `json:"filePathOnOss"`
+	FileSize        int64  `json:"fileSize"`
+	ContentType     string `json:"contentType,omitempty"`
+	Missing         bool   `json:"missing,omitempty"`
+	Expired         bool   `json:"expired,omitempty"`      // 超出保留策略，附件已删除
+	ThumbnailUrl    string `json:"thumbnailUrl,omitempty"` // 查询时由对象路径转换为下载地址
+	ThumbnailStatus string `json:"thumbnailStatus,omitempty"`
+	ArchiveStatus   string `json:"archiveStatus,omitempty"`
+	ScanStatus      string `json:"scanStatus,omitempty"`
+	ScanResult      string `json:"scanResult,omitempty"` // 病毒名或扫描失败的原因
 }
 
 type FeedbackUpload struct {
@@ -21,9 +32,56 @@ type FeedbackUpload struct {
 	ReproduceSteps     string         `json:"reproduceSteps"`
 	UserInfo           string         `json:"userInfo"`
 	Email              string         `json:"email"`
+	UploadTicket       string         `json:"uploadTicket"`
 	Files              []FeedbackFile `json:"files"`
 }
 
+// 未通过附件策略的文件及原因
+type FileRejection struct {
+	File      string `json:"file"`
+	ObjectKey string `json:"objectKey,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// 签发上传凭证时登记的待上传文件
+type UploadTicketFile struct {
+	ObjectKey string
+	FileName  string
+	Sha256    string // 客户端声明的sha256，内容寻址存放时才有
+}
+
+// 反馈的排序字段
+const (
+	SortByFeedbackID         = "feedbackID"
+	SortByTimeStamp          = "timeStamp"
+	SortByImpactedModule     = "impactedModule"
+	SortByOccurringFrequency = "occurringFrequency"
+	SortByAppVersion         = "appVersion"
+	SortByEmail              = "email"
+)
+
+// 反馈的查询条件，零值的条件不生效
+type FeedbackFilter struct {
+	FeedbackIDs      []int      // 反馈id在其中
+	MinFeedbackID    int        // 反馈id不小于
+	MaxFeedbackID    int        // 反馈id不大于
+	ImpactedModules  []string   // 影响模块在其中
+	MinFrequency     int        // 发生频率不小于
+	MaxFrequency     int        // 发生频率不大于
+	AppVersions      []string   // 版本在其中
+	AppVersionPrefix string     // 版本以此开头，如3.2.
+	Emails           []string   // 邮箱在其中
+	BugDescription   string     // 问题描述包含
+	ReproduceSteps   string     // 复现步骤包含
+	UserInfo         string     // 用户信息包含
+	ProcessInfo      string     // 进程信息包含
+	Since            *time.Time // 提交时间不早于
+	Until            *time.Time // 提交时间早于
+	HasFiles         *bool      // 是否有附件
+	SortBy           string     // 排序字段，为空时按反馈id
+	Descending       bool       // 是否降序
+}
+
 type FeedbackQueryAll struct {
 	TotalSize        int                `json:"totalSize"`
 	CurrentPageIndex int                `json:"currentPageIndex"`
@@ -43,3 +101,114 @@ type FeedbackQueryOne struct {
 	Email              string         `json:"email"`
 	Files              []FeedbackFile `json:"files"`
 }
+
+// 缩略图状态
+const (
+	ThumbnailPending = "pending"
+	ThumbnailReady   = "ready"
+	ThumbnailFailed  = "failed"
+	ThumbnailSkipped = "skipped"
+)
+
+// 病毒扫描状态
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanFailed   = "failed"
+)
+
+// 压缩包索引状态
+const (
+	ArchiveIndexPending = "pending"
+	ArchiveIndexReady   = "ready"
+	ArchiveIndexFailed  = "failed"
+	ArchiveIndexSkipped = "skipped"
+)
+
+// 压缩包中的文件
+type ArchiveMember struct {
+	MemberID   int64     `json:"memberID"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	Indexed    bool      `json:"indexed"` // 内容是否已加入搜索索引
+}
+
+// 压缩包内容的搜索结果
+type ArchiveSearchHit struct {
+	FeedbackID int    `json:"feedbackID"`
+	FileID     int    `json:"fileID"`
+	FileName   string `json:"fileName"`
+	MemberID   int64  `json:"memberID"`
+	MemberPath string `json:"memberPath"`
+	Snippet    string `json:"snippet"`
+}
+
+// 全文检索命中的字段
+const (
+	SearchFieldBugDescription = "bugDescription"
+	SearchFieldReproduceSteps = "reproduceSteps"
+	SearchFieldUserInfo       = "userInfo"
+	SearchFieldFileName       = "fileName"
+)
+
+// 全文检索命中字段的摘要
+type SearchHighlight struct {
+	Field   string `json:"field"`
+	Snippet string `json:"snippet"` // 已做html转义，命中的内容用<mark></mark>标出
+}
+
+// 反馈全文检索的结果
+type FeedbackSearchHit struct {
+	FeedbackID     int               `json:"feedbackID"`
+	AppVersion     string            `json:"appVersion"`
+	TimeStamp      int64             `json:"timeStamp"`
+	ImpactedModule string            `json:"impactedModule"`
+	Score          float64           `json:"score"` // 相关度，只用于同一次检索的结果之间比较
+	Highlights     []SearchHighlight `json:"highlights"`
+}
+
+// 分片上传会话状态
+const (
+	UploadSessionUploading = "uploading"
+	UploadSessionCompleted = "completed"
+	UploadSessionAborted   = "aborted"
+)
+
+// 分片上传会话
+type UploadSession struct {
+	UploadID        string
+	ObjectKey       string
+	StorageUploadID string
+	TicketID        string
+	FileName        string
+	ContentType     string
+	TotalSize       int64
+	Status          string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// 单条反馈的删除结果
+type DeleteFeedbackResult struct {
+	FeedbackID int    `json:"feedbackID"`
+	Deleted    bool   `json:"deleted"`
+	Error      string `json:"error,omitempty"`
+}
+
+// 按月份、影响模块和版本统计的附件用量
+type UsageRow struct {
+	Month          string `json:"month"` // 反馈提交的月份，如2024-09
+	ImpactedModule string `json:"impactedModule"`
+	AppVersion     string `json:"appVersion"`
+	FileCount      int64  `json:"fileCount"`
+	TotalSize      int64  `json:"totalSize"`
+}
+
+// 附件用量报表，只统计未过期的附件
+type UsageReport struct {
+	Rows      []UsageRow `json:"rows"`
+	FileCount int64      `json:"fileCount"`
+	TotalSize int64      `json:"totalSize"`
+}
@@ -0,0 +1,177 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-10 14:35:27
+ * @LastEditTime: 2024-10-10 16:47:05
+ * @FilePath: \UserFeedBack\health.go
+ * @Description: 存储自检与运行时重新加载存储凭证
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 未配置时存储自检的间隔
+const defaultHealthCheckInterval = 5 * time.Minute
+
+// 最近一次存储自检的结果
+var storageHealth atomic.Pointer[osswrapper.HealthReport]
+
+// 同一时间只允许一次重新加载
+var reloadMutex sync.Mutex
+
+/**
+ * @description: 对当前的存储后端执行自检并记录结果
+ * @return {*}
+ */
+func checkStorageHealth() *osswrapper.HealthReport {
+	report := osswrapper.CheckHealth(osswrapper.Current())
+	storageHealth.Store(report)
+
+	for _, check := range report.Checks {
+		if !check.Healthy {
+			logwrapper.Logger.Errorf("storage health check %s failed: %s", check.Name, check.Error)
+		}
+	}
+
+	return report
+}
+
+/**
+ * @description: 按配置的间隔定期执行存储自检
+ * @return {*}
+ */
+func runHealthCheck() {
+	interval := time.Duration(configwrapper.Cfg.Storage.HealthCheckSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		checkStorageHealth()
+	}
+}
+
+/**
+ * @description: 健康检查接口，存储自检未通过时返回503，管理员可以看到每项检查的详情
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := storageHealth.Load()
+	if report == nil {
+		http.Error(w, "Health check not finished", http.StatusServiceUnavailable)
+		return
+	}
+
+	// 未鉴权时不返回错误详情
+	if !authorized(r) {
+		report = &osswrapper.HealthReport{Backend: report.Backend, Healthy: report.Healthy, CheckedAt: report.CheckedAt}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logwrapper.Logger.Warn("error encoding health report:", err)
+	}
+}
+
+/**
+ * @description: 重新读取配置文件中的存储凭证，新凭证自检通过后替换，进行中的请求继续使用旧凭证
+ * @return {*} 新凭证的自检结果
+ */
+func reloadStorage() (*osswrapper.HealthReport, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	cfg, err := configwrapper.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := osswrapper.Reload(cfg)
+	if err != nil {
+		return report, err
+	}
+	storageHealth.Store(report)
+
+	return report, nil
+}
+
+/**
+ * @description: 重新加载存储凭证接口
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func reloadStorageHandler(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := reloadStorage()
+	if errors.Is(err, osswrapper.ErrBackendChanged) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if errors.Is(err, osswrapper.ErrUnhealthy) {
+		// 新凭证未通过自检，仍使用旧凭证
+		status = http.StatusBadGateway
+	} else if err != nil {
+		logwrapper.Logger.Error("error reloading storage:", err)
+		http.Error(w, "Failed to reload storage", http.StatusInternalServerError)
+		return
+	}
+
+	// 写入新凭证的自检结果
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		logwrapper.Logger.Warn("error encoding health report:", err)
+	}
+}
+
+/**
+ * @description: 收到SIGHUP时重新加载存储凭证
+ * @return {*}
+ */
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if _, err := reloadStorage(); err != nil {
+			logwrapper.Logger.Error("error reloading storage:", err)
+			continue
+		}
+		logwrapper.Logger.Info("storage credentials reloaded")
+	}
+}
@@ -13,10 +13,17 @@ import (
 	"UserFeedBack/dto"
 	"UserFeedBack/logwrapper"
 	"UserFeedBack/osswrapper"
+	"UserFeedBack/scanwrapper"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -48,7 +55,168 @@ func reportFeedback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 相关内容写入数据库
-	dbwrapper.InsertFeedback(reqBody)
+	if err = dbwrapper.InsertFeedback(reqBody); err != nil {
+		var attachmentErr *dbwrapper.AttachmentError
+		if errors.As(err, &attachmentErr) {
+			writeRejections(w, attachmentErr.Rejections)
+			return
+		}
+		logwrapper.Logger.Error("error inserting feedback:", err)
+		http.Error(w, "Failed to save feedback", http.StatusInternalServerError)
+		return
+	}
+
+	// 附件异步扫描病毒，图片附件异步生成缩略图，压缩包异步建立索引，反馈异步建立检索索引
+	notifyScan()
+	notifyThumbnail()
+	notifyArchiveIndex()
+	notifySearchIndex()
+
+	// 响应客户端已完成
+	fmt.Fprintf(w, "Files uploaded successfully")
+}
+
+/**
+ * @description: 汇报反馈接口，反馈内容和附件通过multipart/form-data一次提交，附件由服务端写入存储
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func reportFeedbackMultipart(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 限制请求总大小
+	if maxRequestSize := configwrapper.Cfg.Upload.MaxRequestSize; maxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	}
+
+	// 逐个读取表单项，附件边读边写入存储，不在内存中缓存
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Failed to parse multipart body", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		reqBody     dto.FeedbackUpload
+		hasFeedback bool
+		ticketFiles []dto.UploadTicketFile
+		specs       []osswrapper.FileSpec
+	)
+
+	// 本次上报的附件放在同一个随机目录下
+	reportID, err := osswrapper.NewUploadID()
+	if err != nil {
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+
+	// 失败时删除已经写入存储的附件，避免留下孤立对象
+	committed := false
+	defer func() {
+		if committed || len(ticketFiles) == 0 {
+			return
+		}
+		objectKeys := make([]string, 0, len(ticketFiles))
+		for _, item := range ticketFiles {
+			objectKeys = append(objectKeys, item.ObjectKey)
+		}
+		if err := osswrapper.DeleteFileOnOssByPath(objectKeys); err != nil {
+			logwrapper.Logger.Error("error cleaning up uploaded files:", err)
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Failed to parse multipart body", http.StatusBadRequest)
+			return
+		}
+
+		// 反馈内容
+		if part.FileName() == "" {
+			if part.FormName() == "feedback" {
+				if err = json.NewDecoder(part).Decode(&reqBody); err != nil {
+					part.Close()
+					http.Error(w, "Failed to parse feedback field", http.StatusBadRequest)
+					return
+				}
+				hasFeedback = true
+			}
+			part.Close()
+			continue
+		}
+
+		// 附件，写入存储前先按数量和扩展名校验，大小和类型在写入时校验
+		fileName := osswrapper.SanitizeFileName(part.FileName())
+		specs = append(specs, osswrapper.FileSpec{Name: fileName, RawName: part.FileName(), Size: -1})
+		if rejections := osswrapper.CheckFiles(specs); len(rejections) > 0 {
+			part.Close()
+			writeRejections(w, rejections)
+			return
+		}
+		objectKey, err := osswrapper.UploadFile(reportID, fileName, part, part.Header.Get("Content-Type"))
+		part.Close()
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.Is(err, osswrapper.ErrFileTooLarge), errors.As(err, &maxBytesErr):
+				http.Error(w, fmt.Sprintf("File too large: %s", fileName), http.StatusRequestEntityTooLarge)
+			case errors.Is(err, osswrapper.ErrContentTypeNotAllowed):
+				http.Error(w, fmt.Sprintf("Content type not allowed: %s", fileName), http.StatusUnsupportedMediaType)
+			default:
+				http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		ticketFiles = append(ticketFiles, dto.UploadTicketFile{ObjectKey: objectKey, FileName: fileName})
+	}
+
+	if !hasFeedback || reqBody.ImpactedModule == "" || reqBody.BugDescription == "" || reqBody.ReproduceSteps == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	// 服务端上传的附件同样走上传登记，由InsertFeedback统一校验
+	reqBody.Files = []dto.FeedbackFile{}
+	if len(ticketFiles) > 0 {
+		reqBody.UploadTicket, err = dbwrapper.CreateUploadTicket(ticketFiles)
+		if err != nil {
+			logwrapper.Logger.Error("error creating upload ticket:", err)
+			http.Error(w, "Failed to save feedback", http.StatusInternalServerError)
+			return
+		}
+		for _, item := range ticketFiles {
+			reqBody.Files = append(reqBody.Files, dto.FeedbackFile{FilePathOnOss: item.ObjectKey})
+		}
+	}
+
+	// 相关内容写入数据库
+	if err = dbwrapper.InsertFeedback(reqBody); err != nil {
+		var attachmentErr *dbwrapper.AttachmentError
+		if errors.As(err, &attachmentErr) {
+			writeRejections(w, attachmentErr.Rejections)
+			return
+		}
+		logwrapper.Logger.Error("error inserting feedback:", err)
+		http.Error(w, "Failed to save feedback", http.StatusInternalServerError)
+		return
+	}
+	committed = true
+
+	// 附件异步扫描病毒，图片附件异步生成缩略图，压缩包异步建立索引，反馈异步建立检索索引
+	notifyScan()
+	notifyThumbnail()
+	notifyArchiveIndex()
+	notifySearchIndex()
 
 	// 响应客户端已完成
 	fmt.Fprintf(w, "Files uploaded successfully")
@@ -90,13 +258,45 @@ func queryFeedback(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	filter, err := parseFeedbackFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// 查询数据库
-	feedbacks, err := dbwrapper.QueryFeedback(pageIndex, pageSize)
+	feedbacks, err := dbwrapper.QueryFeedback(filter, pageIndex, pageSize)
+	if errors.Is(err, dbwrapper.ErrInvalidSortField) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// 将存储路径转换为临时签名的下载地址
+	for i := range feedbacks.PageData {
+		for j := range feedbacks.PageData[i].Files {
+			file := &feedbacks.PageData[i].Files[j]
+			// 已过期或未通过扫描的附件不提供下载地址，缩略图由附件生成，同样不提供
+			if file.Expired || !scanAllowsDownload(file.ScanStatus) {
+				file.FilePathOnOss = ""
+				file.ThumbnailUrl = ""
+			} else if file.FilePathOnOss, err = osswrapper.ObjectURL(file.FilePathOnOss); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if file.ThumbnailUrl != "" {
+				file.ThumbnailUrl, err = osswrapper.ObjectURL(file.ThumbnailUrl)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+
 	// 写入查询结果
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(feedbacks)
@@ -106,6 +306,107 @@ func queryFeedback(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/**
+ * @description: 解析查询反馈的过滤和排序参数，可多选的参数通过重复传递，如impactedModule=A&impactedModule=B
+ * @param {url.Values} query 查询参数
+ * @return {*}
+ */
+func parseFeedbackFilter(query url.Values) (dto.FeedbackFilter, error) {
+	filter := dto.FeedbackFilter{
+		ImpactedModules:  query["impactedModule"],
+		AppVersions:      query["appVersion"],
+		AppVersionPrefix: query.Get("appVersionPrefix"),
+		Emails:           query["email"],
+		BugDescription:   query.Get("bugDescription"),
+		ReproduceSteps:   query.Get("reproduceSteps"),
+		UserInfo:         query.Get("userInfo"),
+		ProcessInfo:      query.Get("processInfo"),
+		SortBy:           query.Get("sortBy"),
+	}
+
+	for _, value := range query["feedbackID"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid feedbackID: %s", value)
+		}
+		filter.FeedbackIDs = append(filter.FeedbackIDs, id)
+	}
+
+	ints := []struct {
+		name  string
+		value *int
+	}{
+		{"minFeedbackID", &filter.MinFeedbackID},
+		{"maxFeedbackID", &filter.MaxFeedbackID},
+		{"minFrequency", &filter.MinFrequency},
+		{"maxFrequency", &filter.MaxFrequency},
+	}
+	for _, item := range ints {
+		value := query.Get(item.name)
+		if value == "" {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return filter, fmt.Errorf("invalid %s: %s", item.name, value)
+		}
+		*item.value = number
+	}
+
+	times := []struct {
+		name  string
+		value **time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	}
+	for _, item := range times {
+		value := query.Get(item.name)
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %s", item.name, value)
+		}
+		*item.value = &t
+	}
+
+	if value := query.Get("hasFiles"); value != "" {
+		hasFiles, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid hasFiles: %s", value)
+		}
+		filter.HasFiles = &hasFiles
+	}
+
+	switch order := query.Get("sortOrder"); order {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return filter, fmt.Errorf("invalid sortOrder: %s", order)
+	}
+
+	return filter, nil
+}
+
+/**
+ * @description: 解析时间参数，支持毫秒时间戳（与返回的timeStamp一致）、RFC3339和本地日期2006-01-02
+ * @param {string} value 参数值
+ * @return {*}
+ */
+func parseTimeParam(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(millis), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
+
 /**
  * @description: 查询上传文件保存路径
  * @param {http.ResponseWriter} w
@@ -121,7 +422,9 @@ func queryUploadSavePath(w http.ResponseWriter, r *http.Request) {
 
 	// 解析body
 	type RequestBody struct {
-		Files []string `json:"files"`
+		Files      []string          `json:"files"`
+		FileHashes map[string]string `json:"fileHashes"` // 可选，原始文件路径->sha256
+		FileSizes  map[string]int64  `json:"fileSizes"`  // 可选，原始文件路径->文件大小，提供时提前校验大小限制
 	}
 	var reqBody RequestBody
 	err := json.NewDecoder(r.Body).Decode(&reqBody)
@@ -130,9 +433,64 @@ func queryUploadSavePath(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 按附件策略校验，任一文件未通过时不签发凭证
+	specs := make([]osswrapper.FileSpec, 0, len(reqBody.Files))
+	for _, rawPath := range reqBody.Files {
+		size, ok := reqBody.FileSizes[rawPath]
+		if !ok {
+			size = -1
+		}
+		specs = append(specs, osswrapper.FileSpec{Name: osswrapper.SanitizeFileName(rawPath), RawName: rawPath, Size: size})
+	}
+	if rejections := osswrapper.CheckFiles(specs); len(rejections) > 0 {
+		writeRejections(w, rejections)
+		return
+	}
+
+	// 声明了sha256的文件查询内容是否已存在
+	hashes := make([]string, 0, len(reqBody.FileHashes))
+	for rawPath, sha256 := range reqBody.FileHashes {
+		sha256 = strings.ToLower(sha256)
+		if !osswrapper.ValidSha256(sha256) {
+			http.Error(w, "Invalid sha256 of "+rawPath, http.StatusBadRequest)
+			return
+		}
+		reqBody.FileHashes[rawPath] = sha256
+		hashes = append(hashes, sha256)
+	}
+
+	existingHashes, err := dbwrapper.QueryExistingBlobs(hashes)
+	if err != nil {
+		logwrapper.Logger.Error("error querying existing blobs:", err)
+		http.Error(w, "Failed to generate security token", http.StatusInternalServerError)
+		return
+	}
+
 	// OSS生成上传路径
-	respBody, err := osswrapper.GenerateSecurityToken(reqBody.Files)
+	respBody, err := osswrapper.GenerateSecurityToken(reqBody.Files, reqBody.FileHashes, existingHashes)
+	if err != nil {
+		http.Error(w, "Failed to generate security token", http.StatusInternalServerError)
+		return
+	}
+
+	// 登记本次允许上传的文件，提交反馈时据此校验，内容相同的文件共用一条登记
+	ticketFiles := make([]dto.UploadTicketFile, 0, len(respBody.OssPathReflect))
+	registered := make(map[string]bool)
+	for _, item := range respBody.OssPathReflect {
+		if registered[item.OssPath] {
+			continue
+		}
+		registered[item.OssPath] = true
+
+		ticketFiles = append(ticketFiles, dto.UploadTicketFile{
+			ObjectKey: item.OssPath,
+			FileName:  osswrapper.SanitizeFileName(item.RawPath),
+			Sha256:    item.Sha256,
+		})
+	}
+	respBody.UploadTicket, err = dbwrapper.CreateUploadTicket(ticketFiles)
 	if err != nil {
+		logwrapper.Logger.Error("error creating upload ticket:", err)
 		http.Error(w, "Failed to generate security token", http.StatusInternalServerError)
 		return
 	}
@@ -146,6 +504,21 @@ func queryUploadSavePath(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/**
+ * @description: 附件未通过策略时返回每个文件的原因
+ * @param {http.ResponseWriter} w
+ * @param {[]dto.FileRejection} rejections 未通过的附件及原因
+ * @return {*}
+ */
+func writeRejections(w http.ResponseWriter, rejections []dto.FileRejection) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":         dbwrapper.ErrInvalidAttachment.Error(),
+		"rejectedFiles": rejections,
+	})
+}
+
 /**
  * @description: 删除反馈接口
  * @param {http.ResponseWriter} w
@@ -170,23 +543,17 @@ func deleteFeedback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 查询关联的文件
-	queryResult := dbwrapper.QueryRelatedFilesByFeedbackID(reqBody.FeedBackIDs)
-	var feedbackIDs []int
-	var ossFiles []string
-	for _, item := range queryResult {
-		feedbackIDs = append(feedbackIDs, item.FeedbackID)
-		ossFiles = append(ossFiles, item.FileOssPath...)
-	}
-
-	// 在oss上删除文件
-	osswrapper.DeleteFileOnOssByPath(ossFiles)
-
-	// 数据库删除记录
-	dbwrapper.DeleteFeedbackByID(feedbackIDs)
+	// 数据库删除记录，附件由待删除队列异步删除
+	results := dbwrapper.DeleteFeedbackByID(reqBody.FeedBackIDs)
+	notifyOutbox()
 
-	// 响应客户端已完成
-	fmt.Fprintf(w, "Feedback delete successfully")
+	// 返回每条反馈的删除结果
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
 }
 
 func main() {
@@ -200,6 +567,11 @@ func main() {
 		logwrapper.Logger.Fatal(err)
 	}
 
+	// 迁移命令执行完即退出
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+
 	// 初始化数据库
 	dbwrapper.InitDB()
 	defer dbwrapper.CloseDB()
@@ -209,6 +581,32 @@ func main() {
 		logwrapper.Logger.Fatal(err)
 	}
 
+	// 启动时自检存储，未通过时只记录日志，便于在上传失败前发现配置问题
+	checkStorageHealth()
+	go runHealthCheck()
+	go watchReloadSignal()
+
+	// 初始化病毒扫描
+	if err := scanwrapper.Init(); err != nil {
+		logwrapper.Logger.Fatal(err)
+	}
+
+	// 定期清理过期的分片上传
+	go runUploadSessionJanitor()
+
+	// 定期清理孤立附件
+	go runReconciler()
+
+	// 定期执行附件保留策略
+	go runRetention()
+
+	// 执行待删除队列
+	go runOutboxWorker()
+	go runScanWorker()
+	go runThumbnailWorker()
+	go runArchiveIndexer()
+	go runSearchIndexer()
+
 	// 提供浏览页面的服务
 	queryFS := http.FileServer(http.Dir("./html/query"))
 	http.Handle("/query/", http.StripPrefix("/query", queryFS))
@@ -221,11 +619,35 @@ func main() {
 	helloFS := http.FileServer(http.Dir("./html/hello"))
 	http.Handle("/hello/", http.StripPrefix("/hello", helloFS))
 
+	// 本地存储等后端自行提供上传下载服务
+	if storageHandler := osswrapper.Handler(); storageHandler != nil {
+		http.Handle(osswrapper.LocalRoutePrefix, storageHandler)
+	}
+
 	// 设置各接口响应函数
-	http.HandleFunc("/api/queryFeedback", queryFeedback)
+	http.HandleFunc("/api/queryFeedback", requireAdmin(queryFeedback))
 	http.HandleFunc("/api/reportFeedback", reportFeedback)
+	http.HandleFunc("/api/reportFeedbackMultipart", reportFeedbackMultipart)
 	http.HandleFunc("/api/queryUploadSavePath", queryUploadSavePath)
-	http.HandleFunc("/api/deleteFeedback", deleteFeedback)
+	http.HandleFunc("/api/deleteFeedback", requireAdmin(deleteFeedback))
+	http.HandleFunc("/api/initiateUpload", initiateUpload)
+	http.HandleFunc("/api/uploadPart", uploadPart)
+	http.HandleFunc("/api/listUploadParts", listUploadParts)
+	http.HandleFunc("/api/completeUpload", completeUpload)
+	http.HandleFunc("/api/abortUpload", abortUpload)
+	http.HandleFunc("/api/reconcileAttachments", requireAdmin(reconcileAttachmentsHandler))
+	http.HandleFunc("/api/applyRetention", requireAdmin(applyRetentionHandler))
+	http.HandleFunc("/api/usageReport", requireAdmin(usageReport))
+	http.HandleFunc("/api/health", healthHandler)
+	http.HandleFunc("/api/reloadStorage", requireAdmin(reloadStorageHandler))
+	http.HandleFunc("/api/attachment/{fileID}", requireAdmin(redirectAttachment))
+	http.HandleFunc("/api/feedback/{id}/files/{fileID}", requireAdmin(downloadAttachment))
+	http.HandleFunc("/api/feedback/{id}/files/{fileID}/members", requireAdmin(listArchiveMembers))
+	http.HandleFunc("/api/feedback/{id}/files/{fileID}/members/{memberID}", requireAdmin(downloadArchiveMember))
+	http.HandleFunc("/api/feedback/{id}/archive.zip", requireAdmin(downloadFeedbackArchive))
+	http.HandleFunc("/api/feedback/archive.zip", requireAdmin(downloadFeedbacksArchive))
+	http.HandleFunc("/api/searchArchives", requireAdmin(searchArchives))
+	http.HandleFunc("/api/searchFeedback", requireAdmin(searchFeedback))
 
 	logwrapper.Logger.Info("Server is running")
 
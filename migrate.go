@@ -0,0 +1,111 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-14 15:03:27
+ * @LastEditTime: 2024-10-14 18:20:51
+ * @FilePath: \UserFeedBack\migrate.go
+ * @Description: 表结构迁移命令
+ */
+package main
+
+import (
+	"UserFeedBack/dbwrapper"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 迁移命令的用法
+const migrateUsage = `usage: UserFeedBack migrate <command>
+  up            执行所有未执行的迁移
+  down [steps]  回滚最新的若干个迁移，默认为1个
+  status        查看迁移的执行状态
+  to <version>  迁移到指定版本，0表示回滚全部`
+
+/**
+ * @description: 执行迁移命令
+ * @param {[]string} args 命令参数，不含migrate本身
+ * @return {*} 进程退出码
+ */
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	if err := dbwrapper.OpenDB(); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to open database:", err)
+		return 1
+	}
+	defer dbwrapper.CloseDB()
+
+	var (
+		migrations []dbwrapper.Migration
+		err        error
+	)
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		migrations, err = dbwrapper.MigrateUp()
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps <= 0 {
+				fmt.Fprintln(os.Stderr, "invalid steps:", args[1])
+				return 2
+			}
+		}
+		migrations, err = dbwrapper.MigrateDown(steps)
+	case args[0] == "to" && len(args) == 2:
+		version, parseErr := strconv.ParseInt(args[1], 10, 64)
+		if parseErr != nil || version < 0 {
+			fmt.Fprintln(os.Stderr, "invalid version:", args[1])
+			return 2
+		}
+		migrations, err = dbwrapper.MigrateTo(version)
+	case args[0] == "status" && len(args) == 1:
+		return printMigrationStatus()
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	// 出错前已完成的迁移也要输出
+	for _, migration := range migrations {
+		fmt.Printf("%d_%s\n", migration.Version, migration.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migration failed:", err)
+		return 1
+	}
+	if len(migrations) == 0 {
+		fmt.Println("nothing to migrate")
+	}
+
+	return 0
+}
+
+/**
+ * @description: 输出每个迁移的执行状态
+ * @return {*} 进程退出码
+ */
+func printMigrationStatus() int {
+	states, err := dbwrapper.MigrationStatus()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to query migrations:", err)
+		return 1
+	}
+
+	for _, state := range states {
+		status := "pending"
+		if state.Applied {
+			status = "applied " + state.AppliedAt.Format(time.DateTime)
+		}
+		name := state.Name
+		if state.Unknown {
+			name = "(unknown)"
+		}
+		fmt.Printf("%6d  %-32s %s\n", state.Version, name, status)
+	}
+
+	return 0
+}
@@ -0,0 +1,580 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-10 10:30:05
+ * @LastEditTime: 2024-09-10 16:40:18
+ * @FilePath: \UserFeedBack\osswrapper\aliyun.go
+ * @Description: 阿里云oss存储实现
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
+	sts "github.com/alibabacloud-go/sts-20150401/v2/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// sts凭证有效期，单位：秒
+const (
+	defaultStsDuration = 3600
+	minStsDuration     = 900
+)
+
+// 签名下载地址默认有效期，单位：秒
+const defaultOssUrlExpire = 600
+
+// sts客户端中用到的方法，便于替换为测试桩
+type stsAssumer interface {
+	AssumeRoleWithOptions(request *sts.AssumeRoleRequest, runtime *util.RuntimeOptions) (*sts.AssumeRoleResponse, error)
+}
+
+// 阿里云oss存储
+type aliyunStorage struct {
+	// sts客户端
+	stsClient stsAssumer
+	// oss客户端
+	ossClient *oss.Client
+	// 存储桶
+	bucket *oss.Bucket
+	// 创建时的配置，重新加载凭证时随实例一起替换
+	cfg zgconfig.Oss
+}
+
+/**
+ * @description: 生成sts和oss客户端
+ * @param {zgconfig.Oss} cfg oss配置
+ * @return {*}
+ */
+func newAliyunStorage(cfg zgconfig.Oss) (*aliyunStorage, error) {
+	// 生成sts客户端
+	config := &openapi.Config{
+		AccessKeyId:     tea.String(cfg.OssAccessKeyId),
+		AccessKeySecret: tea.String(cfg.OssAccessKeySecret),
+	}
+
+	config.Endpoint = tea.String(cfg.StsEndpoint)
+	stsClient, err := sts.NewClient(config)
+	if err != nil {
+		logger.Logger.Error("error initializing OSS client:", err)
+		return nil, err
+	}
+
+	// 生成oss客户端
+	ossClient, err := oss.New(cfg.OssEndpoint, cfg.AdminOssAccessKeyId, cfg.AdminOssAccessKeySecret)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, err := ossClient.Bucket(cfg.BucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aliyunStorage{
+		stsClient: stsClient,
+		ossClient: ossClient,
+		bucket:    bucket,
+		cfg:       cfg,
+	}, nil
+}
+
+/**
+ * @description: 后端名称
+ * @return {*}
+ */
+func (s *aliyunStorage) Name() string {
+	return BackendOss
+}
+
+/**
+ * @description: 通过sts AssumeRole签发临时上传凭证，凭证仅能写入指定的对象路径
+ * @param {[]string} objectKeys 允许上传的对象路径
+ * @return {*}
+ */
+func (s *aliyunStorage) IssueUploadCredential(objectKeys []string) (*UploadCredential, error) {
+	// 生成只允许写入本次路径的会话策略
+	policy, err := buildSessionPolicy(s.cfg.BucketName, objectKeys)
+	if err != nil {
+		logger.Logger.Error("error marshalling policy:", err)
+		return nil, err
+	}
+
+	// AssumeRole请求
+	assumeRoleRequest := &sts.AssumeRoleRequest{
+		RoleArn:         tea.String(s.cfg.FeedbackRole),
+		RoleSessionName: tea.String(s.cfg.RoleSessionName),
+		DurationSeconds: tea.Int64(stsDurationSeconds(zgconfig.Cfg.Upload.TokenDurationSeconds)),
+		Policy:          tea.String(policy),
+	}
+
+	// 解析请求结果
+	stsResult, err := s.stsClient.AssumeRoleWithOptions(assumeRoleRequest, &util.RuntimeOptions{})
+	if err != nil {
+		logger.Logger.Error("error generating signed URL:", err)
+		return nil, err
+	}
+
+	credentials := stsResult.Body.Credentials
+	result := &UploadCredential{
+		AccessKeyId:     tea.StringValue(credentials.AccessKeyId),
+		AccessKeySecret: tea.StringValue(credentials.AccessKeySecret),
+		Expiration:      tea.StringValue(credentials.Expiration),
+		SecurityToken:   tea.StringValue(credentials.SecurityToken),
+	}
+
+	// 配置了类型或大小限制时，额外签发PostObject表单，由oss校验上传内容。
+	// 表单同样以sts凭证签名，会话策略必须允许oss:PutObject，持有凭证仍可直接PUT任意内容，
+	// 因此限制以提交反馈时按实际对象做的校验为准，表单只是让正常客户端尽早失败
+	if len(zgconfig.Cfg.Upload.AllowedContentTypes) > 0 || zgconfig.Cfg.Upload.MaxFileSize > 0 {
+		result.UploadForms = make(map[string]map[string]string, len(objectKeys))
+		for _, objectKey := range objectKeys {
+			form, err := buildPostObjectForm(result, s.cfg.BucketName, objectKey, zgconfig.Cfg.Upload)
+			if err != nil {
+				return nil, err
+			}
+			result.UploadForms[objectKey] = form
+		}
+	}
+
+	return result, nil
+}
+
+// 会话策略中的语句
+type policyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// 会话策略
+type sessionPolicy struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+/**
+ * @description: 生成只允许向指定对象写入的sts会话策略
+ * @param {string} bucketName 存储桶
+ * @param {[]string} objectKeys 允许上传的对象路径
+ * @return {*} json格式的策略
+ */
+func buildSessionPolicy(bucketName string, objectKeys []string) (string, error) {
+	if len(objectKeys) == 0 {
+		return "", errors.New("empty object keys provided")
+	}
+
+	// 生成resouce字段对应的路径
+	resourcePaths := make([]string, 0, len(objectKeys))
+	for _, objectKey := range objectKeys {
+		resourcePaths = append(resourcePaths, fmt.Sprintf("acs:oss:*:*:%s/%s", bucketName, objectKey))
+	}
+
+	policy := sessionPolicy{
+		Version: "1",
+		Statement: []policyStatement{
+			{
+				Effect:   "Allow",
+				Action:   []string{"oss:PutObject"},
+				Resource: resourcePaths,
+			},
+		},
+	}
+
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+
+	return string(policyBytes), nil
+}
+
+/**
+ * @description: 修正sts凭证有效期到允许的范围内
+ * @param {int64} seconds 配置的有效期
+ * @return {*}
+ */
+func stsDurationSeconds(seconds int64) int64 {
+	switch {
+	case seconds <= 0:
+		return defaultStsDuration
+	case seconds < minStsDuration:
+		return minStsDuration
+	default:
+		return seconds
+	}
+}
+
+/**
+ * @description: 生成PostObject上传表单，policy中限制对象路径、大小和内容类型
+ * @param {*UploadCredential} credential sts临时凭证
+ * @param {string} bucketName 存储桶
+ * @param {string} objectKey 对象路径
+ * @param {zgconfig.Upload} limit 上传限制
+ * @return {*} 表单字段
+ */
+func buildPostObjectForm(credential *UploadCredential, bucketName string, objectKey string, limit zgconfig.Upload) (map[string]string, error) {
+	expiration, err := time.Parse(time.RFC3339, credential.Expiration)
+	if err != nil {
+		expiration = time.Now().Add(time.Duration(stsDurationSeconds(limit.TokenDurationSeconds)) * time.Second)
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": bucketName},
+		[]interface{}{"eq", "$key", objectKey},
+	}
+	if limit.MaxFileSize > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", 0, limit.MaxFileSize})
+	}
+	if len(limit.AllowedContentTypes) > 0 {
+		conditions = append(conditions, []interface{}{"in", "$content-type", limit.AllowedContentTypes})
+	}
+
+	policyBytes, err := json.Marshal(map[string]interface{}{
+		"expiration": expiration.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	policy := base64.StdEncoding.EncodeToString(policyBytes)
+	mac := hmac.New(sha1.New, []byte(credential.AccessKeySecret))
+	mac.Write([]byte(policy))
+
+	return map[string]string{
+		"key":                   objectKey,
+		"policy":                policy,
+		"OSSAccessKeyId":        credential.AccessKeyId,
+		"Signature":             base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		"x-oss-security-token":  credential.SecurityToken,
+		"success_action_status": "200",
+	}, nil
+}
+
+/**
+ * @description: 查询对象元信息
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *aliyunStorage) Stat(objectKey string) (*ObjectInfo, error) {
+	header, err := s.bucket.GetObjectDetailedMeta(objectKey)
+	if err != nil {
+		if isOssNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	lastModified, _ := http.ParseTime(header.Get("Last-Modified"))
+
+	return &ObjectInfo{
+		Key:          objectKey,
+		Size:         size,
+		ETag:         strings.Trim(header.Get("ETag"), "\""),
+		ContentType:  header.Get("Content-Type"),
+		LastModified: lastModified,
+	}, nil
+}
+
+/**
+ * @description: 由服务端直接写入对象
+ * @param {string} objectKey 对象路径
+ * @param {io.Reader} reader 对象内容
+ * @param {int64} size 对象大小，未知时为-1
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func (s *aliyunStorage) Put(objectKey string, reader io.Reader, size int64, contentType string) error {
+	options := []oss.Option{oss.ContentType(contentType)}
+	if size >= 0 {
+		options = append(options, oss.ContentLength(size))
+	}
+
+	return s.bucket.PutObject(objectKey, reader, options...)
+}
+
+/**
+ * @description: 在存储桶内复制对象
+ * @param {string} srcKey 源对象路径
+ * @param {string} dstKey 目标对象路径
+ * @return {*}
+ */
+func (s *aliyunStorage) Copy(srcKey string, dstKey string) error {
+	_, err := s.bucket.CopyObject(srcKey, dstKey)
+	if isOssNotFound(err) {
+		return ErrObjectNotFound
+	}
+
+	return err
+}
+
+/**
+ * @description: 读取对象内容
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *aliyunStorage) Open(objectKey string) (io.ReadCloser, error) {
+	reader, err := s.bucket.GetObject(objectKey)
+	if err != nil {
+		if isOssNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+/**
+ * @description: 读取对象的指定区间
+ * @param {string} objectKey 对象路径
+ * @param {int64} offset 起始位置
+ * @param {int64} length 读取长度
+ * @return {*}
+ */
+func (s *aliyunStorage) OpenRange(objectKey string, offset int64, length int64) (io.ReadCloser, error) {
+	reader, err := s.bucket.GetObject(objectKey, oss.Range(offset, offset+length-1))
+	if err != nil {
+		if isOssNotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+/**
+ * @description: 删除对象
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *aliyunStorage) Delete(objectKey string) error {
+	return s.bucket.DeleteObject(objectKey)
+}
+
+/**
+ * @description: 通过DeleteMultipleObjects批量删除对象
+ * @param {[]string} objectKeys 对象路径
+ * @return {*} 删除失败的对象及原因
+ */
+func (s *aliyunStorage) DeleteObjects(objectKeys []string) (map[string]error, error) {
+	result, err := s.bucket.DeleteObjects(objectKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// 非quiet模式下返回成功删除的对象，未出现在结果中的即为失败
+	deleted := make(map[string]bool, len(result.DeletedObjects))
+	for _, objectKey := range result.DeletedObjects {
+		deleted[objectKey] = true
+	}
+
+	failed := make(map[string]error)
+	for _, objectKey := range objectKeys {
+		if !deleted[objectKey] {
+			failed[objectKey] = errors.New("not reported as deleted")
+		}
+	}
+
+	return failed, nil
+}
+
+/**
+ * @description: 分页遍历前缀下的所有对象
+ * @param {string} prefix 对象路径前缀
+ * @param {func(info *ObjectInfo) error} fn 处理函数
+ * @return {*}
+ */
+func (s *aliyunStorage) List(prefix string, fn func(info *ObjectInfo) error) error {
+	token := ""
+	for {
+		options := []oss.Option{oss.Prefix(prefix), oss.MaxKeys(1000)}
+		if token != "" {
+			options = append(options, oss.ContinuationToken(token))
+		}
+
+		result, err := s.bucket.ListObjectsV2(options...)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range result.Objects {
+			err = fn(&ObjectInfo{
+				Key:          object.Key,
+				Size:         object.Size,
+				ETag:         strings.Trim(object.ETag, "\""),
+				LastModified: object.LastModified,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+/**
+ * @description: 对象的签名下载地址，存储桶无需公共读
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *aliyunStorage) URL(objectKey string) (string, error) {
+	expire := s.cfg.UrlExpireSeconds
+	if expire <= 0 {
+		expire = defaultOssUrlExpire
+	}
+
+	return s.bucket.SignURL(objectKey, oss.HTTPGet, expire)
+}
+
+/**
+ * @description: 初始化分片上传
+ * @param {string} objectKey 对象路径
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func (s *aliyunStorage) InitiateMultipart(objectKey string, contentType string) (string, error) {
+	imur, err := s.bucket.InitiateMultipartUpload(objectKey, oss.ContentType(contentType))
+	if err != nil {
+		return "", err
+	}
+
+	return imur.UploadID, nil
+}
+
+/**
+ * @description: 上传单个分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @param {int} partNumber 分片号
+ * @param {io.Reader} reader 分片内容
+ * @param {int64} size 分片大小
+ * @return {*}
+ */
+func (s *aliyunStorage) UploadPart(objectKey string, uploadID string, partNumber int, reader io.Reader, size int64) (*PartInfo, error) {
+	part, err := s.bucket.UploadPart(s.multipartResult(objectKey, uploadID), reader, size, partNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PartInfo{
+		PartNumber:   part.PartNumber,
+		ETag:         part.ETag,
+		Size:         size,
+		LastModified: time.Now(),
+	}, nil
+}
+
+/**
+ * @description: 列出已上传的分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *aliyunStorage) ListParts(objectKey string, uploadID string) ([]PartInfo, error) {
+	imur := s.multipartResult(objectKey, uploadID)
+
+	parts := []PartInfo{}
+	marker := 0
+	for {
+		result, err := s.bucket.ListUploadedParts(imur, oss.PartNumberMarker(marker))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range result.UploadedParts {
+			parts = append(parts, PartInfo{
+				PartNumber:   part.PartNumber,
+				ETag:         part.ETag,
+				Size:         int64(part.Size),
+				LastModified: part.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		if marker, err = strconv.Atoi(result.NextPartNumberMarker); err != nil {
+			return nil, err
+		}
+	}
+
+	sortParts(parts)
+	return parts, nil
+}
+
+/**
+ * @description: 合并分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @param {[]PartInfo} parts 参与合并的分片
+ * @return {*}
+ */
+func (s *aliyunStorage) CompleteMultipart(objectKey string, uploadID string, parts []PartInfo) error {
+	uploadParts := make([]oss.UploadPart, 0, len(parts))
+	for _, part := range parts {
+		uploadParts = append(uploadParts, oss.UploadPart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	_, err := s.bucket.CompleteMultipartUpload(s.multipartResult(objectKey, uploadID), uploadParts)
+	return err
+}
+
+/**
+ * @description: 放弃分片上传
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *aliyunStorage) AbortMultipart(objectKey string, uploadID string) error {
+	return s.bucket.AbortMultipartUpload(s.multipartResult(objectKey, uploadID))
+}
+
+/**
+ * @description: 构造sdk所需的分片上传标识
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *aliyunStorage) multipartResult(objectKey string, uploadID string) oss.InitiateMultipartUploadResult {
+	return oss.InitiateMultipartUploadResult{
+		Bucket:   s.bucket.BucketName,
+		Key:      objectKey,
+		UploadID: uploadID,
+	}
+}
+
+/**
+ * @description: 判断oss返回的错误是否为对象不存在
+ * @param {error} err
+ * @return {*}
+ */
+func isOssNotFound(err error) bool {
+	var serviceErr oss.ServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.StatusCode == http.StatusNotFound
+	}
+
+	return false
+}
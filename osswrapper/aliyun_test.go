@@ -0,0 +1,150 @@
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"encoding/base64"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	sts "github.com/alibabacloud-go/sts-20150401/v2/client"
+	util "github.com/alibabacloud-go/tea-utils/v2/service"
+	"github.com/alibabacloud-go/tea/tea"
+	"github.com/sirupsen/logrus"
+)
+
+// 记录AssumeRole请求的sts桩
+type fakeStsAssumer struct {
+	requests []*sts.AssumeRoleRequest
+}
+
+func (f *fakeStsAssumer) AssumeRoleWithOptions(request *sts.AssumeRoleRequest, runtime *util.RuntimeOptions) (*sts.AssumeRoleResponse, error) {
+	f.requests = append(f.requests, request)
+
+	return &sts.AssumeRoleResponse{
+		Body: &sts.AssumeRoleResponseBody{
+			Credentials: &sts.AssumeRoleResponseBodyCredentials{
+				AccessKeyId:     tea.String("STS.test"),
+				AccessKeySecret: tea.String("secret"),
+				Expiration:      tea.String("2030-01-01T00:00:00Z"),
+				SecurityToken:   tea.String("token"),
+			},
+		},
+	}, nil
+}
+
+/**
+ * @description: 创建使用sts桩的阿里云存储
+ * @param {*testing.T} t
+ * @return {*}
+ */
+func newTestAliyunStorage(t *testing.T) (*aliyunStorage, *fakeStsAssumer) {
+	t.Helper()
+
+	logger.Logger = logrus.New()
+	zgconfig.Cfg = &zgconfig.Config{}
+
+	assumer := &fakeStsAssumer{}
+	return &aliyunStorage{
+		stsClient: assumer,
+		cfg: zgconfig.Oss{
+			BucketName:      "feedback-bucket",
+			FeedbackRole:    "acs:ram::123:role/feedback",
+			RoleSessionName: "feedback",
+		},
+	}, assumer
+}
+
+func TestAliyunSessionPolicyMatchesRequestedFiles(t *testing.T) {
+	storage, assumer := newTestAliyunStorage(t)
+
+	objectKeys := []string{"feedback/r1/f1/log.txt", "feedback/r1/f2/shot.png", "blob/ab/abcdef"}
+	credential, err := storage.IssueUploadCredential(objectKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.SecurityToken != "token" || credential.AccessKeyId != "STS.test" {
+		t.Errorf("unexpected credential: %+v", credential)
+	}
+
+	if len(assumer.requests) != 1 {
+		t.Fatalf("AssumeRole called %d times, want 1", len(assumer.requests))
+	}
+	request := assumer.requests[0]
+	if tea.StringValue(request.RoleArn) != "acs:ram::123:role/feedback" {
+		t.Errorf("role arn = %q", tea.StringValue(request.RoleArn))
+	}
+	if tea.Int64Value(request.DurationSeconds) != defaultStsDuration {
+		t.Errorf("duration = %d, want %d", tea.Int64Value(request.DurationSeconds), defaultStsDuration)
+	}
+
+	var policy sessionPolicy
+	if err = json.Unmarshal([]byte(tea.StringValue(request.Policy)), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Statement) != 1 {
+		t.Fatalf("policy has %d statements, want 1", len(policy.Statement))
+	}
+
+	statement := policy.Statement[0]
+	if statement.Effect != "Allow" || !slices.Equal(statement.Action, []string{"oss:PutObject"}) {
+		t.Errorf("unexpected statement: %+v", statement)
+	}
+	want := []string{
+		"acs:oss:*:*:feedback-bucket/feedback/r1/f1/log.txt",
+		"acs:oss:*:*:feedback-bucket/feedback/r1/f2/shot.png",
+		"acs:oss:*:*:feedback-bucket/blob/ab/abcdef",
+	}
+	if !slices.Equal(statement.Resource, want) {
+		t.Errorf("policy resources = %v, want %v", statement.Resource, want)
+	}
+
+	// 未配置限制时不签发表单
+	if credential.UploadForms != nil {
+		t.Errorf("unexpected upload forms: %v", credential.UploadForms)
+	}
+}
+
+func TestAliyunSessionPolicyRejectsEmptyKeys(t *testing.T) {
+	storage, assumer := newTestAliyunStorage(t)
+
+	if _, err := storage.IssueUploadCredential(nil); err == nil {
+		t.Error("expected an error for empty object keys")
+	}
+	if len(assumer.requests) != 0 {
+		t.Errorf("AssumeRole called %d times, want 0", len(assumer.requests))
+	}
+}
+
+func TestAliyunPostObjectFormLimits(t *testing.T) {
+	storage, _ := newTestAliyunStorage(t)
+	zgconfig.Cfg.Upload.MaxFileSize = 1 << 20
+	zgconfig.Cfg.Upload.AllowedContentTypes = []string{"text/plain", "image/png"}
+
+	credential, err := storage.IssueUploadCredential([]string{"feedback/r1/f1/log.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := credential.UploadForms["feedback/r1/f1/log.txt"]
+	if form["key"] != "feedback/r1/f1/log.txt" || form["x-oss-security-token"] != "token" || form["Signature"] == "" {
+		t.Fatalf("unexpected form: %v", form)
+	}
+
+	policyBytes, err := base64.StdEncoding.DecodeString(form["policy"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := strings.ReplaceAll(string(policyBytes), " ", "")
+	for _, want := range []string{
+		`["eq","$key","feedback/r1/f1/log.txt"]`,
+		`["content-length-range",0,1048576]`,
+		`["in","$content-type",["text/plain","image/png"]]`,
+	} {
+		if !strings.Contains(policy, want) {
+			t.Errorf("policy %s does not contain %s", policy, want)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-30 09:41:25
+ * @LastEditTime: 2024-09-30 17:26:48
+ * @FilePath: \UserFeedBack\osswrapper\archive.go
+ * @Description: 读取存储上的zip、tar.gz压缩包
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+const (
+	// 随机读取时每次从存储读取的块大小
+	archiveBlockSize = 1 << 20
+	// 随机读取时缓存的块数
+	archiveCachedBlocks = 8
+)
+
+// 压缩包格式
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+// 压缩包中不存在该文件
+var ErrArchiveMemberNotFound = errors.New("archive member not found")
+
+// 压缩包中的文件
+type ArchiveEntry struct {
+	Path       string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+/**
+ * @description: 判断附件是否为需要建立索引的压缩包
+ * @param {string} fileName 文件名
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func IsArchiveCandidate(fileName string, contentType string) bool {
+	if zgconfig.Cfg.Archive.Disabled {
+		return false
+	}
+
+	if archiveFormat(fileName) != "" {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/zip" || mediaType == "application/x-zip-compressed"
+}
+
+/**
+ * @description: 按文件名识别压缩包格式，无法识别时为空
+ * @param {string} fileName 文件名
+ * @return {*}
+ */
+func archiveFormat(fileName string) string {
+	lower := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	}
+
+	return ""
+}
+
+/**
+ * @description: 依次遍历压缩包中的文件，zip按需分块读取，tar流式读取
+ * @param {string} objectKey 对象路径
+ * @param {string} fileName 文件名，用于识别格式
+ * @param {int64} size 对象大小
+ * @param {func(entry *ArchiveEntry, reader io.Reader) error} fn 处理函数，文件无法解压时reader为nil，返回错误时停止遍历
+ * @return {*}
+ */
+func WalkArchive(objectKey string, fileName string, size int64, fn func(entry *ArchiveEntry, reader io.Reader) error) error {
+	format := archiveFormat(fileName)
+	if format == "" {
+		format = archiveZip
+	}
+
+	if format == archiveZip {
+		archive, err := zip.NewReader(newObjectReaderAt(objectKey, size), size)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range archive.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+
+			entry := &ArchiveEntry{Path: file.Name, Size: int64(file.UncompressedSize64), ModifiedAt: file.Modified}
+			reader, err := file.Open()
+			if err != nil {
+				// 加密或不支持的压缩方式，只记录文件信息
+				err = fn(entry, nil)
+			} else {
+				err = fn(entry, reader)
+				reader.Close()
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	reader, err := openTar(objectKey, format)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err = fn(&ArchiveEntry{Path: header.Name, Size: header.Size, ModifiedAt: header.ModTime}, reader); err != nil {
+			return err
+		}
+	}
+}
+
+/**
+ * @description: 打开压缩包中的单个文件，zip只读取该文件所在的区间，tar需要从头读取到该文件
+ * @param {string} objectKey 对象路径
+ * @param {string} fileName 文件名，用于识别格式
+ * @param {int64} size 对象大小
+ * @param {string} memberPath 压缩包中的文件路径
+ * @return {*} 文件内容和解压后的大小
+ */
+func OpenArchiveMember(objectKey string, fileName string, size int64, memberPath string) (io.ReadCloser, int64, error) {
+	format := archiveFormat(fileName)
+	if format == "" {
+		format = archiveZip
+	}
+
+	if format == archiveZip {
+		archive, err := zip.NewReader(newObjectReaderAt(objectKey, size), size)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, file := range archive.File {
+			if file.Name != memberPath || file.FileInfo().IsDir() {
+				continue
+			}
+
+			reader, err := file.Open()
+			if err != nil {
+				return nil, 0, err
+			}
+			return reader, int64(file.UncompressedSize64), nil
+		}
+
+		return nil, 0, ErrArchiveMemberNotFound
+	}
+
+	reader, err := openTar(objectKey, format)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			reader.Close()
+			return nil, 0, ErrArchiveMemberNotFound
+		}
+		if err != nil {
+			reader.Close()
+			return nil, 0, err
+		}
+
+		if header.Typeflag == tar.TypeReg && header.Name == memberPath {
+			return reader, header.Size, nil
+		}
+	}
+}
+
+// 流式读取的tar包
+type tarReader struct {
+	*tar.Reader
+	object io.Closer
+}
+
+/**
+ * @description: 关闭底层的对象
+ * @return {*}
+ */
+func (r *tarReader) Close() error {
+	return r.object.Close()
+}
+
+/**
+ * @description: 从存储流式打开tar或tar.gz
+ * @param {string} objectKey 对象路径
+ * @param {string} format 压缩包格式
+ * @return {*}
+ */
+func openTar(objectKey string, format string) (*tarReader, error) {
+	object, err := Current().Open(objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader = object
+	if format == archiveTarGz {
+		gzipReader, err := gzip.NewReader(object)
+		if err != nil {
+			object.Close()
+			return nil, err
+		}
+		reader = gzipReader
+	}
+
+	return &tarReader{Reader: tar.NewReader(reader), object: object}, nil
+}
+
+// 按块读取并缓存的对象，供zip随机读取，不是并发安全的
+type objectReaderAt struct {
+	objectKey string
+	size      int64
+	blocks    map[int64][]byte
+	order     []int64
+}
+
+/**
+ * @description: 创建按块读取的对象
+ * @param {string} objectKey 对象路径
+ * @param {int64} size 对象大小
+ * @return {*}
+ */
+func newObjectReaderAt(objectKey string, size int64) *objectReaderAt {
+	return &objectReaderAt{
+		objectKey: objectKey,
+		size:      size,
+		blocks:    make(map[int64][]byte),
+	}
+}
+
+/**
+ * @description: 实现io.ReaderAt接口
+ * @param {[]byte} p
+ * @param {int64} off 起始位置
+ * @return {*}
+ */
+func (r *objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	n := 0
+	for n < len(p) && off+int64(n) < r.size {
+		position := off + int64(n)
+		index := position / archiveBlockSize
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[position-index*archiveBlockSize:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+/**
+ * @description: 读取第index块，超出缓存数量时淘汰最早读取的块
+ * @param {int64} index 块序号
+ * @return {*}
+ */
+func (r *objectReaderAt) block(index int64) ([]byte, error) {
+	if block, ok := r.blocks[index]; ok {
+		return block, nil
+	}
+
+	offset := index * archiveBlockSize
+	reader, err := Current().OpenRange(r.objectKey, offset, min(archiveBlockSize, r.size-offset))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	block, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(block) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if len(r.order) >= archiveCachedBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[index] = block
+	r.order = append(r.order, index)
+
+	return block, nil
+}
@@ -0,0 +1,164 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-20 10:08:51
+ * @LastEditTime: 2024-09-20 15:12:36
+ * @FilePath: \UserFeedBack\osswrapper\delete.go
+ * @Description: 批量删除
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 默认同时进行的删除请求数
+const defaultDeleteConcurrency = 4
+
+// 批量删除的汇总结果
+type DeleteResult struct {
+	Deleted []string          `json:"deleted"`
+	Failed  map[string]string `json:"failed"` // 对象路径->失败原因
+}
+
+/**
+ * @description: 删除失败的对象路径，按路径排序，便于调用方只重试这部分
+ * @return {*}
+ */
+func (r *DeleteResult) FailedKeys() []string {
+	keys := make([]string, 0, len(r.Failed))
+	for key := range r.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+/**
+ * @description: 汇总所有失败对象为一个错误，全部成功时返回nil
+ * @return {*}
+ */
+func (r *DeleteResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+
+	errs := make([]error, 0, len(r.Failed))
+	for _, key := range r.FailedKeys() {
+		errs = append(errs, fmt.Errorf("%s: %s", key, r.Failed[key]))
+	}
+
+	return errors.Join(errs...)
+}
+
+/**
+ * @description: 批量删除对象，按每批最多1000个分组并发执行，单个对象失败不影响其余对象
+ * @param {[]string} objectKeys 对象路径
+ * @return {*}
+ */
+func DeleteObjects(objectKeys []string) *DeleteResult {
+	result := &DeleteResult{
+		Deleted: []string{},
+		Failed:  make(map[string]string),
+	}
+
+	// 去重
+	seen := make(map[string]bool, len(objectKeys))
+	uniqueKeys := make([]string, 0, len(objectKeys))
+	for _, objectKey := range objectKeys {
+		if !seen[objectKey] {
+			seen[objectKey] = true
+			uniqueKeys = append(uniqueKeys, objectKey)
+		}
+	}
+
+	// 支持批量删除的后端每批最多1000个，否则逐个删除
+	batchSize := 1
+	deleter, isBatch := Current().(BatchDeleter)
+	if isBatch {
+		batchSize = maxDeleteBatch
+	}
+
+	var batches [][]string
+	for start := 0; start < len(uniqueKeys); start += batchSize {
+		end := min(start+batchSize, len(uniqueKeys))
+		batches = append(batches, uniqueKeys[start:end])
+	}
+
+	concurrency := zgconfig.Cfg.Storage.DeleteConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultDeleteConcurrency
+	}
+
+	var (
+		mutex     sync.Mutex
+		waitGroup sync.WaitGroup
+		batchCh   = make(chan []string)
+	)
+
+	for i := 0; i < min(concurrency, len(batches)); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for batch := range batchCh {
+				failed := deleteBatch(deleter, isBatch, batch)
+
+				mutex.Lock()
+				for _, objectKey := range batch {
+					if err, ok := failed[objectKey]; ok {
+						result.Failed[objectKey] = err.Error()
+					} else {
+						result.Deleted = append(result.Deleted, objectKey)
+					}
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for _, batch := range batches {
+		batchCh <- batch
+	}
+	close(batchCh)
+	waitGroup.Wait()
+
+	if len(result.Failed) > 0 {
+		logger.Logger.Errorf("failed to delete %d of %d objects", len(result.Failed), len(uniqueKeys))
+	}
+
+	return result
+}
+
+/**
+ * @description: 删除一批对象，整批请求失败时该批所有对象都视为失败
+ * @param {BatchDeleter} deleter 批量删除接口
+ * @param {bool} isBatch 是否支持批量删除
+ * @param {[]string} batch 本批对象路径
+ * @return {*} 删除失败的对象及原因
+ */
+func deleteBatch(deleter BatchDeleter, isBatch bool, batch []string) map[string]error {
+	if !isBatch {
+		failed := make(map[string]error)
+		for _, objectKey := range batch {
+			if err := Current().Delete(objectKey); err != nil {
+				failed[objectKey] = err
+			}
+		}
+		return failed
+	}
+
+	failed, err := deleter.DeleteObjects(batch)
+	if err != nil {
+		failed = make(map[string]error, len(batch))
+		for _, objectKey := range batch {
+			failed[objectKey] = err
+		}
+	}
+
+	return failed
+}
@@ -0,0 +1,104 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-10 10:18:42
+ * @LastEditTime: 2024-10-10 16:47:05
+ * @FilePath: \UserFeedBack\osswrapper\health.go
+ * @Description: 存储后端自检
+ */
+package osswrapper
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 自检的能力
+const (
+	CheckCredential = "credential"
+	CheckPut        = "put"
+	CheckHead       = "head"
+	CheckDelete     = "delete"
+)
+
+// 自检探测对象的内容
+const canaryContent = "feedback storage health check"
+
+// 存储后端自检未通过
+var ErrUnhealthy = errors.New("storage health check failed")
+
+// 单项能力的自检结果
+type CapabilityCheck struct {
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// 存储后端的自检结果
+type HealthReport struct {
+	Backend   string            `json:"backend"`
+	Healthy   bool              `json:"healthy"`
+	CheckedAt time.Time         `json:"checkedAt"`
+	Checks    []CapabilityCheck `json:"checks"`
+}
+
+/**
+ * @description: 在附件目录下的探测对象上依次检查签发上传凭证、写入、查询和删除
+ * @param {Storage} backend 存储后端
+ * @return {*}
+ */
+func CheckHealth(backend Storage) *HealthReport {
+	report := &HealthReport{Backend: backend.Name(), Healthy: true, CheckedAt: time.Now()}
+
+	check := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+
+		result := CapabilityCheck{Name: name, Healthy: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, result)
+
+		return err == nil
+	}
+
+	id, err := NewUploadID()
+	if err != nil {
+		check(CheckCredential, func() error { return err })
+		return report
+	}
+	// 与附件使用相同的目录，sts会话策略等按目录授权的配置也能被检查到
+	canaryKey := FeedbackPrefix() + ".healthcheck/" + id
+
+	check(CheckCredential, func() error {
+		_, err := backend.IssueUploadCredential([]string{canaryKey})
+		return err
+	})
+
+	if !check(CheckPut, func() error {
+		return backend.Put(canaryKey, strings.NewReader(canaryContent), int64(len(canaryContent)), "text/plain")
+	}) {
+		return report
+	}
+
+	check(CheckHead, func() error {
+		info, err := backend.Stat(canaryKey)
+		if err != nil {
+			return err
+		}
+		if info.Size != int64(len(canaryContent)) {
+			return fmt.Errorf("unexpected size %d", info.Size)
+		}
+		return nil
+	})
+
+	check(CheckDelete, func() error {
+		return backend.Delete(canaryKey)
+	})
+
+	return report
+}
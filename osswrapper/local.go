@@ -0,0 +1,704 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-10 11:18:44
+ * @LastEditTime: 2024-09-10 16:40:18
+ * @FilePath: \UserFeedBack\osswrapper\local.go
+ * @Description: 本地磁盘存储实现
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 本地存储对外提供上传下载服务的路由前缀
+const LocalRoutePrefix = "/storage/"
+
+// 签名地址默认有效期
+const defaultLocalUrlExpire = 3600
+
+// 分片上传暂存目录，位于根目录下
+const localMultipartDir = ".multipart"
+
+// 本地磁盘存储，同时负责处理签名地址上的上传和下载请求
+type localStorage struct {
+	rootDir   string
+	publicUrl string
+	secret    []byte
+	expire    time.Duration
+}
+
+/**
+ * @description: 创建本地磁盘存储
+ * @param {zgconfig.Local} cfg 本地存储配置
+ * @return {*}
+ */
+func newLocalStorage(cfg zgconfig.Local) (*localStorage, error) {
+	if cfg.RootDir == "" {
+		return nil, errors.New("local storage root dir not configured")
+	}
+
+	rootDir, err := filepath.Abs(cfg.RootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// 未配置密钥时随机生成，重启后之前签发的地址失效
+	secret := []byte(cfg.SignSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+		logger.Logger.Warn("local storage sign secret not configured, using a random one")
+	}
+
+	expire := cfg.UrlExpireSeconds
+	if expire <= 0 {
+		expire = defaultLocalUrlExpire
+	}
+
+	return &localStorage{
+		rootDir:   rootDir,
+		publicUrl: strings.TrimSuffix(cfg.PublicUrl, "/"),
+		secret:    secret,
+		expire:    time.Duration(expire) * time.Second,
+	}, nil
+}
+
+/**
+ * @description: 后端名称
+ * @return {*}
+ */
+func (s *localStorage) Name() string {
+	return BackendLocal
+}
+
+/**
+ * @description: 为每个对象生成带签名的PUT上传地址
+ * @param {[]string} objectKeys 允许上传的对象路径
+ * @return {*}
+ */
+func (s *localStorage) IssueUploadCredential(objectKeys []string) (*UploadCredential, error) {
+	expire := s.expire
+	if zgconfig.Cfg.Upload.TokenDurationSeconds > 0 {
+		expire = time.Duration(zgconfig.Cfg.Upload.TokenDurationSeconds) * time.Second
+	}
+	expiration := time.Now().Add(expire)
+
+	result := &UploadCredential{
+		Expiration: expiration.UTC().Format(time.RFC3339),
+		UploadUrls: make(map[string]string, len(objectKeys)),
+	}
+
+	for _, objectKey := range objectKeys {
+		if _, err := s.resolve(objectKey); err != nil {
+			return nil, err
+		}
+		result.UploadUrls[objectKey] = s.signedURL(http.MethodPut, objectKey, expiration)
+	}
+
+	return result, nil
+}
+
+/**
+ * @description: 查询对象元信息
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *localStorage) Stat(objectKey string) (*ObjectInfo, error) {
+	fullPath, err := s.resolve(objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	if fileInfo.IsDir() {
+		return nil, ErrObjectNotFound
+	}
+
+	return &ObjectInfo{
+		Key:          objectKey,
+		Size:         fileInfo.Size(),
+		ETag:         fmt.Sprintf("%x-%x", fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+		ContentType:  contentTypeByName(objectKey),
+		LastModified: fileInfo.ModTime(),
+	}, nil
+}
+
+/**
+ * @description: 由服务端直接写入对象
+ * @param {string} objectKey 对象路径
+ * @param {io.Reader} reader 对象内容
+ * @param {int64} size 对象大小，本地存储不需要
+ * @param {string} contentType 内容类型，本地存储按扩展名推断
+ * @return {*}
+ */
+func (s *localStorage) Put(objectKey string, reader io.Reader, size int64, contentType string) error {
+	fullPath, err := s.resolve(objectKey)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(fullPath, reader)
+}
+
+/**
+ * @description: 复制本地文件
+ * @param {string} srcKey 源对象路径
+ * @param {string} dstKey 目标对象路径
+ * @return {*}
+ */
+func (s *localStorage) Copy(srcKey string, dstKey string) error {
+	reader, err := s.Open(srcKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	dstPath, err := s.resolve(dstKey)
+	if err != nil {
+		return err
+	}
+
+	return s.writeFile(dstPath, reader)
+}
+
+/**
+ * @description: 读取对象内容
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *localStorage) Open(objectKey string) (io.ReadCloser, error) {
+	fullPath, err := s.resolve(objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return file, nil
+}
+
+/**
+ * @description: 读取对象的指定区间
+ * @param {string} objectKey 对象路径
+ * @param {int64} offset 起始位置
+ * @param {int64} length 读取长度
+ * @return {*}
+ */
+func (s *localStorage) OpenRange(objectKey string, offset int64, length int64) (io.ReadCloser, error) {
+	reader, err := s.Open(objectKey)
+	if err != nil {
+		return nil, err
+	}
+
+	file := reader.(*os.File)
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+/**
+ * @description: 删除对象
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *localStorage) Delete(objectKey string) error {
+	fullPath, err := s.resolve(objectKey)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * @description: 遍历前缀下的所有文件，跳过写入中的临时文件
+ * @param {string} prefix 对象路径前缀
+ * @param {func(info *ObjectInfo) error} fn 处理函数
+ * @return {*}
+ */
+func (s *localStorage) List(prefix string, fn func(info *ObjectInfo) error) error {
+	// 从前缀所在的目录开始遍历
+	startDir := s.rootDir
+	if dir := path.Dir(prefix); dir != "." && dir != "/" {
+		resolved, err := s.resolve(dir)
+		if err != nil {
+			return err
+		}
+		startDir = resolved
+	}
+
+	err := filepath.WalkDir(startDir, func(fullPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// 跳过分片暂存目录和临时文件
+		if entry.IsDir() {
+			if entry.Name() == localMultipartDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(s.rootDir, fullPath)
+		if err != nil {
+			return err
+		}
+		objectKey := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(objectKey, prefix) {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(&ObjectInfo{
+			Key:          objectKey,
+			Size:         fileInfo.Size(),
+			ETag:         fmt.Sprintf("%x-%x", fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+			ContentType:  contentTypeByName(objectKey),
+			LastModified: fileInfo.ModTime(),
+		})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+/**
+ * @description: 对象的签名下载地址
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *localStorage) URL(objectKey string) (string, error) {
+	if _, err := s.resolve(objectKey); err != nil {
+		return "", err
+	}
+
+	return s.signedURL(http.MethodGet, objectKey, time.Now().Add(s.expire)), nil
+}
+
+/**
+ * @description: 初始化分片上传，分片暂存在根目录下的独立目录中
+ * @param {string} objectKey 对象路径
+ * @param {string} contentType 内容类型，本地存储按扩展名推断
+ * @return {*}
+ */
+func (s *localStorage) InitiateMultipart(objectKey string, contentType string) (string, error) {
+	if _, err := s.resolve(objectKey); err != nil {
+		return "", err
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(idBytes)
+
+	if err := os.MkdirAll(filepath.Join(s.rootDir, localMultipartDir, uploadID), 0755); err != nil {
+		return "", err
+	}
+
+	return uploadID, nil
+}
+
+/**
+ * @description: 上传单个分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @param {int} partNumber 分片号
+ * @param {io.Reader} reader 分片内容
+ * @param {int64} size 分片大小
+ * @return {*}
+ */
+func (s *localStorage) UploadPart(objectKey string, uploadID string, partNumber int, reader io.Reader, size int64) (*PartInfo, error) {
+	partDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	partPath := filepath.Join(partDir, fmt.Sprintf("%05d", partNumber))
+	if err = s.writeFile(partPath, reader); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(partPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return localPartInfo(partNumber, fileInfo), nil
+}
+
+/**
+ * @description: 列出已上传的分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *localStorage) ListParts(objectKey string, uploadID string) ([]PartInfo, error) {
+	partDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(partDir)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []PartInfo{}
+	for _, entry := range entries {
+		// 跳过写入中的临时文件
+		partNumber, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, *localPartInfo(partNumber, fileInfo))
+	}
+
+	sortParts(parts)
+	return parts, nil
+}
+
+/**
+ * @description: 按顺序拼接分片为完整文件
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @param {[]PartInfo} parts 参与合并的分片
+ * @return {*}
+ */
+func (s *localStorage) CompleteMultipart(objectKey string, uploadID string, parts []PartInfo) error {
+	fullPath, err := s.resolve(objectKey)
+	if err != nil {
+		return err
+	}
+
+	partDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		partFile, err := os.Open(filepath.Join(partDir, fmt.Sprintf("%05d", part.PartNumber)))
+		if err != nil {
+			return err
+		}
+		defer partFile.Close()
+		readers = append(readers, partFile)
+	}
+
+	if err = s.writeFile(fullPath, io.MultiReader(readers...)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(partDir)
+}
+
+/**
+ * @description: 放弃分片上传并删除暂存的分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *localStorage) AbortMultipart(objectKey string, uploadID string) error {
+	partDir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(partDir)
+}
+
+/**
+ * @description: 分片暂存目录，上传id必须是本存储生成的
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *localStorage) multipartDir(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", fmt.Errorf("invalid upload id: %q", uploadID)
+	}
+
+	partDir := filepath.Join(s.rootDir, localMultipartDir, uploadID)
+	if _, err := os.Stat(partDir); err != nil {
+		return "", err
+	}
+
+	return partDir, nil
+}
+
+/**
+ * @description: 分片文件信息转换为分片信息
+ * @param {int} partNumber 分片号
+ * @param {os.FileInfo} fileInfo 分片文件信息
+ * @return {*}
+ */
+func localPartInfo(partNumber int, fileInfo os.FileInfo) *PartInfo {
+	return &PartInfo{
+		PartNumber:   partNumber,
+		ETag:         fmt.Sprintf("%x-%x", fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+		Size:         fileInfo.Size(),
+		LastModified: fileInfo.ModTime(),
+	}
+}
+
+/**
+ * @description: 处理签名地址上的上传(PUT)和下载(GET/HEAD)请求
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func (s *localStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	objectKey := strings.TrimPrefix(r.URL.Path, LocalRoutePrefix)
+
+	// HEAD与GET共用签名
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	if method != http.MethodGet && method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.verify(method, objectKey, r.URL.Query()) {
+		http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	fullPath, err := s.resolve(objectKey)
+	if err != nil {
+		http.Error(w, "Invalid object key", http.StatusBadRequest)
+		return
+	}
+
+	if method == http.MethodPut {
+		// 校验上传限制
+		limit := zgconfig.Cfg.Upload
+		if !contentTypeAllowed(r.Header.Get("Content-Type"), limit.AllowedContentTypes) {
+			http.Error(w, "Content type not allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+		if limit.MaxFileSize > 0 {
+			if r.ContentLength > limit.MaxFileSize {
+				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit.MaxFileSize)
+		}
+
+		if err = s.writeFile(fullPath, r.Body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			logger.Logger.Error("error writing local object:", err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.IsDir() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// 用户上传的内容与管理页面同源，一律作为附件下载并禁止执行脚本
+	header := w.Header()
+	header.Set("Content-Type", SafeContentType(contentTypeByName(objectKey)))
+	disposition := "attachment"
+	if value := mime.FormatMediaType(disposition, map[string]string{"filename": path.Base(objectKey)}); value != "" {
+		disposition = value
+	}
+	header.Set("Content-Disposition", disposition)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Security-Policy", "sandbox")
+
+	http.ServeContent(w, r, path.Base(objectKey), fileInfo.ModTime(), file)
+}
+
+/**
+ * @description: 先写入临时文件再重命名，避免读到写了一半的文件
+ * @param {string} fullPath 目标文件路径
+ * @param {io.Reader} reader 文件内容
+ * @return {*}
+ */
+func (s *localStorage) writeFile(fullPath string, reader io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(fullPath), ".upload-*")
+	if err != nil {
+		return err
+	}
+	// 重命名成功后删除会失败，忽略即可
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = io.Copy(tmpFile, reader); err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), fullPath)
+}
+
+/**
+ * @description: 将对象路径转换为磁盘路径，拒绝越出根目录的路径
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *localStorage) resolve(objectKey string) (string, error) {
+	if objectKey == "" || strings.HasPrefix(objectKey, "/") || strings.Contains(objectKey, "\\") {
+		return "", fmt.Errorf("invalid object key: %q", objectKey)
+	}
+
+	for _, segment := range strings.Split(objectKey, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid object key: %q", objectKey)
+		}
+	}
+
+	return filepath.Join(s.rootDir, filepath.FromSlash(objectKey)), nil
+}
+
+/**
+ * @description: 生成签名地址
+ * @param {string} method 允许的请求方法
+ * @param {string} objectKey 对象路径
+ * @param {time.Time} expiration 过期时间
+ * @return {*}
+ */
+func (s *localStorage) signedURL(method string, objectKey string, expiration time.Time) string {
+	expires := strconv.FormatInt(expiration.Unix(), 10)
+
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", s.sign(method, objectKey, expires))
+
+	escapedKey := (&url.URL{Path: objectKey}).EscapedPath()
+	return s.publicUrl + LocalRoutePrefix + escapedKey + "?" + query.Encode()
+}
+
+/**
+ * @description: 校验签名及有效期
+ * @param {string} method 请求方法
+ * @param {string} objectKey 对象路径
+ * @param {url.Values} query 请求参数
+ * @return {*}
+ */
+func (s *localStorage) verify(method string, objectKey string, query url.Values) bool {
+	expires := query.Get("expires")
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+
+	expected := s.sign(method, objectKey, expires)
+	return hmac.Equal([]byte(expected), []byte(query.Get("signature")))
+}
+
+/**
+ * @description: 计算hmac-sha256签名
+ * @param {string} method 请求方法
+ * @param {string} objectKey 对象路径
+ * @param {string} expires 过期时间戳
+ * @return {*}
+ */
+func (s *localStorage) sign(method string, objectKey string, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(method + "\n" + objectKey + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/**
+ * @description: 根据扩展名推断内容类型
+ * @param {string} name 文件名
+ * @return {*}
+ */
+func contentTypeByName(name string) string {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return contentType
+}
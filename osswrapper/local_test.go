@@ -0,0 +1,205 @@
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/**
+ * @description: 在临时目录下创建本地存储，并启动处理签名地址的服务
+ * @param {*testing.T} t
+ * @return {*}
+ */
+func newTestLocalStorage(t *testing.T) *localStorage {
+	t.Helper()
+
+	logger.Logger = logrus.New()
+	zgconfig.Cfg = &zgconfig.Config{}
+
+	var storage *localStorage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storage.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	storage, err := newLocalStorage(zgconfig.Local{
+		RootDir:    t.TempDir(),
+		PublicUrl:  server.URL,
+		SignSecret: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage
+}
+
+/**
+ * @description: 发送请求并返回响应，响应体读完后关闭
+ * @param {*testing.T} t
+ * @param {string} method 请求方法
+ * @param {string} rawUrl 请求地址
+ * @param {string} body 请求体
+ * @return {*}
+ */
+func doLocalRequest(t *testing.T, method string, rawUrl string, body string) (*http.Response, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(method, rawUrl, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method == http.MethodPut {
+		request.Header.Set("Content-Type", "text/html")
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response, string(content)
+}
+
+func TestLocalSignedUploadAndDownload(t *testing.T) {
+	storage := newTestLocalStorage(t)
+
+	objectKey := "feedback/r1/f1/page.html"
+	credential, err := storage.IssueUploadCredential([]string{objectKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "<script>alert(1)</script>"
+	response, _ := doLocalRequest(t, http.MethodPut, credential.UploadUrls[objectKey], content)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("upload returned %d", response.StatusCode)
+	}
+
+	downloadUrl, err := storage.URL(objectKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, body := doLocalRequest(t, http.MethodGet, downloadUrl, "")
+	if response.StatusCode != http.StatusOK || body != content {
+		t.Fatalf("download returned %d %q", response.StatusCode, body)
+	}
+
+	// 用户上传的页面只能作为附件下载，不能在同源下执行
+	if contentType := response.Header.Get("Content-Type"); strings.HasPrefix(contentType, "text/html") {
+		t.Errorf("served as %q", contentType)
+	}
+	if disposition := response.Header.Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment") || !strings.Contains(disposition, "page.html") {
+		t.Errorf("content disposition = %q", disposition)
+	}
+	if csp := response.Header.Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Errorf("content security policy = %q", csp)
+	}
+	if nosniff := response.Header.Get("X-Content-Type-Options"); nosniff != "nosniff" {
+		t.Errorf("x-content-type-options = %q", nosniff)
+	}
+
+	// 上传地址不能用于下载
+	response, _ = doLocalRequest(t, http.MethodGet, credential.UploadUrls[objectKey], "")
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("download with an upload signature returned %d", response.StatusCode)
+	}
+}
+
+func TestLocalRejectsInvalidSignature(t *testing.T) {
+	storage := newTestLocalStorage(t)
+
+	objectKey := "feedback/r1/f1/log.txt"
+	credential, err := storage.IssueUploadCredential([]string{objectKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadUrl, err := url.Parse(credential.UploadUrls[objectKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 篡改签名
+	tampered := *uploadUrl
+	query := tampered.Query()
+	query.Set("signature", strings.Repeat("0", 64))
+	tampered.RawQuery = query.Encode()
+
+	// 改为其他对象路径
+	otherKey := *uploadUrl
+	otherKey.Path = LocalRoutePrefix + "feedback/r1/f1/other.txt"
+
+	// 延长有效期
+	extended := *uploadUrl
+	query = extended.Query()
+	query.Set("expires", "99999999999")
+	extended.RawQuery = query.Encode()
+
+	// 已过期的签名
+	expired := storage.signedURL(http.MethodPut, objectKey, time.Now().Add(-time.Minute))
+
+	for name, rawUrl := range map[string]string{
+		"tampered": tampered.String(),
+		"otherKey": otherKey.String(),
+		"extended": extended.String(),
+		"expired":  expired,
+	} {
+		response, _ := doLocalRequest(t, http.MethodPut, rawUrl, "content")
+		if response.StatusCode != http.StatusForbidden {
+			t.Errorf("%s signature returned %d, want 403", name, response.StatusCode)
+		}
+	}
+
+	if _, err = storage.Stat(objectKey); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("object written with an invalid signature: %v", err)
+	}
+}
+
+func TestLocalResolveRejectsTraversal(t *testing.T) {
+	storage := newTestLocalStorage(t)
+
+	for _, objectKey := range []string{
+		"",
+		"../secret.txt",
+		"feedback/../../secret.txt",
+		"feedback/./log.txt",
+		"feedback//log.txt",
+		"/etc/passwd",
+		`feedback\..\secret.txt`,
+	} {
+		if _, err := storage.resolve(objectKey); err == nil {
+			t.Errorf("resolve(%q) succeeded, want an error", objectKey)
+		}
+	}
+
+	fullPath, err := storage.resolve("feedback/r1/f1/log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fullPath, storage.rootDir) {
+		t.Errorf("resolved %q outside of %q", fullPath, storage.rootDir)
+	}
+
+	// 签名正确但路径越界的请求同样拒绝
+	rawUrl := storage.signedURL(http.MethodGet, "../secret.txt", time.Now().Add(time.Minute))
+	response, _ := doLocalRequest(t, http.MethodGet, strings.Replace(rawUrl, "../", "..%2F", 1), "")
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("traversal request returned %d, want 400", response.StatusCode)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-13 10:26:52
+ * @LastEditTime: 2024-09-13 18:03:14
+ * @FilePath: \UserFeedBack\osswrapper\multipart.go
+ * @Description: 分片上传
+ */
+package osswrapper
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// 存储后端不支持分片上传
+var ErrMultipartNotSupported = errors.New("multipart upload not supported by storage backend")
+
+// 已上传的分片
+type PartInfo struct {
+	PartNumber   int       `json:"partNumber"`
+	ETag         string    `json:"etag"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// 支持分片上传的存储
+type MultipartStorage interface {
+	// 初始化分片上传，返回存储侧的上传id
+	InitiateMultipart(objectKey string, contentType string) (string, error)
+
+	// 上传单个分片，分片号从1开始，重复上传同一分片号时覆盖
+	UploadPart(objectKey string, uploadID string, partNumber int, reader io.Reader, size int64) (*PartInfo, error)
+
+	// 列出已上传的分片，按分片号升序
+	ListParts(objectKey string, uploadID string) ([]PartInfo, error)
+
+	// 按分片号顺序合并分片为完整对象
+	CompleteMultipart(objectKey string, uploadID string, parts []PartInfo) error
+
+	// 放弃分片上传并清理已上传的分片
+	AbortMultipart(objectKey string, uploadID string) error
+}
+
+/**
+ * @description: 获取当前存储的分片上传能力
+ * @return {*}
+ */
+func Multipart() (MultipartStorage, error) {
+	multipart, ok := Current().(MultipartStorage)
+	if !ok {
+		return nil, ErrMultipartNotSupported
+	}
+
+	return multipart, nil
+}
+
+/**
+ * @description: 为分片上传生成对象路径，每个分片上传会话单独一个上传id
+ * @param {string} originalPath 原始文件路径
+ * @return {*}
+ */
+func NewMultipartObjectKey(originalPath string) (string, error) {
+	reportID, err := NewUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	return newObjectKey(reportID, originalPath)
+}
+
+/**
+ * @description: 分片按分片号升序排列
+ * @param {[]PartInfo} parts
+ * @return {*}
+ */
+func sortParts(parts []PartInfo) {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+}
@@ -10,78 +10,154 @@ package osswrapper
 import (
 	zgconfig "UserFeedBack/configwrapper"
 	logger "UserFeedBack/logwrapper"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"path/filepath"
+	"io"
+	"net/http"
+	"path"
 	"strings"
-	"time"
-
-	openapi "github.com/alibabacloud-go/darabonba-openapi/v2/client"
-	sts "github.com/alibabacloud-go/sts-20150401/v2/client"
-	util "github.com/alibabacloud-go/tea-utils/v2/service"
-	"github.com/alibabacloud-go/tea/tea"
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"sync"
+	"unicode"
 )
 
-// sts客户端
-var stsClient *sts.Client
+var (
+	// 当前使用的附件存储，重新加载凭证时整体替换，进行中的请求继续使用旧实例
+	storage Storage
+	// 保护storage的替换
+	storageMutex sync.RWMutex
+)
 
-// oss客户端
-var ossClient *oss.Client
+// 运行时不允许切换存储后端
+var ErrBackendChanged = errors.New("storage backend cannot be changed at runtime")
 
 /**
- * @description: 初始化OSS并生成sts和oss客户端
+ * @description: 根据配置初始化附件存储后端
  * @return {*}
  */
 func Init() error {
-	// 生成sts客户端
-	config := &openapi.Config{
-		AccessKeyId:     tea.String(zgconfig.Cfg.Oss.OssAccessKeyId),
-		AccessKeySecret: tea.String(zgconfig.Cfg.Oss.OssAccessKeySecret),
+	backend, err := newStorage(zgconfig.Cfg)
+	if err != nil {
+		return err
 	}
 
-	config.Endpoint = tea.String(zgconfig.Cfg.Oss.StsEndpoint)
-	_stsClient, _err := sts.NewClient(config)
-	if _err != nil {
-		logger.Logger.Error("error initializing OSS client:", _err)
-		return _err
+	storageMutex.Lock()
+	storage = backend
+	storageMutex.Unlock()
+
+	logger.Logger.Infof("storage backend: %s", backend.Name())
+
+	return nil
+}
+
+/**
+ * @description: 按配置创建存储后端
+ * @param {*zgconfig.Config} cfg 配置
+ * @return {*}
+ */
+func newStorage(cfg *zgconfig.Config) (Storage, error) {
+	switch cfg.Storage.Backend {
+	case "", BackendOss:
+		return newAliyunStorage(cfg.Oss)
+	case BackendS3:
+		return newS3Storage(cfg.Storage.S3)
+	case BackendLocal:
+		return newLocalStorage(cfg.Storage.Local)
 	}
 
-	stsClient = _stsClient
+	return nil, fmt.Errorf("unknown storage backend: %s", cfg.Storage.Backend)
+}
+
+/**
+ * @description: 按新配置重新创建存储后端，自检通过后才替换当前实例，用于轮换密钥后无需重启
+ * @param {*zgconfig.Config} cfg 新配置，只使用其中的存储凭证，其他配置仍需重启生效
+ * @return {*} 新实例的自检结果
+ */
+func Reload(cfg *zgconfig.Config) (*HealthReport, error) {
+	backend, err := newStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if backend.Name() != Current().Name() {
+		return nil, ErrBackendChanged
+	}
 
-	// 生成oss客户端
-	var _ossClient *oss.Client
-	_ossClient, _err = oss.New(zgconfig.Cfg.Oss.OssEndpoint, zgconfig.Cfg.Oss.AdminOssAccessKeyId, zgconfig.Cfg.Oss.AdminOssAccessKeySecret)
-	if _err != nil {
-		return _err
+	report := CheckHealth(backend)
+	if !report.Healthy {
+		return report, ErrUnhealthy
 	}
-	ossClient = _ossClient
 
-	return nil
+	storageMutex.Lock()
+	storage = backend
+	storageMutex.Unlock()
+
+	logger.Logger.Infof("storage backend %s reloaded", backend.Name())
+
+	return report, nil
+}
+
+/**
+ * @description: 获取当前使用的附件存储
+ * @return {*}
+ */
+func Current() Storage {
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
+
+	return storage
+}
+
+/**
+ * @description: 存储后端自身提供的http服务，没有时返回nil
+ * @return {*}
+ */
+func Handler() http.Handler {
+	if _, ok := Current().(http.Handler); !ok {
+		return nil
+	}
+
+	// 重新加载后由新实例处理
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := Current().(http.Handler)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
 type OssPathReflect struct {
-	RawPath string `json:"rawPath"`
-	OssPath string `json:"ossPath"`
+	RawPath    string            `json:"rawPath"`
+	OssPath    string            `json:"ossPath"`
+	Sha256     string            `json:"sha256,omitempty"`
+	Exists     bool              `json:"exists,omitempty"`     // 相同内容已存在，无需上传
+	UploadUrl  string            `json:"uploadUrl,omitempty"`  // 有uploadForm时以multipart表单POST到该地址，否则直接PUT文件内容
+	UploadForm map[string]string `json:"uploadForm,omitempty"` // 表单上传时需要附带的字段
 }
 
 type GenrateResult struct {
+	Backend         string           `json:"backend"`
 	OssEndpoint     string           `json:"ossEndpoint"`
 	BucketName      string           `json:"bucketName"`
 	AccessKeyId     string           `json:"accessKeyId"`
 	AccessKeySecret string           `json:"accessKeySecret"`
 	Expiration      string           `json:"expiration"`
 	SecurityToken   string           `json:"securityToken"`
+	UploadTicket    string           `json:"uploadTicket"`
 	OssPathReflect  []OssPathReflect `json:"ossPathReflect"`
 }
 
 /**
- * @description: 生成sts的上传token
+ * @description: 生成sts的上传token，声明了sha256的文件按内容寻址存放，内容已存在时不再签发上传权限
  * @param {[]string} originalPaths 原始文件路径数组
+ * @param {map[string]string} hashes 原始文件路径->sha256，可为空
+ * @param {map[string]bool} existingHashes 存储上已存在的sha256
  * @return {*} 生成结果
  */
-func GenerateSecurityToken(originalPaths []string) (*GenrateResult, error) {
+func GenerateSecurityToken(originalPaths []string, hashes map[string]string, existingHashes map[string]bool) (*GenrateResult, error) {
 	if len(originalPaths) == 0 {
 		logger.Logger.Error("empty file names provided")
 		return nil, errors.New("empty file names provided")
@@ -89,116 +165,314 @@ func GenerateSecurityToken(originalPaths []string) (*GenrateResult, error) {
 
 	// 声明返回结果
 	result := &GenrateResult{}
-	result.OssEndpoint = zgconfig.Cfg.Oss.OssEndpoint
-	result.BucketName = zgconfig.Cfg.Oss.BucketName
+	result.Backend = Current().Name()
+	if Current().Name() == BackendOss {
+		result.OssEndpoint = zgconfig.Cfg.Oss.OssEndpoint
+		result.BucketName = zgconfig.Cfg.Oss.BucketName
+	}
 
 	// 待填充的新的文件路径集合
-	resourcePaths := make([]string, 0, len(originalPaths))
+	objectKeys := make([]string, 0, len(originalPaths))
+
+	// 同一次请求的文件放在同一个随机目录下
+	reportID, err := NewUploadID()
+	if err != nil {
+		return nil, err
+	}
+
+	// 同一请求中相同sha256的文件共用一个暂存路径
+	stagingKeys := map[string]string{}
 
 	// 遍历原始文件名数组生成新的文件名
-	timestamp := time.Now().UnixMilli()
 	for _, originalPath := range originalPaths {
-		// 只使用文件名
-		originalFileName := filepath.Base(originalPath)
-
-		// 提取文件名和扩展名
-		fileName := strings.TrimSuffix(originalFileName, filepath.Ext(originalFileName))
-		extension := filepath.Ext(originalFileName)
+		sha256 := hashes[originalPath]
+		if sha256 != "" && existingHashes[sha256] {
+			// 内容已存在，直接引用共用的对象，不签发上传权限
+			result.OssPathReflect = append(result.OssPathReflect, OssPathReflect{RawPath: originalPath, OssPath: BlobObjectKey(sha256), Sha256: sha256, Exists: true})
+			continue
+		}
+		if sha256 != "" && stagingKeys[sha256] != "" {
+			result.OssPathReflect = append(result.OssPathReflect, OssPathReflect{RawPath: originalPath, OssPath: stagingKeys[sha256], Sha256: sha256})
+			continue
+		}
 
 		// 生成oss上的存放路径
-		pathOnOss := fmt.Sprintf("%s/%d/%s.%s",
-			zgconfig.Cfg.Oss.DirFeedback,
-			timestamp,
-			fileName,
-			extension,
-		)
-		result.OssPathReflect = append(result.OssPathReflect, OssPathReflect{RawPath: originalPath, OssPath: pathOnOss})
-
-		// 生成resouce字段对应的路径
-		pathInResource := fmt.Sprintf("acs:oss:*:*:%s/%s",
-			zgconfig.Cfg.Oss.BucketName,
-			pathOnOss,
-		)
-		resourcePaths = append(resourcePaths, pathInResource)
-	}
-
-	// 定义结构体来表示 Policy
-	type Statement struct {
-		Effect   string   `json:"Effect"`
-		Action   string   `json:"Action"`
-		Resource []string `json:"Resource"`
-	}
-
-	type Policy struct {
-		Version   string      `json:"Version"`
-		Statement []Statement `json:"Statement"`
-	}
-
-	// 创建 Policy 对象
-	policy := Policy{
-		Version: "1",
-		Statement: []Statement{
-			{
-				Effect:   "Allow",
-				Action:   "oss:PutObject",
-				Resource: resourcePaths,
-			},
-		},
-	}
-
-	// 转化Policy为json字符串
-	_, err := json.Marshal(policy)
-	if err != nil {
-		logger.Logger.Error("error marshalling policy:", err)
-		return nil, err
+		pathOnOss, err := newObjectKey(reportID, originalPath)
+		if err != nil {
+			return nil, err
+		}
+		// 声明了sha256的文件先上传到本次请求的暂存路径，提交时校验内容后再复制到共用对象，
+		// 共用对象的路径从不签发上传权限，避免被其他上传者覆盖
+		if sha256 != "" {
+			stagingKeys[sha256] = pathOnOss
+		}
+		result.OssPathReflect = append(result.OssPathReflect, OssPathReflect{RawPath: originalPath, OssPath: pathOnOss, Sha256: sha256})
+		objectKeys = append(objectKeys, pathOnOss)
 	}
 
-	// AssumeRole请求
-	assumeRoleRequest := &sts.AssumeRoleRequest{
-		RoleArn:         tea.String(zgconfig.Cfg.Oss.FeedbackRole),
-		RoleSessionName: tea.String(zgconfig.Cfg.Oss.RoleSessionName),
-		// Policy:          tea.String(string(policyBytes)),
+	// 所有文件都已存在时不需要上传凭证
+	if len(objectKeys) == 0 {
+		return result, nil
 	}
 
-	// 解析请求结果
-	stsResult := &sts.AssumeRoleResponse{}
-	if stsResult, err = stsClient.AssumeRoleWithOptions(assumeRoleRequest, &util.RuntimeOptions{}); err != nil {
-		logger.Logger.Error("error generating signed URL:", err)
+	// 签发上传凭证
+	credential, err := Current().IssueUploadCredential(objectKeys)
+	if err != nil {
 		return nil, err
 	}
 
 	// 填充返回结果
-	result.AccessKeyId = *stsResult.Body.Credentials.AccessKeyId
-	result.AccessKeySecret = *stsResult.Body.Credentials.AccessKeySecret
-	result.Expiration = *stsResult.Body.Credentials.Expiration
-	result.SecurityToken = *stsResult.Body.Credentials.SecurityToken
+	result.AccessKeyId = credential.AccessKeyId
+	result.AccessKeySecret = credential.AccessKeySecret
+	result.Expiration = credential.Expiration
+	result.SecurityToken = credential.SecurityToken
+	for i := range result.OssPathReflect {
+		result.OssPathReflect[i].UploadUrl = credential.UploadUrls[result.OssPathReflect[i].OssPath]
+		result.OssPathReflect[i].UploadForm = credential.UploadForms[result.OssPathReflect[i].OssPath]
+	}
 
 	return result, nil
 }
 
 /**
- * @description:删除oss上的文件
- * @param {[]string} path oss路径
+ * @description: 生成随机的上传id，用作对象路径中的目录
  * @return {*}
  */
-func DeleteFileOnOssByPath(path []string) error {
-	if len(path) == 0 {
-		logger.Logger.Error("empty file names provided")
-		return errors.New("empty file names provided")
+func NewUploadID() (string, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(idBytes), nil
+}
+
+/**
+ * @description: 生成文件在存储上的存放路径，格式为 目录/本次上报的id/文件的id/文件名，
+ * 同一次上报中的同名文件和并发的上报都不会冲突
+ * @param {string} reportID 本次上报的上传id
+ * @param {string} originalPath 原始文件路径
+ * @return {*}
+ */
+func newObjectKey(reportID string, originalPath string) (string, error) {
+	fileID, err := NewUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s/%s/%s", feedbackDir(), reportID, fileID, objectKeyName(originalPath)), nil
+}
+
+/**
+ * @description: 文件名转换为对象路径中使用的名称，在规范化的基础上只保留字母、数字和.-_
+ * @param {string} originalPath 原始文件路径
+ * @return {*}
+ */
+func objectKeyName(originalPath string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, SanitizeFileName(originalPath))
+}
+
+/**
+ * @description: 按sha256生成内容寻址的对象路径
+ * @param {string} sha256 小写十六进制的sha256
+ * @return {*}
+ */
+func BlobObjectKey(sha256 string) string {
+	return fmt.Sprintf("%s/blob/%s/%s", feedbackDir(), sha256[:2], sha256)
+}
+
+/**
+ * @description: 从内容寻址的对象路径中取出sha256
+ * @param {string} objectKey 对象路径
+ * @return {*} sha256，不是内容寻址的对象时返回false
+ */
+func BlobSha256(objectKey string) (string, bool) {
+	sha256 := path.Base(objectKey)
+	if !ValidSha256(sha256) || BlobObjectKey(sha256) != objectKey {
+		return "", false
 	}
 
-	bucket, err := ossClient.Bucket(zgconfig.Cfg.Oss.BucketName)
+	return sha256, true
+}
+
+/**
+ * @description: 校验sha256格式，需为64位小写十六进制
+ * @param {string} sha256
+ * @return {*}
+ */
+func ValidSha256(sha256 string) bool {
+	if len(sha256) != 64 {
+		return false
+	}
+
+	for _, c := range sha256 {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * @description: 读取对象内容计算sha256
+ * @param {string} objectKey 对象路径
+ * @return {*} 小写十六进制的sha256
+ */
+func ObjectSha256(objectKey string) (string, error) {
+	reader, err := Current().Open(objectKey)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+ * @description: 复制对象，存储不支持内部复制时经服务端中转内容
+ * @param {string} srcKey 源对象路径
+ * @param {string} dstKey 目标对象路径
+ * @return {*}
+ */
+func CopyObject(srcKey string, dstKey string) error {
+	if copier, ok := Current().(Copier); ok {
+		return copier.Copy(srcKey, dstKey)
+	}
+
+	info, err := Current().Stat(srcKey)
 	if err != nil {
 		return err
 	}
 
-	for _, ossPath := range path {
-		err = bucket.DeleteObject(ossPath)
-		if err != nil {
-			logger.Logger.Error("error deleting file:", err)
-			return err
+	reader, err := Current().Open(srcKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return Current().Put(dstKey, reader, info.Size, info.ContentType)
+}
+
+/**
+ * @description: 由服务端将文件流式写入存储，并校验大小和类型限制
+ * @param {string} reportID 本次上报的上传id
+ * @param {string} originalPath 原始文件路径
+ * @param {io.Reader} reader 文件内容
+ * @param {string} contentType 内容类型
+ * @return {*} 对象路径
+ */
+func UploadFile(reportID string, originalPath string, reader io.Reader, contentType string) (string, error) {
+	limit := zgconfig.Cfg.Upload
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if !contentTypeAllowed(contentType, limit.AllowedContentTypes) {
+		return "", fmt.Errorf("%w: %s", ErrContentTypeNotAllowed, contentType)
+	}
+
+	// 超过大小限制时中断读取，存储上不会留下完整对象
+	var limited *limitedReader
+	if limit.MaxFileSize > 0 {
+		limited = &limitedReader{reader: reader, remaining: limit.MaxFileSize}
+		reader = limited
+	}
+
+	objectKey, err := newObjectKey(reportID, originalPath)
+	if err != nil {
+		return "", err
+	}
+	if err = Current().Put(objectKey, reader, -1, contentType); err != nil {
+		// 各sdk不一定保留原始错误，以reader的状态为准
+		if limited != nil && limited.remaining < 0 {
+			return "", ErrFileTooLarge
 		}
+		logger.Logger.Error("error uploading file:", err)
+		return "", err
 	}
 
-	return nil
+	return objectKey, nil
+}
+
+// 超出长度后返回ErrFileTooLarge的reader
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+/**
+ * @description: 实现io.Reader接口
+ * @param {[]byte} p
+ * @return {*}
+ */
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrFileTooLarge
+	}
+
+	// 多读一个字节用于判断是否超出
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, ErrFileTooLarge
+	}
+
+	return n, err
+}
+
+/**
+ * @description:删除oss上的文件，单个文件失败时继续删除其余文件
+ * @param {[]string} path oss路径
+ * @return {*} 所有失败文件的错误
+ */
+func DeleteFileOnOssByPath(path []string) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	return DeleteObjects(path).Err()
+}
+
+/**
+ * @description: 反馈附件在存储上的路径前缀
+ * @return {*}
+ */
+func FeedbackPrefix() string {
+	return feedbackDir() + "/"
+}
+
+/**
+ * @description: 反馈附件在存储上的根目录
+ * @return {*}
+ */
+func feedbackDir() string {
+	dir := strings.Trim(zgconfig.Cfg.Oss.DirFeedback, "/")
+	if dir == "" {
+		dir = "feedback"
+	}
+
+	return dir
+}
+
+/**
+ * @description: 获取对象的下载地址
+ * @param {string} path oss路径
+ * @return {*}
+ */
+func ObjectURL(path string) (string, error) {
+	return Current().URL(path)
 }
@@ -0,0 +1,189 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-27 09:36:14
+ * @LastEditTime: 2024-09-27 16:52:48
+ * @FilePath: \UserFeedBack\osswrapper\policy.go
+ * @Description: 附件类型与大小策略
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"UserFeedBack/dto"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 识别内容类型时读取的字节数
+const sniffLength = 512
+
+// 文件名的最大长度，单位：字节
+const maxFileNameLength = 200
+
+// Windows下的保留文件名
+var reservedFileNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// 待校验的附件
+type FileSpec struct {
+	Name        string // 规范化后的文件名
+	RawName     string // 客户端提供的原始文件名，用于在校验结果中标识文件
+	ObjectKey   string // 对象路径，签发凭证前还没有
+	Size        int64  // 文件大小，未知时为-1
+	ContentType string // 存储上记录的内容类型，签发凭证前还没有
+}
+
+/**
+ * @description: 规范化客户端提供的文件名，去掉目录、控制字符和各系统下的非法字符，限制长度
+ * @param {string} rawPath 原始文件路径
+ * @return {*}
+ */
+func SanitizeFileName(rawPath string) string {
+	name := path.Base(strings.ReplaceAll(rawPath, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"/\|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	// 去掉首尾的空白和点，避免隐藏文件和Windows下无法打开的文件名
+	name = strings.Trim(name, " .")
+
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	if reservedFileNames[strings.ToUpper(stem)] {
+		name = "_" + name
+	}
+
+	// 超长时截断主干部分，保留扩展名
+	if len(name) > maxFileNameLength {
+		ext := path.Ext(name)
+		if len(ext) > maxFileNameLength/2 {
+			ext = ""
+		}
+		stem = strings.TrimSuffix(name, path.Ext(name))
+		for len(stem)+len(ext) > maxFileNameLength {
+			_, size := utf8.DecodeLastRuneInString(stem)
+			stem = stem[:len(stem)-size]
+		}
+		name = stem + ext
+	}
+
+	if name == "" {
+		name = "file"
+	}
+
+	return name
+}
+
+/**
+ * @description: 按配置的数量、扩展名、内容类型、单个文件大小和总大小校验一次反馈的附件
+ * @param {[]FileSpec} files 附件
+ * @return {*} 未通过的附件及原因
+ */
+func CheckFiles(files []FileSpec) []dto.FileRejection {
+	limit := zgconfig.Cfg.Upload
+	rejections := []dto.FileRejection{}
+
+	var total int64
+	for i, file := range files {
+		var reason string
+		switch {
+		case limit.MaxFiles > 0 && i >= limit.MaxFiles:
+			reason = fmt.Sprintf("too many files, at most %d per report", limit.MaxFiles)
+		case !extensionAllowed(file.Name, limit.AllowedExtensions):
+			reason = fmt.Sprintf("file extension %q is not allowed", path.Ext(file.Name))
+		case file.ContentType != "" && !contentTypeAllowed(file.ContentType, limit.AllowedContentTypes):
+			reason = fmt.Sprintf("content type %q is not allowed", file.ContentType)
+		case limit.MaxFileSize > 0 && file.Size > limit.MaxFileSize:
+			reason = fmt.Sprintf("file size %d exceeds the limit of %d bytes", file.Size, limit.MaxFileSize)
+		case limit.MaxReportSize > 0 && file.Size > 0 && total+file.Size > limit.MaxReportSize:
+			reason = fmt.Sprintf("total size of the report exceeds the limit of %d bytes", limit.MaxReportSize)
+		}
+
+		if reason != "" {
+			label := file.Name
+			if file.RawName != "" {
+				label = file.RawName
+			}
+			rejections = append(rejections, dto.FileRejection{File: label, ObjectKey: file.ObjectKey, Reason: reason})
+			continue
+		}
+
+		if file.Size > 0 {
+			total += file.Size
+		}
+	}
+
+	return rejections
+}
+
+/**
+ * @description: 读取对象开头识别实际内容类型，未配置允许的类型时不校验
+ * @param {string} objectKey 对象路径
+ * @param {int64} size 对象大小
+ * @return {*} 未通过时返回原因
+ */
+func CheckObjectContent(objectKey string, size int64) (string, error) {
+	allowed := zgconfig.Cfg.Upload.AllowedSniffedTypes
+	if len(allowed) == 0 || size <= 0 {
+		return "", nil
+	}
+
+	reader, err := Current().OpenRange(objectKey, 0, min(size, sniffLength))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	head, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	sniffed := http.DetectContentType(head)
+	if !contentTypeAllowed(sniffed, allowed) {
+		mediaType, _, _ := mime.ParseMediaType(sniffed)
+		return fmt.Sprintf("content detected as %s is not allowed", mediaType), nil
+	}
+
+	return "", nil
+}
+
+/**
+ * @description: 判断扩展名是否在允许范围内，不区分大小写
+ * @param {string} fileName 文件名
+ * @param {[]string} allowed 允许的扩展名，为空时不限制
+ * @return {*}
+ */
+func extensionAllowed(fileName string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(fileName))
+	for _, item := range allowed {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" && !strings.HasPrefix(item, ".") {
+			item = "." + item
+		}
+		if item == ext {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,33 @@
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"testing"
+)
+
+func TestCheckFilesAtRegistration(t *testing.T) {
+	zgconfig.Cfg = &zgconfig.Config{}
+	zgconfig.Cfg.Upload.MaxFileSize = 100
+	zgconfig.Cfg.Upload.AllowedContentTypes = []string{"text/plain", "image/*"}
+
+	// 直传时凭证无法完全限制大小和类型，提交反馈时按存储上的实际对象校验
+	rejections := CheckFiles([]FileSpec{
+		{Name: "ok.log", ObjectKey: "a", Size: 10, ContentType: "text/plain; charset=utf-8"},
+		{Name: "shot.png", ObjectKey: "b", Size: 10, ContentType: "image/png"},
+		{Name: "page.html", ObjectKey: "c", Size: 10, ContentType: "text/html"},
+		{Name: "big.log", ObjectKey: "d", Size: 101, ContentType: "text/plain"},
+	})
+
+	rejected := map[string]bool{}
+	for _, rejection := range rejections {
+		rejected[rejection.ObjectKey] = true
+	}
+	if len(rejections) != 2 || !rejected["c"] || !rejected["d"] {
+		t.Errorf("unexpected rejections: %+v", rejections)
+	}
+
+	// 签发凭证前还没有内容类型，不按类型校验
+	if rejections = CheckFiles([]FileSpec{{Name: "page.html", Size: 10}}); len(rejections) != 0 {
+		t.Errorf("unexpected rejections before upload: %+v", rejections)
+	}
+}
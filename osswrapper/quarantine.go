@@ -0,0 +1,55 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-08 11:12:50
+ * @LastEditTime: 2024-10-08 16:52:37
+ * @FilePath: \UserFeedBack\osswrapper\quarantine.go
+ * @Description: 染毒附件的隔离
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"strings"
+)
+
+/**
+ * @description: 把对象移动到隔离目录，隔离目录不在附件目录下，不会被下载地址或孤立附件清理访问到
+ * @param {string} objectKey 对象路径
+ * @return {*} 隔离后的对象路径
+ */
+func QuarantineObject(objectKey string) (string, error) {
+	info, err := Current().Stat(objectKey)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := Current().Open(objectKey)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	quarantineKey := quarantineDir() + "/" + objectKey
+	if err = Current().Put(quarantineKey, reader, info.Size, "application/octet-stream"); err != nil {
+		return "", err
+	}
+
+	if err = Current().Delete(objectKey); err != nil {
+		return quarantineKey, err
+	}
+
+	return quarantineKey, nil
+}
+
+/**
+ * @description: 隔离目录
+ * @return {*}
+ */
+func quarantineDir() string {
+	dir := strings.Trim(zgconfig.Cfg.Scan.QuarantineDir, "/")
+	if dir == "" {
+		dir = "quarantine"
+	}
+
+	return dir
+}
@@ -0,0 +1,488 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-11 09:52:17
+ * @LastEditTime: 2024-09-11 15:27:43
+ * @FilePath: \UserFeedBack\osswrapper\s3.go
+ * @Description: S3兼容存储实现（AWS S3、MinIO等）
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// 预签名地址默认有效期
+const defaultS3UrlExpire = 3600
+
+// 大小未知时流式上传的分片大小，决定了上传时占用的内存
+const s3StreamPartSize = 16 << 20
+
+// S3兼容存储
+type s3Storage struct {
+	client     *minio.Client
+	urlClient  *minio.Client // 生成下载地址的客户端，配置了公开地址时以公开地址签名
+	bucketName string
+	expire     time.Duration
+}
+
+/**
+ * @description: 创建S3兼容存储
+ * @param {zgconfig.S3} cfg s3配置
+ * @return {*}
+ */
+func newS3Storage(cfg zgconfig.S3) (*s3Storage, error) {
+	if cfg.Endpoint == "" || cfg.BucketName == "" {
+		return nil, errors.New("s3 endpoint or bucket not configured")
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	options := &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKeyId, cfg.AccessKeySecret, ""),
+		Secure:       cfg.UseSSL,
+		Region:       cfg.Region,
+		BucketLookup: bucketLookup,
+	}
+	client, err := minio.New(cfg.Endpoint, options)
+	if err != nil {
+		logger.Logger.Error("error initializing S3 client:", err)
+		return nil, err
+	}
+
+	// 公开地址只替换下载地址的协议和主机，签名按公开主机计算，下载地址仍会过期
+	urlClient := client
+	if cfg.PublicUrl != "" {
+		publicUrl, err := url.Parse(cfg.PublicUrl)
+		if err != nil || (publicUrl.Scheme != "http" && publicUrl.Scheme != "https") || publicUrl.Host == "" ||
+			strings.Trim(publicUrl.Path, "/") != "" || publicUrl.RawQuery != "" {
+			return nil, errors.New("s3 public url must be in the form of scheme://host[:port]")
+		}
+
+		publicOptions := *options
+		publicOptions.Secure = publicUrl.Scheme == "https"
+		urlClient, err = minio.New(publicUrl.Host, &publicOptions)
+		if err != nil {
+			logger.Logger.Error("error initializing S3 public url client:", err)
+			return nil, err
+		}
+	}
+
+	expire := cfg.UrlExpireSeconds
+	if expire <= 0 {
+		expire = defaultS3UrlExpire
+	}
+
+	return &s3Storage{
+		client:     client,
+		urlClient:  urlClient,
+		bucketName: cfg.BucketName,
+		expire:     time.Duration(expire) * time.Second,
+	}, nil
+}
+
+/**
+ * @description: 后端名称
+ * @return {*}
+ */
+func (s *s3Storage) Name() string {
+	return BackendS3
+}
+
+/**
+ * @description: 为每个对象生成预签名的上传地址，配置了类型或大小限制时签发表单上传，由存储校验上传内容
+ * @param {[]string} objectKeys 允许上传的对象路径
+ * @return {*}
+ */
+func (s *s3Storage) IssueUploadCredential(objectKeys []string) (*UploadCredential, error) {
+	limit := zgconfig.Cfg.Upload
+	expire := s.expire
+	if limit.TokenDurationSeconds > 0 {
+		expire = time.Duration(limit.TokenDurationSeconds) * time.Second
+	}
+	expiration := time.Now().Add(expire).UTC()
+
+	result := &UploadCredential{
+		Expiration: expiration.Format(time.RFC3339),
+		UploadUrls: make(map[string]string, len(objectKeys)),
+	}
+
+	// 预签名的PUT地址无法限制大小，有限制时只签发表单，客户端把表单POST到上传地址
+	if len(limit.AllowedContentTypes) > 0 || limit.MaxFileSize > 0 {
+		result.UploadForms = make(map[string]map[string]string, len(objectKeys))
+		for _, objectKey := range objectKeys {
+			postUrl, form, err := s.presignedPostForm(objectKey, expiration, limit)
+			if err != nil {
+				logger.Logger.Error("error generating presigned post policy:", err)
+				return nil, err
+			}
+			result.UploadUrls[objectKey] = postUrl
+			result.UploadForms[objectKey] = form
+		}
+
+		return result, nil
+	}
+
+	for _, objectKey := range objectKeys {
+		presignedUrl, err := s.client.PresignedPutObject(context.Background(), s.bucketName, objectKey, expire)
+		if err != nil {
+			logger.Logger.Error("error generating presigned put URL:", err)
+			return nil, err
+		}
+		result.UploadUrls[objectKey] = presignedUrl.String()
+	}
+
+	return result, nil
+}
+
+/**
+ * @description: 生成POST表单上传的策略，限制对象路径、大小和内容类型，
+ * S3的表单策略只能限定一个内容类型或前缀，允许多个类型时由提交反馈时的校验兜底
+ * @param {string} objectKey 对象路径
+ * @param {time.Time} expiration 过期时间
+ * @param {zgconfig.Upload} limit 上传限制
+ * @return {*} 上传地址和表单字段
+ */
+func (s *s3Storage) presignedPostForm(objectKey string, expiration time.Time, limit zgconfig.Upload) (string, map[string]string, error) {
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(s.bucketName); err != nil {
+		return "", nil, err
+	}
+	if err := policy.SetKey(objectKey); err != nil {
+		return "", nil, err
+	}
+	if err := policy.SetExpires(expiration); err != nil {
+		return "", nil, err
+	}
+	if limit.MaxFileSize > 0 {
+		if err := policy.SetContentLengthRange(0, limit.MaxFileSize); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(limit.AllowedContentTypes) == 1 {
+		contentType := strings.ToLower(strings.TrimSpace(limit.AllowedContentTypes[0]))
+		var err error
+		if strings.HasSuffix(contentType, "/*") {
+			err = policy.SetContentTypeStartsWith(strings.TrimSuffix(contentType, "*"))
+		} else {
+			err = policy.SetContentType(contentType)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	postUrl, form, err := s.client.PresignedPostPolicy(context.Background(), policy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return postUrl.String(), form, nil
+}
+
+/**
+ * @description: 查询对象元信息
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *s3Storage) Stat(objectKey string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucketName, objectKey, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Key:          objectKey,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+/**
+ * @description: 由服务端直接写入对象，大小未知时按分片流式上传
+ * @param {string} objectKey 对象路径
+ * @param {io.Reader} reader 对象内容
+ * @param {int64} size 对象大小，未知时为-1
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func (s *s3Storage) Put(objectKey string, reader io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(context.Background(), s.bucketName, objectKey, reader, size, minio.PutObjectOptions{
+		ContentType: contentType,
+		PartSize:    s3StreamPartSize,
+	})
+	return err
+}
+
+/**
+ * @description: 在存储桶内复制对象
+ * @param {string} srcKey 源对象路径
+ * @param {string} dstKey 目标对象路径
+ * @return {*}
+ */
+func (s *s3Storage) Copy(srcKey string, dstKey string) error {
+	_, err := s.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucketName, Object: dstKey},
+		minio.CopySrcOptions{Bucket: s.bucketName, Object: srcKey})
+	if isS3NotFound(err) {
+		return ErrObjectNotFound
+	}
+
+	return err
+}
+
+/**
+ * @description: 读取对象内容
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *s3Storage) Open(objectKey string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucketName, objectKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject不会立即发起请求，通过Stat提前暴露对象不存在等错误
+	if _, err = object.Stat(); err != nil {
+		object.Close()
+		if isS3NotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return object, nil
+}
+
+/**
+ * @description: 读取对象的指定区间
+ * @param {string} objectKey 对象路径
+ * @param {int64} offset 起始位置
+ * @param {int64} length 读取长度
+ * @return {*}
+ */
+func (s *s3Storage) OpenRange(objectKey string, offset int64, length int64) (io.ReadCloser, error) {
+	options := minio.GetObjectOptions{}
+	if err := options.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+
+	// 高层的GetObject在Stat时会去掉Range，直接发起带Range的请求
+	object, _, _, err := s.core().GetObject(context.Background(), s.bucketName, objectKey, options)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	return object, nil
+}
+
+/**
+ * @description: 删除对象
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *s3Storage) Delete(objectKey string) error {
+	return s.client.RemoveObject(context.Background(), s.bucketName, objectKey, minio.RemoveObjectOptions{})
+}
+
+/**
+ * @description: 通过DeleteObjects批量删除对象
+ * @param {[]string} objectKeys 对象路径
+ * @return {*} 删除失败的对象及原因
+ */
+func (s *s3Storage) DeleteObjects(objectKeys []string) (map[string]error, error) {
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for _, objectKey := range objectKeys {
+			objectsCh <- minio.ObjectInfo{Key: objectKey}
+		}
+	}()
+
+	failed := make(map[string]error)
+	for removeErr := range s.client.RemoveObjects(context.Background(), s.bucketName, objectsCh, minio.RemoveObjectsOptions{}) {
+		failed[removeErr.ObjectName] = removeErr.Err
+	}
+
+	return failed, nil
+}
+
+/**
+ * @description: 遍历前缀下的所有对象
+ * @param {string} prefix 对象路径前缀
+ * @param {func(info *ObjectInfo) error} fn 处理函数
+ * @return {*}
+ */
+func (s *s3Storage) List(prefix string, fn func(info *ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	// 提前结束遍历时停止后台的分页请求
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		err := fn(&ObjectInfo{
+			Key:          object.Key,
+			Size:         object.Size,
+			ETag:         object.ETag,
+			ContentType:  object.ContentType,
+			LastModified: object.LastModified,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * @description: 对象的预签名下载地址，配置了公开地址时以公开地址的主机签名
+ * @param {string} objectKey 对象路径
+ * @return {*}
+ */
+func (s *s3Storage) URL(objectKey string) (string, error) {
+	presignedUrl, err := s.urlClient.PresignedGetObject(context.Background(), s.bucketName, objectKey, s.expire, url.Values{})
+	if err != nil {
+		return "", err
+	}
+
+	return presignedUrl.String(), nil
+}
+
+/**
+ * @description: 初始化分片上传
+ * @param {string} objectKey 对象路径
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func (s *s3Storage) InitiateMultipart(objectKey string, contentType string) (string, error) {
+	return s.core().NewMultipartUpload(context.Background(), s.bucketName, objectKey, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+}
+
+/**
+ * @description: 上传单个分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @param {int} partNumber 分片号
+ * @param {io.Reader} reader 分片内容
+ * @param {int64} size 分片大小
+ * @return {*}
+ */
+func (s *s3Storage) UploadPart(objectKey string, uploadID string, partNumber int, reader io.Reader, size int64) (*PartInfo, error) {
+	part, err := s.core().PutObjectPart(context.Background(), s.bucketName, objectKey, uploadID, partNumber, reader, size, minio.PutObjectPartOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PartInfo{
+		PartNumber:   part.PartNumber,
+		ETag:         part.ETag,
+		Size:         part.Size,
+		LastModified: time.Now(),
+	}, nil
+}
+
+/**
+ * @description: 列出已上传的分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *s3Storage) ListParts(objectKey string, uploadID string) ([]PartInfo, error) {
+	parts := []PartInfo{}
+	marker := 0
+	for {
+		result, err := s.core().ListObjectParts(context.Background(), s.bucketName, objectKey, uploadID, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range result.ObjectParts {
+			parts = append(parts, PartInfo{
+				PartNumber:   part.PartNumber,
+				ETag:         part.ETag,
+				Size:         part.Size,
+				LastModified: part.LastModified,
+			})
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	sortParts(parts)
+	return parts, nil
+}
+
+/**
+ * @description: 合并分片
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @param {[]PartInfo} parts 参与合并的分片
+ * @return {*}
+ */
+func (s *s3Storage) CompleteMultipart(objectKey string, uploadID string, parts []PartInfo) error {
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+
+	_, err := s.core().CompleteMultipartUpload(context.Background(), s.bucketName, objectKey, uploadID, completeParts, minio.PutObjectOptions{})
+	return err
+}
+
+/**
+ * @description: 放弃分片上传
+ * @param {string} objectKey 对象路径
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func (s *s3Storage) AbortMultipart(objectKey string, uploadID string) error {
+	return s.core().AbortMultipartUpload(context.Background(), s.bucketName, objectKey, uploadID)
+}
+
+/**
+ * @description: 分片上传需要使用底层api
+ * @return {*}
+ */
+func (s *s3Storage) core() minio.Core {
+	return minio.Core{Client: s.client}
+}
+
+/**
+ * @description: 判断s3返回的错误是否为对象不存在
+ * @param {error} err
+ * @return {*}
+ */
+func isS3NotFound(err error) bool {
+	errResp := minio.ToErrorResponse(err)
+	return errResp.StatusCode == http.StatusNotFound || errResp.Code == "NoSuchKey"
+}
@@ -0,0 +1,543 @@
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	logger "UserFeedBack/logwrapper"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// 内存中的S3桩，只实现路径风格下单次PUT、复制、HEAD、GET（含Range）、DELETE、批量删除和ListObjectsV2
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	types   map[string]string
+	// 批量删除时返回错误的对象
+	deleteErrors map[string]string
+	// 每次批量删除请求的对象数
+	deleteBatches []int
+	// 同时进行的批量删除请求数及其最大值
+	activeDeletes    atomic.Int32
+	maxActiveDeletes atomic.Int32
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 加锁前统计并发的批量删除请求，稍作停顿以便请求重叠
+	if r.Method == http.MethodPost && r.URL.Query().Has("delete") {
+		active := f.activeDeletes.Add(1)
+		defer f.activeDeletes.Add(-1)
+		for peak := f.maxActiveDeletes.Load(); active > peak && !f.maxActiveDeletes.CompareAndSwap(peak, active); peak = f.maxActiveDeletes.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	if key == "" && r.Method == http.MethodPost && r.URL.Query().Has("delete") {
+		f.deleteMultiple(w, r.Body)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.bucket+"/"))
+			body, ok := f.objects[source]
+			if !ok {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+				return
+			}
+			f.objects[key] = body
+			f.types[key] = f.types[source]
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>"%d"</ETag><LastModified>%s</LastModified></CopyObjectResult>`, len(body), time.Now().UTC().Format(time.RFC3339))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			body = decodeAwsChunked(body)
+		}
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(body))+`"`)
+	case http.MethodHead, http.MethodGet:
+		body, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(body))+`"`)
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		status := http.StatusOK
+		if value := r.Header.Get("Range"); value != "" {
+			var start, end int
+			fmt.Sscanf(value, "bytes=%d-%d", &start, &end)
+			end = min(end, len(body)-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+			body = body[start : end+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+// 解码流式签名的分块内容，格式为 十六进制长度;chunk-signature=...\r\n内容\r\n，长度为0时结束
+func decodeAwsChunked(body []byte) []byte {
+	var decoded []byte
+	for {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return decoded
+		}
+		sizeText, _, _ := bytes.Cut(header, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeText), 16, 64)
+		if err != nil || size == 0 || int64(len(rest)) < size {
+			return decoded
+		}
+		decoded = append(decoded, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
+
+// 批量删除，单个对象的错误在结果中返回，其余对象正常删除
+func (f *fakeS3) deleteMultiple(w http.ResponseWriter, body io.Reader) {
+	var request struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(body).Decode(&request); err != nil {
+		http.Error(w, "MalformedXML", http.StatusBadRequest)
+		return
+	}
+	f.deleteBatches = append(f.deleteBatches, len(request.Objects))
+
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Errors  []deleteError `xml:"Error"`
+	}{}
+	for _, object := range request.Objects {
+		if message, ok := f.deleteErrors[object.Key]; ok {
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: "AccessDenied", Message: message})
+			continue
+		}
+		delete(f.objects, object.Key)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		ETag         string
+		LastModified string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			Size:         int64(len(f.objects[key])),
+			ETag:         `"` + strconv.Itoa(len(f.objects[key])) + `"`,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+/**
+ * @description: 启动S3桩并创建连接到它的存储
+ * @param {*testing.T} t
+ * @return {*}
+ */
+func newTestS3Storage(t *testing.T) (*s3Storage, *fakeS3) {
+	t.Helper()
+
+	logger.Logger = logrus.New()
+	zgconfig.Cfg = &zgconfig.Config{}
+
+	fake := &fakeS3{bucket: "feedback", objects: map[string][]byte{}, types: map[string]string{}, deleteErrors: map[string]string{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	storage, err := newS3Storage(zgconfig.S3{
+		Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		BucketName:      fake.bucket,
+		AccessKeyId:     "test",
+		AccessKeySecret: "testsecret",
+		Region:          "us-east-1",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage, fake
+}
+
+func TestS3ObjectLifecycle(t *testing.T) {
+	storage, _ := newTestS3Storage(t)
+
+	content := []byte("hello feedback")
+	if err := storage.Put("feedback/a/log.txt", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := storage.Stat("feedback/a/log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) || info.ContentType != "text/plain" {
+		t.Errorf("unexpected stat result: %+v", info)
+	}
+
+	reader, err := storage.OpenRange("feedback/a/log.txt", 6, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(part) != "feedback" {
+		t.Errorf("range read %q, want %q", part, "feedback")
+	}
+
+	var keys []string
+	err = storage.List("feedback/", func(info *ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "feedback/a/log.txt" {
+		t.Errorf("listed %v", keys)
+	}
+
+	if err = storage.Delete("feedback/a/log.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.Stat("feedback/a/log.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("stat after delete returned %v, want ErrObjectNotFound", err)
+	}
+	if _, err = storage.Open("feedback/a/log.txt"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("open after delete returned %v, want ErrObjectNotFound", err)
+	}
+	if _, err = storage.OpenRange("feedback/a/log.txt", 0, 4); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("range read after delete returned %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestS3UploadCredentialWithoutLimits(t *testing.T) {
+	storage, _ := newTestS3Storage(t)
+
+	credential, err := storage.IssueUploadCredential([]string{"feedback/a/log.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.UploadForms != nil {
+		t.Errorf("unexpected upload forms: %v", credential.UploadForms)
+	}
+
+	uploadUrl, err := url.Parse(credential.UploadUrls["feedback/a/log.txt"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadUrl.Path != "/feedback/feedback/a/log.txt" || uploadUrl.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("unexpected presigned put url: %s", uploadUrl)
+	}
+}
+
+func TestS3UploadCredentialWithLimits(t *testing.T) {
+	storage, _ := newTestS3Storage(t)
+	zgconfig.Cfg.Upload.MaxFileSize = 1 << 20
+	zgconfig.Cfg.Upload.AllowedContentTypes = []string{"image/*"}
+
+	credential, err := storage.IssueUploadCredential([]string{"feedback/a/shot.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 有限制时只签发表单，不能再通过PUT绕过限制
+	uploadUrl, err := url.Parse(credential.UploadUrls["feedback/a/shot.png"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadUrl.Path != "/feedback/" || uploadUrl.RawQuery != "" {
+		t.Errorf("unexpected post url: %s", uploadUrl)
+	}
+
+	form := credential.UploadForms["feedback/a/shot.png"]
+	if form["key"] != "feedback/a/shot.png" || form["x-amz-signature"] == "" {
+		t.Fatalf("unexpected form: %v", form)
+	}
+
+	policyBytes, err := base64.StdEncoding.DecodeString(form["policy"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policy struct {
+		Conditions []json.RawMessage `json:"conditions"`
+	}
+	if err = json.Unmarshal(policyBytes, &policy); err != nil {
+		t.Fatal(err)
+	}
+
+	conditions := make([]string, 0, len(policy.Conditions))
+	for _, condition := range policy.Conditions {
+		conditions = append(conditions, string(condition))
+	}
+	for _, want := range []string{
+		`["content-length-range",0,1048576]`,
+		`["starts-with","$Content-Type","image/"]`,
+		`["eq","$key","feedback/a/shot.png"]`,
+	} {
+		found := false
+		for _, condition := range conditions {
+			if strings.ReplaceAll(condition, " ", "") == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("policy conditions %v do not contain %s", conditions, want)
+		}
+	}
+}
+
+func TestS3CopyObject(t *testing.T) {
+	storage, fake := newTestS3Storage(t)
+
+	content := []byte("shared content")
+	if err := storage.Put("feedback/r1/f1/log.txt", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Copy("feedback/r1/f1/log.txt", "feedback/blob/ab/abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["feedback/blob/ab/abcdef"]) != string(content) {
+		t.Errorf("copied content = %q, want %q", fake.objects["feedback/blob/ab/abcdef"], content)
+	}
+
+	if err := storage.Copy("feedback/r1/f2/missing.txt", "feedback/blob/cd/cdef"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("copy of missing object returned %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestS3URLSignsWithPublicHost(t *testing.T) {
+	_, fake := newTestS3Storage(t)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	// 公开地址与服务地址指向同一个桩，只是主机名不同
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	publicHost := strings.Replace(endpoint, "127.0.0.1", "localhost", 1)
+	storage, err := newS3Storage(zgconfig.S3{
+		Endpoint:         endpoint,
+		BucketName:       fake.bucket,
+		AccessKeyId:      "test",
+		AccessKeySecret:  "testsecret",
+		Region:           "us-east-1",
+		PathStyle:        true,
+		PublicUrl:        "http://" + publicHost + "/",
+		UrlExpireSeconds: 600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("public content")
+	if err = storage.Put("feedback/r1/f1/log.txt", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	rawUrl, err := storage.URL("feedback/r1/f1/log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if downloadUrl.Host != publicHost || downloadUrl.Path != "/feedback/feedback/r1/f1/log.txt" {
+		t.Errorf("download url = %s, want host %s", rawUrl, publicHost)
+	}
+	// 公开地址同样是会过期的签名地址
+	query := downloadUrl.Query()
+	if query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") != "600" {
+		t.Errorf("download url is not presigned: %s", rawUrl)
+	}
+
+	response, err := http.Get(rawUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != string(content) {
+		t.Errorf("download returned %d %q", response.StatusCode, body)
+	}
+
+	for _, publicUrl := range []string{"cdn.example.com", "ftp://cdn.example.com", "https://cdn.example.com/files", "https://"} {
+		_, err = newS3Storage(zgconfig.S3{
+			Endpoint:   endpoint,
+			BucketName: fake.bucket,
+			PublicUrl:  publicUrl,
+		})
+		if err == nil {
+			t.Errorf("public url %q accepted, want an error", publicUrl)
+		}
+	}
+}
+
+func TestGenerateSecurityTokenStagesNewBlobs(t *testing.T) {
+	testStorage, _ := newTestS3Storage(t)
+	previous := storage
+	storage = testStorage
+	t.Cleanup(func() { storage = previous })
+
+	existingSha := strings.Repeat("a", 64)
+	newSha := strings.Repeat("b", 64)
+	result, err := GenerateSecurityToken(
+		[]string{"old.log", "new.log", "copy-of-new.log", "plain.txt"},
+		map[string]string{"old.log": existingSha, "new.log": newSha, "copy-of-new.log": newSha},
+		map[string]bool{existingSha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := map[string]OssPathReflect{}
+	for _, item := range result.OssPathReflect {
+		paths[item.RawPath] = item
+	}
+
+	// 已存在的内容直接引用共用对象，不签发上传权限
+	if old := paths["old.log"]; old.OssPath != BlobObjectKey(existingSha) || !old.Exists || old.UploadUrl != "" {
+		t.Errorf("unexpected reflect for existing blob: %+v", old)
+	}
+
+	// 新内容上传到暂存路径，同一请求中相同内容共用一个暂存路径
+	staged := paths["new.log"]
+	if staged.OssPath == BlobObjectKey(newSha) || strings.Contains(staged.OssPath, "/blob/") || staged.Sha256 != newSha || staged.UploadUrl == "" {
+		t.Errorf("unexpected reflect for new blob: %+v", staged)
+	}
+	if paths["copy-of-new.log"].OssPath != staged.OssPath {
+		t.Errorf("same content staged at %q and %q", staged.OssPath, paths["copy-of-new.log"].OssPath)
+	}
+	if paths["plain.txt"].UploadUrl == "" || paths["plain.txt"].Sha256 != "" {
+		t.Errorf("unexpected reflect for plain file: %+v", paths["plain.txt"])
+	}
+}
+
+func TestS3DeleteObjectsInBatches(t *testing.T) {
+	testStorage, fake := newTestS3Storage(t)
+	previous := storage
+	storage = testStorage
+	t.Cleanup(func() { storage = previous })
+	zgconfig.Cfg.Storage.DeleteConcurrency = 2
+
+	// 超过一批的数量，其中部分对象删除失败，重复的路径只删除一次
+	var objectKeys []string
+	for i := 0; i < 2500; i++ {
+		objectKey := fmt.Sprintf("feedback/r%d/log.txt", i)
+		fake.objects[objectKey] = []byte("x")
+		objectKeys = append(objectKeys, objectKey)
+	}
+	objectKeys = append(objectKeys, objectKeys[0])
+	fake.deleteErrors["feedback/r7/log.txt"] = "denied"
+	fake.deleteErrors["feedback/r1999/log.txt"] = "denied"
+
+	result := DeleteObjects(objectKeys)
+
+	if peak := fake.maxActiveDeletes.Load(); peak > 2 {
+		t.Errorf("%d concurrent delete requests, want at most 2", peak)
+	}
+
+	sort.Ints(fake.deleteBatches)
+	if len(fake.deleteBatches) != 3 || fake.deleteBatches[0] != 500 || fake.deleteBatches[2] != maxDeleteBatch {
+		t.Errorf("delete batches = %v, want 500, 1000 and 1000 objects", fake.deleteBatches)
+	}
+
+	if len(result.Deleted) != 2498 {
+		t.Errorf("deleted %d objects, want 2498", len(result.Deleted))
+	}
+	if failed := result.FailedKeys(); len(failed) != 2 || failed[0] != "feedback/r1999/log.txt" || failed[1] != "feedback/r7/log.txt" {
+		t.Errorf("failed keys = %v", failed)
+	}
+	if err := result.Err(); err == nil || !strings.Contains(err.Error(), "feedback/r7/log.txt") {
+		t.Errorf("aggregated error = %v", err)
+	}
+
+	// 失败的对象仍在存储上，其余对象已删除
+	if len(fake.objects) != 2 || fake.objects["feedback/r7/log.txt"] == nil || fake.objects["feedback/r1999/log.txt"] == nil {
+		t.Errorf("remaining objects = %d", len(fake.objects))
+	}
+}
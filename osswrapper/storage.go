@@ -0,0 +1,155 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-10 10:12:36
+ * @LastEditTime: 2024-09-10 16:40:18
+ * @FilePath: \UserFeedBack\osswrapper\storage.go
+ * @Description: 附件存储抽象
+ */
+package osswrapper
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"time"
+)
+
+// 存储后端名称
+const (
+	BackendOss   = "oss"
+	BackendS3    = "s3"
+	BackendLocal = "local"
+)
+
+// 对象不存在
+var ErrObjectNotFound = errors.New("object not found")
+
+// 上传内容超出限制
+var (
+	ErrFileTooLarge          = errors.New("file too large")
+	ErrContentTypeNotAllowed = errors.New("content type not allowed")
+)
+
+// 对象元信息
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+}
+
+// 上传凭证
+type UploadCredential struct {
+	AccessKeyId     string
+	AccessKeySecret string
+	Expiration      string
+	SecurityToken   string
+	UploadUrls      map[string]string            // 对象路径->预签名上传地址，仅部分后端提供，有表单时为表单的POST地址
+	UploadForms     map[string]map[string]string // 对象路径->表单上传字段，配置了上传限制时由oss和s3提供
+}
+
+// 附件存储接口
+type Storage interface {
+	// 后端名称
+	Name() string
+
+	// 为指定的对象路径签发上传凭证
+	IssueUploadCredential(objectKeys []string) (*UploadCredential, error)
+
+	// 查询对象元信息，对象不存在时返回ErrObjectNotFound
+	Stat(objectKey string) (*ObjectInfo, error)
+
+	// 由服务端直接写入对象，size未知时传-1
+	Put(objectKey string, reader io.Reader, size int64, contentType string) error
+
+	// 读取对象内容，由调用方负责关闭
+	Open(objectKey string) (io.ReadCloser, error)
+
+	// 读取对象从offset开始的length字节，由调用方负责关闭
+	OpenRange(objectKey string, offset int64, length int64) (io.ReadCloser, error)
+
+	// 删除对象，对象不存在时不返回错误
+	Delete(objectKey string) error
+
+	// 遍历前缀下的所有对象，fn返回错误时停止遍历
+	List(prefix string, fn func(info *ObjectInfo) error) error
+
+	// 对象的下载地址
+	URL(objectKey string) (string, error)
+}
+
+// 单次批量删除请求最多包含的对象数
+const maxDeleteBatch = 1000
+
+// 支持一次请求删除多个对象的存储
+type BatchDeleter interface {
+	// 删除不超过maxDeleteBatch个对象，返回删除失败的对象及原因，整个请求失败时返回error
+	DeleteObjects(objectKeys []string) (map[string]error, error)
+}
+
+// 支持在存储内部复制对象的存储，不需要经服务端中转内容
+type Copier interface {
+	// 把srcKey复制到dstKey，dstKey已存在时覆盖
+	Copy(srcKey string, dstKey string) error
+}
+
+// 浏览器可能当作页面执行脚本的内容类型，下载时一律按纯文本返回
+var unsafeContentTypes = map[string]bool{
+	"text/html":                true,
+	"application/xhtml+xml":    true,
+	"image/svg+xml":            true,
+	"text/xml":                 true,
+	"application/xml":          true,
+	"text/javascript":          true,
+	"application/javascript":   true,
+	"application/x-javascript": true,
+}
+
+/**
+ * @description: 可能被浏览器执行的内容类型替换为纯文本，未知类型按二进制下载
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func SafeContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "application/octet-stream"
+	}
+
+	if unsafeContentTypes[mediaType] {
+		return "text/plain; charset=utf-8"
+	}
+
+	return contentType
+}
+
+/**
+ * @description: 判断内容类型是否在允许范围内，支持image/*形式的通配
+ * @param {string} contentType 内容类型
+ * @param {[]string} allowed 允许的内容类型，为空时不限制
+ * @return {*}
+ */
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, item := range allowed {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == mediaType {
+			return true
+		}
+		if strings.HasSuffix(item, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(item, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
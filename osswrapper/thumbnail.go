@@ -0,0 +1,153 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-29 10:17:43
+ * @LastEditTime: 2024-09-29 17:05:26
+ * @FilePath: \UserFeedBack\osswrapper\thumbnail.go
+ * @Description: 图片附件缩略图
+ */
+package osswrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+const (
+	// 缩略图默认最长边，单位：像素
+	defaultThumbnailDimension = 320
+	// 默认生成缩略图的原图最大尺寸，单位：字节
+	defaultThumbnailSourceSize = 32 << 20
+	// 默认生成缩略图的原图最大像素数
+	defaultThumbnailSourcePixels = 40_000_000
+	// 缩略图的jpeg质量
+	thumbnailQuality = 80
+)
+
+// 原图超出限制或无法识别，不生成缩略图
+var ErrThumbnailSkipped = errors.New("thumbnail skipped")
+
+// 可以生成缩略图的图片类型
+var thumbnailContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+/**
+ * @description: 判断附件是否需要生成缩略图，按内容类型或扩展名识别png、jpeg、gif
+ * @param {string} fileName 文件名
+ * @param {string} contentType 内容类型
+ * @return {*}
+ */
+func IsThumbnailCandidate(fileName string, contentType string) bool {
+	if zgconfig.Cfg.Thumbnail.Disabled {
+		return false
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && thumbnailContentTypes[mediaType] {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(path.Ext(fileName))))
+	return thumbnailContentTypes[mediaType]
+}
+
+/**
+ * @description: 缩略图的对象路径，与原图放在一起
+ * @param {string} objectKey 原图的对象路径
+ * @return {*}
+ */
+func ThumbnailObjectKey(objectKey string) string {
+	return objectKey + ".thumb.jpg"
+}
+
+/**
+ * @description: 读取原图生成jpeg缩略图并写入存储
+ * @param {string} objectKey 原图的对象路径
+ * @param {int64} size 原图大小
+ * @return {*} 缩略图的对象路径
+ */
+func CreateThumbnail(objectKey string, size int64) (string, error) {
+	cfg := zgconfig.Cfg.Thumbnail
+	maxDimension := cfg.MaxDimension
+	if maxDimension <= 0 {
+		maxDimension = defaultThumbnailDimension
+	}
+	maxSourceSize := cfg.MaxSourceSize
+	if maxSourceSize <= 0 {
+		maxSourceSize = defaultThumbnailSourceSize
+	}
+	maxSourcePixels := cfg.MaxSourcePixels
+	if maxSourcePixels <= 0 {
+		maxSourcePixels = defaultThumbnailSourcePixels
+	}
+
+	if size > maxSourceSize {
+		return "", ErrThumbnailSkipped
+	}
+
+	reader, err := Current().Open(objectKey)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxSourceSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(data)) > maxSourceSize {
+		return "", ErrThumbnailSkipped
+	}
+
+	// 解码前先检查尺寸，避免小文件解码出超大图片
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || int64(config.Width)*int64(config.Height) > maxSourcePixels {
+		return "", ErrThumbnailSkipped
+	}
+
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", ErrThumbnailSkipped
+	}
+
+	// 按比例缩放，透明区域填充为白色
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxDimension || height > maxDimension {
+		if width >= height {
+			width, height = maxDimension, max(1, height*maxDimension/width)
+		} else {
+			width, height = max(1, width*maxDimension/height), maxDimension
+		}
+	}
+
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(thumbnail, thumbnail.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	xdraw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), source, bounds, xdraw.Over, nil)
+
+	var buffer bytes.Buffer
+	if err = jpeg.Encode(&buffer, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return "", err
+	}
+
+	thumbnailKey := ThumbnailObjectKey(objectKey)
+	if err = Current().Put(thumbnailKey, &buffer, int64(buffer.Len()), "image/jpeg"); err != nil {
+		return "", err
+	}
+
+	return thumbnailKey, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-19 11:02:49
+ * @LastEditTime: 2024-09-19 17:48:33
+ * @FilePath: \UserFeedBack\outbox.go
+ * @Description: 待删除队列的执行
+ */
+package main
+
+import (
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/logwrapper"
+	"time"
+)
+
+const (
+	// 轮询间隔
+	outboxPollInterval = 30 * time.Second
+	// 每批处理的条数
+	outboxBatchSize = 100
+	// 重试的初始间隔
+	outboxRetryBase = 30 * time.Second
+	// 重试的最大间隔
+	outboxRetryMax = time.Hour
+)
+
+// 有新的待删除对象时唤醒执行
+var outboxWakeup = make(chan struct{}, 1)
+
+/**
+ * @description: 通知待删除队列有新的对象
+ * @return {*}
+ */
+func notifyOutbox() {
+	select {
+	case outboxWakeup <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * @description: 持续执行待删除队列，失败的对象按指数退避重试
+ * @return {*}
+ */
+func runOutboxWorker() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// 一批处理满时说明可能还有积压，继续处理
+		for processOutbox() == outboxBatchSize {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-outboxWakeup:
+		}
+	}
+}
+
+/**
+ * @description: 处理一批到期的待删除对象
+ * @return {*} 本批处理的条数
+ */
+func processOutbox() int {
+	count, err := dbwrapper.ProcessDueOutbox(time.Now(), outboxBatchSize, outboxBackoff)
+	if err != nil {
+		logwrapper.Logger.Error("error processing storage outbox:", err)
+		return 0
+	}
+
+	return count
+}
+
+/**
+ * @description: 第attempts次失败后的重试间隔
+ * @param {int} attempts 已失败的次数
+ * @return {*}
+ */
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxRetryBase
+	for i := 0; i < attempts && backoff < outboxRetryMax; i++ {
+		backoff *= 2
+	}
+
+	if backoff > outboxRetryMax {
+		backoff = outboxRetryMax
+	}
+
+	return backoff
+}
@@ -0,0 +1,204 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-18 10:32:08
+ * @LastEditTime: 2024-09-18 16:35:52
+ * @FilePath: \UserFeedBack\reconcile.go
+ * @Description: 孤立附件清理
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 未配置时孤立对象的保留时长
+const defaultGcGrace = 48 * time.Hour
+
+// 同一时间只允许一次对账
+var reconcileMutex sync.Mutex
+
+// 对账已在进行中
+var errReconcileRunning = errors.New("reconcile already running")
+
+// 对账结果
+type reconcileReport struct {
+	DryRun          bool      `json:"dryRun"`
+	StartedAt       time.Time `json:"startedAt"`
+	FinishedAt      time.Time `json:"finishedAt"`
+	ScannedObjects  int       `json:"scannedObjects"`
+	OrphanedObjects []string  `json:"orphanedObjects"`
+	DeletedObjects  []string  `json:"deletedObjects"`
+	FailedObjects   []string  `json:"failedObjects"`
+	DanglingFileIDs []int     `json:"danglingFileIds"`
+	RecoveredIDs    []int     `json:"recoveredFileIds"`
+	ExpiredTickets  int64     `json:"expiredTickets"`
+}
+
+/**
+ * @description: 对比存储上的附件与数据库记录，删除超过保留期的未引用对象，标记对象已丢失的记录
+ * @param {bool} dryRun 只报告不修改
+ * @return {*}
+ */
+func reconcileAttachments(dryRun bool) (*reconcileReport, error) {
+	if !reconcileMutex.TryLock() {
+		return nil, errReconcileRunning
+	}
+	defer reconcileMutex.Unlock()
+
+	grace := defaultGcGrace
+	if configwrapper.Cfg.Gc.GraceSeconds > 0 {
+		grace = time.Duration(configwrapper.Cfg.Gc.GraceSeconds) * time.Second
+	}
+
+	report := &reconcileReport{
+		DryRun:          dryRun,
+		StartedAt:       time.Now(),
+		OrphanedObjects: []string{},
+		DeletedObjects:  []string{},
+		FailedObjects:   []string{},
+		DanglingFileIDs: []int{},
+		RecoveredIDs:    []int{},
+	}
+
+	// 先列出存储上的对象，再查询引用，避免把列出之后才登记的对象误判为孤立
+	existing := make(map[string]time.Time)
+	err := osswrapper.Current().List(osswrapper.FeedbackPrefix(), func(info *osswrapper.ObjectInfo) error {
+		existing[info.Key] = info.LastModified
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.ScannedObjects = len(existing)
+
+	referenced, err := dbwrapper.QueryReferencedObjectKeys(report.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// 未被引用且超过保留期的对象
+	deadline := report.StartedAt.Add(-grace)
+	for objectKey, lastModified := range existing {
+		if referenced[objectKey] || lastModified.After(deadline) {
+			continue
+		}
+
+		report.OrphanedObjects = append(report.OrphanedObjects, objectKey)
+	}
+
+	if !dryRun && len(report.OrphanedObjects) > 0 {
+		result := osswrapper.DeleteObjects(report.OrphanedObjects)
+		report.DeletedObjects = result.Deleted
+		report.FailedObjects = result.FailedKeys()
+	}
+
+	// 存储上已不存在的附件记录
+	files, err := dbwrapper.QueryFileObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		_, exists := existing[file.FilePath]
+		switch {
+		case !exists && !file.Missing:
+			// 列出对象之后才登记的附件不在列表中，标记前再确认一次对象是否存在
+			if _, err := osswrapper.Current().Stat(file.FilePath); !errors.Is(err, osswrapper.ErrObjectNotFound) {
+				if err != nil {
+					logwrapper.Logger.Error("error checking object ", file.FilePath, ": ", err)
+				}
+				continue
+			}
+			report.DanglingFileIDs = append(report.DanglingFileIDs, file.FileID)
+		case exists && file.Missing:
+			report.RecoveredIDs = append(report.RecoveredIDs, file.FileID)
+		}
+	}
+
+	if !dryRun {
+		if err = dbwrapper.MarkFilesMissing(report.DanglingFileIDs, true); err != nil {
+			return nil, err
+		}
+		if err = dbwrapper.MarkFilesMissing(report.RecoveredIDs, false); err != nil {
+			return nil, err
+		}
+		if report.ExpiredTickets, err = dbwrapper.DeleteExpiredUploadTickets(report.StartedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	report.FinishedAt = time.Now()
+	logwrapper.Logger.Infof("reconcile finished, dryRun: %v, scanned: %d, orphaned: %d, deleted: %d, failed: %d, dangling: %d, recovered: %d",
+		dryRun,
+		report.ScannedObjects,
+		len(report.OrphanedObjects),
+		len(report.DeletedObjects),
+		len(report.FailedObjects),
+		len(report.DanglingFileIDs),
+		len(report.RecoveredIDs))
+
+	return report, nil
+}
+
+/**
+ * @description: 手动触发对账接口，默认只报告不删除，dryRun=false时才实际执行
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func reconcileAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+
+	report, err := reconcileAttachments(dryRun)
+	if errors.Is(err, errReconcileRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error reconciling attachments:", err)
+		http.Error(w, "Failed to reconcile attachments", http.StatusInternalServerError)
+		return
+	}
+
+	// 写入对账结果
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 按配置的间隔定期对账
+ * @return {*}
+ */
+func runReconciler() {
+	interval := time.Duration(configwrapper.Cfg.Gc.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := reconcileAttachments(configwrapper.Cfg.Gc.DryRun); err != nil {
+			logwrapper.Logger.Error("error reconciling attachments:", err)
+		}
+	}
+}
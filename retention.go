@@ -0,0 +1,257 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-09 14:02:18
+ * @LastEditTime: 2024-10-09 17:13:45
+ * @FilePath: \UserFeedBack\retention.go
+ * @Description: 附件保留策略与用量报表
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/logwrapper"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 每次标记过期的附件数
+const retentionBatchSize = 500
+
+// 同一时间只允许执行一次保留策略
+var retentionMutex sync.Mutex
+
+// 保留策略已在执行中
+var errRetentionRunning = errors.New("retention already running")
+
+// 保留策略执行结果
+type retentionReport struct {
+	DryRun         bool      `json:"dryRun"`
+	StartedAt      time.Time `json:"startedAt"`
+	FinishedAt     time.Time `json:"finishedAt"`
+	ExpiredByAge   []int     `json:"expiredByAge"`
+	ExpiredByQuota []int     `json:"expiredByQuota"`
+	ExpiredSize    int64     `json:"expiredSize"`
+}
+
+/**
+ * @description: 按配置的保留天数和配额标记附件过期，对象由待删除队列从存储上删除，反馈内容保留
+ * @param {bool} dryRun 只报告不修改
+ * @return {*}
+ */
+func applyRetention(dryRun bool) (*retentionReport, error) {
+	if !retentionMutex.TryLock() {
+		return nil, errRetentionRunning
+	}
+	defer retentionMutex.Unlock()
+
+	cfg := configwrapper.Cfg.Retention
+	report := &retentionReport{
+		DryRun:         dryRun,
+		StartedAt:      time.Now(),
+		ExpiredByAge:   []int{},
+		ExpiredByQuota: []int{},
+	}
+	expired := make(map[int]bool)
+
+	// 超过保留天数的附件
+	if cfg.MaxAgeDays > 0 {
+		files, err := dbwrapper.QueryFilesSubmittedBefore(report.StartedAt.AddDate(0, 0, -cfg.MaxAgeDays))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			expired[file.FileID] = true
+			report.ExpiredByAge = append(report.ExpiredByAge, file.FileID)
+			report.ExpiredSize += file.FileSize
+		}
+
+		if err = expireFiles(report.ExpiredByAge, report.StartedAt, dryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	// 超出配额的模块和版本，保留最新的附件
+	quotas := []struct {
+		scope     dbwrapper.UsageScope
+		quota     int64
+		overrides map[string]int64
+	}{
+		{dbwrapper.ScopeModule, cfg.ModuleQuota, cfg.ModuleQuotas},
+		{dbwrapper.ScopeVersion, cfg.VersionQuota, cfg.VersionQuotas},
+	}
+
+	for _, item := range quotas {
+		if item.quota <= 0 && len(item.overrides) == 0 {
+			continue
+		}
+
+		usage, err := dbwrapper.QueryUsageByScope(item.scope)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileIDs []int
+		for value, size := range usage {
+			quota, ok := item.overrides[value]
+			if !ok {
+				quota = item.quota
+			}
+			if quota <= 0 || size <= quota {
+				continue
+			}
+
+			files, err := dbwrapper.QueryScopeFiles(item.scope, value)
+			if err != nil {
+				return nil, err
+			}
+
+			var (
+				kept       int64
+				overflowed bool
+			)
+			for _, file := range files {
+				// 只报告不修改时，已按其他规则过期的附件仍在统计中
+				if expired[file.FileID] {
+					continue
+				}
+				// 从新到旧保留，第一次超出配额后更旧的附件全部过期，不再用较小的旧附件填补剩余空间
+				if !overflowed && kept+file.FileSize <= quota {
+					kept += file.FileSize
+					continue
+				}
+				overflowed = true
+
+				expired[file.FileID] = true
+				fileIDs = append(fileIDs, file.FileID)
+				report.ExpiredSize += file.FileSize
+			}
+		}
+
+		if err = expireFiles(fileIDs, report.StartedAt, dryRun); err != nil {
+			return nil, err
+		}
+		report.ExpiredByQuota = append(report.ExpiredByQuota, fileIDs...)
+	}
+
+	report.FinishedAt = time.Now()
+	logwrapper.Logger.Infof("retention finished, dryRun: %v, expired by age: %d, expired by quota: %d, expired size: %d",
+		dryRun,
+		len(report.ExpiredByAge),
+		len(report.ExpiredByQuota),
+		report.ExpiredSize)
+
+	return report, nil
+}
+
+/**
+ * @description: 分批标记附件过期
+ * @param {[]int} fileIDs 附件id
+ * @param {time.Time} now 过期时间
+ * @param {bool} dryRun 只报告不修改
+ * @return {*}
+ */
+func expireFiles(fileIDs []int, now time.Time, dryRun bool) error {
+	if dryRun || len(fileIDs) == 0 {
+		return nil
+	}
+
+	for start := 0; start < len(fileIDs); start += retentionBatchSize {
+		if err := dbwrapper.ExpireFiles(fileIDs[start:min(start+retentionBatchSize, len(fileIDs))], now); err != nil {
+			return err
+		}
+	}
+
+	// 唤醒待删除队列
+	notifyOutbox()
+
+	return nil
+}
+
+/**
+ * @description: 手动执行保留策略接口，默认只报告不删除，dryRun=false时才实际执行
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func applyRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+
+	report, err := applyRetention(dryRun)
+	if errors.Is(err, errRetentionRunning) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error applying retention:", err)
+		http.Error(w, "Failed to apply retention", http.StatusInternalServerError)
+		return
+	}
+
+	// 写入执行结果
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 附件用量报表接口，按月份、影响模块和版本统计未过期附件的总大小
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func usageReport(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := dbwrapper.QueryUsageReport()
+	if err != nil {
+		logwrapper.Logger.Error("error querying usage:", err)
+		http.Error(w, "Failed to query usage", http.StatusInternalServerError)
+		return
+	}
+
+	// 写入统计结果
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(report)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 按配置的间隔定期执行保留策略
+ * @return {*}
+ */
+func runRetention() {
+	interval := time.Duration(configwrapper.Cfg.Retention.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := applyRetention(configwrapper.Cfg.Retention.DryRun); err != nil {
+			logwrapper.Logger.Error("error applying retention:", err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-08 14:15:03
+ * @LastEditTime: 2024-10-08 16:52:37
+ * @FilePath: \UserFeedBack\scan.go
+ * @Description: 附件的异步病毒扫描与下载前检查
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"UserFeedBack/scanwrapper"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	// 轮询间隔
+	scanPollInterval = time.Minute
+	// 每批处理的条数
+	scanBatchSize = 10
+	// 重试的初始间隔
+	scanRetryBase = time.Minute
+	// 重试的最大间隔
+	scanRetryMax = 6 * time.Hour
+	// 连续失败达到该次数后标记为扫描失败，不再重试
+	scanMaxAttempts = 10
+)
+
+// 有新的附件时唤醒执行
+var scanWakeup = make(chan struct{}, 1)
+
+/**
+ * @description: 通知有新的附件需要扫描
+ * @return {*}
+ */
+func notifyScan() {
+	select {
+	case scanWakeup <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * @description: 持续扫描新提交的附件，未配置扫描器时直接返回
+ * @return {*}
+ */
+func runScanWorker() {
+	if !scanwrapper.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(scanPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// 一批处理满时说明可能还有积压，继续处理
+		for processScans() == scanBatchSize {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-scanWakeup:
+		}
+	}
+}
+
+/**
+ * @description: 处理一批到期的待扫描附件，单个附件暂时失败时推迟重试，不影响同批其他附件
+ * @return {*} 本批处理的条数
+ */
+func processScans() int {
+	tasks, err := dbwrapper.QueryPendingScans(time.Now(), scanBatchSize)
+	if err != nil {
+		logwrapper.Logger.Error("error querying pending scans:", err)
+		return 0
+	}
+
+	for _, task := range tasks {
+		status, result, quarantinePath, err := scanObject(task)
+		if err != nil {
+			logwrapper.Logger.Error("error scanning ", task.FilePath, ": ", err)
+
+			// 扫描器或存储暂时不可用，保持待扫描并按指数退避重试，多次失败后不再重试
+			if task.Attempts+1 < scanMaxAttempts {
+				if err = dbwrapper.RetryScan(task.FilePath, time.Now().Add(scanBackoff(task.Attempts)), err.Error()); err != nil {
+					logwrapper.Logger.Error("error updating scan result:", err)
+				}
+				continue
+			}
+			status, result = dto.ScanFailed, err.Error()
+		}
+
+		if err = dbwrapper.FinishScan(task.FilePath, status, result, quarantinePath); err != nil {
+			logwrapper.Logger.Error("error updating scan result:", err)
+		}
+	}
+
+	return len(tasks)
+}
+
+/**
+ * @description: 第attempts次失败后的重试间隔
+ * @param {int} attempts 已失败的次数
+ * @return {*}
+ */
+func scanBackoff(attempts int) time.Duration {
+	backoff := scanRetryBase
+	for i := 0; i < attempts && backoff < scanRetryMax; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, scanRetryMax)
+}
+
+/**
+ * @description: 扫描单个对象，染毒时移入隔离目录
+ * @param {dbwrapper.ScanTask} task 待扫描的对象
+ * @return {*} 扫描状态、病毒名或失败原因、隔离后的对象路径，需要重试时返回error
+ */
+func scanObject(task dbwrapper.ScanTask) (string, string, string, error) {
+	if maxSize := configwrapper.Cfg.Scan.MaxSize; maxSize > 0 && task.FileSize > maxSize {
+		return dto.ScanFailed, scanwrapper.ErrTooLarge.Error(), "", nil
+	}
+
+	reader, err := osswrapper.Current().Open(task.FilePath)
+	if errors.Is(err, osswrapper.ErrObjectNotFound) {
+		return dto.ScanFailed, err.Error(), "", nil
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+
+	result, err := scanwrapper.Scan(reader)
+	reader.Close()
+	if errors.Is(err, scanwrapper.ErrTooLarge) {
+		return dto.ScanFailed, err.Error(), "", nil
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if !result.Infected {
+		return dto.ScanClean, "", "", nil
+	}
+
+	logwrapper.Logger.Warn("infected attachment ", task.FilePath, ": ", result.Signature)
+	// 隔离失败时仍标记为染毒，拒绝下载
+	quarantinePath, err := osswrapper.QuarantineObject(task.FilePath)
+	if err != nil {
+		logwrapper.Logger.Error("error quarantining ", task.FilePath, ": ", err)
+	}
+
+	return dto.ScanInfected, result.Signature, quarantinePath, nil
+}
+
+/**
+ * @description: 附件是否允许下载，启用扫描时只允许扫描通过的附件，染毒的附件始终不允许下载
+ * @param {string} status 扫描状态
+ * @return {*}
+ */
+func scanAllowsDownload(status string) bool {
+	if status == dto.ScanInfected {
+		return false
+	}
+
+	return !scanwrapper.Enabled() || status == dto.ScanClean
+}
+
+/**
+ * @description: 检查附件是否允许下载，不允许时直接写入错误响应
+ * @param {http.ResponseWriter} w
+ * @param {string} status 扫描状态
+ * @return {*}
+ */
+func checkScanStatus(w http.ResponseWriter, status string) bool {
+	if scanAllowsDownload(status) {
+		return true
+	}
+
+	switch status {
+	case dto.ScanInfected:
+		http.Error(w, "File is infected", http.StatusForbidden)
+	case dto.ScanFailed:
+		http.Error(w, "File could not be scanned", http.StatusForbidden)
+	default:
+		http.Error(w, "File has not been scanned yet", http.StatusConflict)
+	}
+
+	return false
+}
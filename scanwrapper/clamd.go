@@ -0,0 +1,156 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-08 10:21:09
+ * @LastEditTime: 2024-10-08 16:52:37
+ * @FilePath: \UserFeedBack\scanwrapper\clamd.go
+ * @Description: 通过clamd的INSTREAM命令扫描
+ */
+package scanwrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// 默认clamd地址
+	defaultClamdAddress = "tcp://127.0.0.1:3310"
+	// 默认单个文件的扫描超时
+	defaultClamdTimeout = 60 * time.Second
+	// 每次发送给clamd的数据块大小
+	clamdChunkSize = 32 << 10
+)
+
+// clamd扫描器，每次扫描使用一个新连接
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+/**
+ * @description: 创建clamd扫描器
+ * @param {zgconfig.Scan} cfg 扫描配置
+ * @return {*}
+ */
+func newClamdScanner(cfg zgconfig.Scan) (*clamdScanner, error) {
+	address := cfg.ClamdAddress
+	if address == "" {
+		address = defaultClamdAddress
+	}
+
+	scanner := &clamdScanner{network: "tcp", address: address, timeout: defaultClamdTimeout}
+	if cfg.TimeoutSeconds > 0 {
+		scanner.timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+
+	if socket, ok := strings.CutPrefix(address, "unix://"); ok {
+		scanner.network, scanner.address = "unix", socket
+	} else if host, ok := strings.CutPrefix(address, "tcp://"); ok {
+		scanner.address = host
+	}
+	if scanner.address == "" {
+		return nil, errors.New("clamd address not configured")
+	}
+
+	return scanner, nil
+}
+
+/**
+ * @description: 扫描器名称
+ * @return {*}
+ */
+func (s *clamdScanner) Name() string {
+	return ScannerClamd
+}
+
+/**
+ * @description: 按INSTREAM协议分块发送内容，每块前加4字节大端长度，以长度0结束
+ * @param {io.Reader} reader 文件内容
+ * @return {*}
+ */
+func (s *clamdScanner) Scan(reader io.Reader) (*Result, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return nil, err
+	}
+
+	// 超出StreamMaxLength时clamd会先回复错误再断开，写入失败时仍尝试读取回复
+	writeErr := s.send(conn, reader)
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if writeErr != nil {
+			return nil, writeErr
+		}
+		return nil, err
+	}
+
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+/**
+ * @description: 发送INSTREAM命令和文件内容
+ * @param {net.Conn} conn 连接
+ * @param {io.Reader} reader 文件内容
+ * @return {*}
+ */
+func (s *clamdScanner) send(conn net.Conn, reader io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := reader.Read(buffer[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buffer, uint32(n))
+			if _, writeErr := conn.Write(buffer[:4+n]); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+/**
+ * @description: 解析clamd的回复，如stream: OK、stream: Eicar-Signature FOUND
+ * @param {string} reply 回复内容
+ * @return {*}
+ */
+func parseClamdReply(reply string) (*Result, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		signature := strings.TrimSuffix(reply, " FOUND")
+		if index := strings.LastIndex(signature, ": "); index >= 0 {
+			signature = signature[index+2:]
+		}
+		return &Result{Infected: true, Signature: signature}, nil
+	case strings.HasSuffix(reply, ": OK"):
+		return &Result{}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return nil, ErrTooLarge
+	}
+
+	return nil, fmt.Errorf("clamd: %s", reply)
+}
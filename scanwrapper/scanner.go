@@ -0,0 +1,86 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-08 09:36:14
+ * @LastEditTime: 2024-10-08 16:52:37
+ * @FilePath: \UserFeedBack\scanwrapper\scanner.go
+ * @Description: 附件病毒扫描抽象
+ */
+package scanwrapper
+
+import (
+	zgconfig "UserFeedBack/configwrapper"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 扫描器名称
+const (
+	ScannerClamd = "clamd"
+	ScannerStub  = "stub"
+)
+
+// 文件超出扫描器允许的大小
+var ErrTooLarge = errors.New("file too large to scan")
+
+// 扫描结果
+type Result struct {
+	Infected  bool
+	Signature string // 染毒时的病毒名
+}
+
+// 病毒扫描器
+type Scanner interface {
+	// 扫描器名称
+	Name() string
+	// 扫描内容，扫描器不可用时返回error
+	Scan(reader io.Reader) (*Result, error)
+}
+
+// 当前使用的扫描器，未配置时为nil
+var scanner Scanner
+
+/**
+ * @description: 根据配置初始化扫描器，未配置时不扫描
+ * @return {*}
+ */
+func Init() error {
+	cfg := zgconfig.Cfg.Scan
+	switch cfg.Scanner {
+	case "":
+		scanner = nil
+	case ScannerClamd:
+		clamd, err := newClamdScanner(cfg)
+		if err != nil {
+			return err
+		}
+		scanner = clamd
+	case ScannerStub:
+		scanner = &stubScanner{}
+	default:
+		return fmt.Errorf("unknown scanner: %s", cfg.Scanner)
+	}
+
+	return nil
+}
+
+/**
+ * @description: 是否启用了病毒扫描
+ * @return {*}
+ */
+func Enabled() bool {
+	return scanner != nil
+}
+
+/**
+ * @description: 使用当前的扫描器扫描内容
+ * @param {io.Reader} reader 文件内容
+ * @return {*}
+ */
+func Scan(reader io.Reader) (*Result, error) {
+	if scanner == nil {
+		return nil, errors.New("scanner not configured")
+	}
+
+	return scanner.Scan(reader)
+}
@@ -0,0 +1,45 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-08 10:05:41
+ * @LastEditTime: 2024-10-08 16:52:37
+ * @FilePath: \UserFeedBack\scanwrapper\stub.go
+ * @Description: 测试用的扫描器
+ */
+package scanwrapper
+
+import (
+	"bytes"
+	"io"
+)
+
+// EICAR标准测试文件的内容
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// 不依赖杀毒软件的扫描器，只识别EICAR测试文件，用于测试环境
+type stubScanner struct{}
+
+/**
+ * @description: 扫描器名称
+ * @return {*}
+ */
+func (s *stubScanner) Name() string {
+	return ScannerStub
+}
+
+/**
+ * @description: 内容包含EICAR测试文件时判定为染毒
+ * @param {io.Reader} reader 文件内容
+ * @return {*}
+ */
+func (s *stubScanner) Scan(reader io.Reader) (*Result, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Contains(data, eicarSignature) {
+		return &Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+	}
+
+	return &Result{}, nil
+}
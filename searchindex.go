@@ -0,0 +1,119 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-10-16 10:52:07
+ * @LastEditTime: 2024-10-16 17:22:35
+ * @FilePath: \UserFeedBack\searchindex.go
+ * @Description: 反馈的全文检索索引和检索接口
+ */
+package main
+
+import (
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/logwrapper"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 轮询间隔
+	searchIndexPollInterval = time.Minute
+	// 每批处理的条数
+	searchIndexBatchSize = 100
+)
+
+// 有新的反馈时唤醒执行
+var searchIndexWakeup = make(chan struct{}, 1)
+
+/**
+ * @description: 通知有新的反馈需要建立检索索引
+ * @return {*}
+ */
+func notifySearchIndex() {
+	select {
+	case searchIndexWakeup <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * @description: 持续为新提交的反馈建立检索索引，启动时补齐已有的反馈
+ * @return {*}
+ */
+func runSearchIndexer() {
+	ticker := time.NewTicker(searchIndexPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// 一批处理满时说明可能还有积压，继续处理
+		for processSearchIndex() == searchIndexBatchSize {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-searchIndexWakeup:
+		}
+	}
+}
+
+/**
+ * @description: 处理一批待建立检索索引的反馈
+ * @return {*} 本批处理的条数
+ */
+func processSearchIndex() int {
+	count, err := dbwrapper.BuildSearchIndex(searchIndexBatchSize)
+	if err != nil {
+		logwrapper.Logger.Error("error building search index:", err)
+		return 0
+	}
+
+	return count
+}
+
+/**
+ * @description: 在问题描述、复现步骤、用户信息和附件文件名中全文检索反馈
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func searchFeedback(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing search keyword", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxSearchLimit)
+	}
+
+	hits, err := dbwrapper.SearchFeedback(query, limit)
+	if err != nil {
+		logwrapper.Logger.Error("error searching feedback:", err)
+		http.Error(w, "Failed to search feedback", http.StatusInternalServerError)
+		return
+	}
+
+	// 设置响应头
+	w.Header().Set("Content-Type", "application/json")
+
+	// 将结果编码为JSON并写入响应
+	if err := json.NewEncoder(w).Encode(hits); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-29 14:20:11
+ * @LastEditTime: 2024-09-29 17:05:26
+ * @FilePath: \UserFeedBack\thumbnail.go
+ * @Description: 缩略图的异步生成
+ */
+package main
+
+import (
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"errors"
+	"time"
+)
+
+const (
+	// 轮询间隔
+	thumbnailPollInterval = time.Minute
+	// 每批处理的条数
+	thumbnailBatchSize = 20
+)
+
+// 有新的图片附件时唤醒执行
+var thumbnailWakeup = make(chan struct{}, 1)
+
+/**
+ * @description: 通知有新的图片附件需要生成缩略图
+ * @return {*}
+ */
+func notifyThumbnail() {
+	select {
+	case thumbnailWakeup <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * @description: 持续为新提交的图片附件生成缩略图
+ * @return {*}
+ */
+func runThumbnailWorker() {
+	ticker := time.NewTicker(thumbnailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// 一批处理满时说明可能还有积压，继续处理
+		for processThumbnails() == thumbnailBatchSize {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-thumbnailWakeup:
+		}
+	}
+}
+
+/**
+ * @description: 处理一批待生成的缩略图
+ * @return {*} 本批处理的条数
+ */
+func processThumbnails() int {
+	tasks, err := dbwrapper.QueryPendingThumbnails(thumbnailBatchSize)
+	if err != nil {
+		logwrapper.Logger.Error("error querying pending thumbnails:", err)
+		return 0
+	}
+
+	for _, task := range tasks {
+		thumbnailPath, status := createThumbnail(task)
+		if err = dbwrapper.FinishThumbnail(task.FilePath, thumbnailPath, status); err != nil {
+			logwrapper.Logger.Error("error updating thumbnail:", err)
+		}
+	}
+
+	return len(tasks)
+}
+
+/**
+ * @description: 生成单个对象的缩略图，已有缩略图时直接复用
+ * @param {dbwrapper.ThumbnailTask} task 待生成的对象
+ * @return {*} 缩略图的对象路径和状态
+ */
+func createThumbnail(task dbwrapper.ThumbnailTask) (string, string) {
+	thumbnailPath, err := dbwrapper.QueryReadyThumbnail(task.FilePath)
+	if err != nil {
+		logwrapper.Logger.Error("error querying thumbnail:", err)
+	}
+	if thumbnailPath != "" {
+		return thumbnailPath, dto.ThumbnailReady
+	}
+
+	thumbnailPath, err = osswrapper.CreateThumbnail(task.FilePath, task.FileSize)
+	if errors.Is(err, osswrapper.ErrThumbnailSkipped) {
+		return "", dto.ThumbnailSkipped
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error creating thumbnail for ", task.FilePath, ": ", err)
+		return "", dto.ThumbnailFailed
+	}
+
+	return thumbnailPath, dto.ThumbnailReady
+}
@@ -0,0 +1,522 @@
+/*
+ * @Author: shanghanjin
+ * @Date: 2024-09-13 15:40:26
+ * @LastEditTime: 2024-09-13 18:03:14
+ * @FilePath: \UserFeedBack\upload.go
+ * @Description: 可断点续传的分片上传接口
+ */
+package main
+
+import (
+	"UserFeedBack/configwrapper"
+	"UserFeedBack/dbwrapper"
+	"UserFeedBack/dto"
+	"UserFeedBack/logwrapper"
+	"UserFeedBack/osswrapper"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 默认分片大小
+	defaultPartSize = 8 << 20
+	// 对象存储要求除最后一个分片外不小于5MB
+	minPartSize = 5 << 20
+	// 分片号上限
+	maxPartNumber = 10000
+	// 会话无进展多久后自动放弃
+	defaultSessionExpire = 24 * time.Hour
+	// 检查过期会话的间隔
+	sessionCheckInterval = 10 * time.Minute
+)
+
+/**
+ * @description: 单个分片的最大尺寸
+ * @return {*}
+ */
+func partSize() int64 {
+	size := configwrapper.Cfg.Upload.PartSize
+	if size <= 0 {
+		return defaultPartSize
+	}
+	if size < minPartSize {
+		return minPartSize
+	}
+
+	return size
+}
+
+/**
+ * @description: 初始化分片上传接口
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func initiateUpload(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 解析body
+	type RequestBody struct {
+		FileName     string `json:"fileName"`
+		ContentType  string `json:"contentType"`
+		Size         int64  `json:"size"`
+		UploadTicket string `json:"uploadTicket"`
+	}
+	var reqBody RequestBody
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	// 需要声明文件大小，上传分片时据此限制总大小
+	if strings.TrimSpace(reqBody.FileName) == "" || reqBody.Size <= 0 {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+	if reqBody.Size > maxPartNumber*partSize() {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// 按附件策略校验扩展名和大小
+	fileName := osswrapper.SanitizeFileName(reqBody.FileName)
+	if rejections := osswrapper.CheckFiles([]osswrapper.FileSpec{{Name: fileName, RawName: reqBody.FileName, Size: reqBody.Size}}); len(rejections) > 0 {
+		writeRejections(w, rejections)
+		return
+	}
+
+	if reqBody.ContentType == "" {
+		reqBody.ContentType = "application/octet-stream"
+	}
+
+	// 追加到已有的上传登记时，登记须存在、未过期且未被反馈使用
+	if reqBody.UploadTicket != "" {
+		err = dbwrapper.CheckUploadTicket(reqBody.UploadTicket)
+		if errors.Is(err, dbwrapper.ErrInvalidUploadTicket) {
+			http.Error(w, "Invalid upload ticket", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logwrapper.Logger.Error("error checking upload ticket:", err)
+			http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	multipart, err := osswrapper.Multipart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	// 在存储上初始化分片上传
+	objectKey, err := osswrapper.NewMultipartObjectKey(fileName)
+	if err != nil {
+		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+		return
+	}
+	storageUploadID, err := multipart.InitiateMultipart(objectKey, reqBody.ContentType)
+	if err != nil {
+		logwrapper.Logger.Error("error initiating multipart upload:", err)
+		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err = rand.Read(idBytes); err != nil {
+		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+		return
+	}
+
+	// 记录上传会话
+	now := time.Now()
+	session := dto.UploadSession{
+		UploadID:        hex.EncodeToString(idBytes),
+		ObjectKey:       objectKey,
+		StorageUploadID: storageUploadID,
+		TicketID:        reqBody.UploadTicket,
+		FileName:        fileName,
+		ContentType:     reqBody.ContentType,
+		TotalSize:       reqBody.Size,
+		Status:          dto.UploadSessionUploading,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err = dbwrapper.CreateUploadSession(session); err != nil {
+		logwrapper.Logger.Error("error creating upload session:", err)
+		multipart.AbortMultipart(objectKey, storageUploadID)
+		http.Error(w, "Failed to initiate upload", http.StatusInternalServerError)
+		return
+	}
+
+	// 将响应数据返回给客户端
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploadId":  session.UploadID,
+		"objectKey": objectKey,
+		"partSize":  partSize(),
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 上传单个分片接口，请求体为分片内容
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func uploadPart(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		http.Error(w, "Invalid part number", http.StatusBadRequest)
+		return
+	}
+
+	// 分片需要已知大小
+	if r.ContentLength <= 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength > partSize() {
+		http.Error(w, "Part too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	session, multipart, ok := loadUploadSession(w, r.URL.Query().Get("uploadId"))
+	if !ok {
+		return
+	}
+
+	// 分片不能超出声明的文件大小，避免合并前在存储上写入远超限制的内容
+	if int64(partNumber-1)*partSize()+r.ContentLength > session.TotalSize {
+		http.Error(w, "Part exceeds the declared file size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	part, err := multipart.UploadPart(session.ObjectKey, session.StorageUploadID, partNumber, http.MaxBytesReader(w, r.Body, r.ContentLength), r.ContentLength)
+	if err != nil {
+		logwrapper.Logger.Error("error uploading part:", err)
+		http.Error(w, "Failed to upload part", http.StatusInternalServerError)
+		return
+	}
+
+	if err = dbwrapper.TouchUploadSession(session.UploadID); err != nil {
+		logwrapper.Logger.Error("error updating upload session:", err)
+	}
+
+	// 将响应数据返回给客户端
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(part)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 查询已上传分片接口，客户端据此续传
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func listUploadParts(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, multipart, ok := loadUploadSession(w, r.URL.Query().Get("uploadId"))
+	if !ok {
+		return
+	}
+
+	parts, err := multipart.ListParts(session.ObjectKey, session.StorageUploadID)
+	if err != nil {
+		logwrapper.Logger.Error("error listing parts:", err)
+		http.Error(w, "Failed to list parts", http.StatusInternalServerError)
+		return
+	}
+
+	// 将响应数据返回给客户端
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploadId": session.UploadID,
+		"partSize": partSize(),
+		"parts":    parts,
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 完成分片上传接口，合并分片并登记到上传登记中
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func completeUpload(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 解析body
+	type RequestBody struct {
+		UploadID string `json:"uploadId"`
+	}
+	var reqBody RequestBody
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	session, multipart, ok := loadUploadSession(w, reqBody.UploadID)
+	if !ok {
+		return
+	}
+
+	// 以存储上实际的分片为准，分片号必须连续
+	parts, err := multipart.ListParts(session.ObjectKey, session.StorageUploadID)
+	if err != nil {
+		logwrapper.Logger.Error("error listing parts:", err)
+		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+		return
+	}
+
+	var totalSize int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			http.Error(w, fmt.Sprintf("Missing part %d", i+1), http.StatusBadRequest)
+			return
+		}
+		totalSize += part.Size
+	}
+
+	if len(parts) == 0 {
+		http.Error(w, "No parts uploaded", http.StatusBadRequest)
+		return
+	}
+	if totalSize != session.TotalSize {
+		http.Error(w, fmt.Sprintf("Uploaded %d bytes, expected %d", totalSize, session.TotalSize), http.StatusBadRequest)
+		return
+	}
+	if maxFileSize := configwrapper.Cfg.Upload.MaxFileSize; maxFileSize > 0 && totalSize > maxFileSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// 登记在上传期间可能已过期或被使用，合并前先确认
+	if session.TicketID != "" {
+		err = dbwrapper.CheckUploadTicket(session.TicketID)
+		if errors.Is(err, dbwrapper.ErrInvalidUploadTicket) {
+			http.Error(w, "Invalid upload ticket", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logwrapper.Logger.Error("error checking upload ticket:", err)
+			http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 合并分片
+	if err = multipart.CompleteMultipart(session.ObjectKey, session.StorageUploadID, parts); err != nil {
+		logwrapper.Logger.Error("error completing multipart upload:", err)
+		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+		return
+	}
+
+	if err = dbwrapper.FinishUploadSession(session.UploadID, dto.UploadSessionCompleted); err != nil {
+		logwrapper.Logger.Error("error updating upload session:", err)
+		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+		return
+	}
+
+	// 登记文件，提交反馈时据此校验
+	ticketFiles := []dto.UploadTicketFile{{ObjectKey: session.ObjectKey, FileName: session.FileName}}
+	ticketID := session.TicketID
+	if ticketID == "" {
+		ticketID, err = dbwrapper.CreateUploadTicket(ticketFiles)
+	} else {
+		err = dbwrapper.AddUploadTicketFiles(ticketID, ticketFiles)
+	}
+	if errors.Is(err, dbwrapper.ErrInvalidUploadTicket) {
+		http.Error(w, "Invalid upload ticket", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error creating upload ticket:", err)
+		http.Error(w, "Failed to complete upload", http.StatusInternalServerError)
+		return
+	}
+
+	// 将响应数据返回给客户端
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{
+		"uploadTicket":  ticketID,
+		"fileName":      session.FileName,
+		"filePathOnOss": session.ObjectKey,
+		"fileSize":      totalSize,
+	})
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+/**
+ * @description: 放弃分片上传接口
+ * @param {http.ResponseWriter} w
+ * @param {*http.Request} r
+ * @return {*}
+ */
+func abortUpload(w http.ResponseWriter, r *http.Request) {
+	// 检查请求方法
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 解析body
+	type RequestBody struct {
+		UploadID string `json:"uploadId"`
+	}
+	var reqBody RequestBody
+	err := json.NewDecoder(r.Body).Decode(&reqBody)
+	if err != nil {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+
+	session, multipart, ok := loadUploadSession(w, reqBody.UploadID)
+	if !ok {
+		return
+	}
+
+	if err = abortUploadSession(multipart, session); err != nil {
+		http.Error(w, "Failed to abort upload", http.StatusInternalServerError)
+		return
+	}
+
+	// 响应客户端已完成
+	fmt.Fprintf(w, "Upload aborted successfully")
+}
+
+/**
+ * @description: 查询上传中的会话，失败时直接写入错误响应
+ * @param {http.ResponseWriter} w
+ * @param {string} uploadID 上传id
+ * @return {*}
+ */
+func loadUploadSession(w http.ResponseWriter, uploadID string) (*dto.UploadSession, osswrapper.MultipartStorage, bool) {
+	multipart, err := osswrapper.Multipart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return nil, nil, false
+	}
+
+	session, err := dbwrapper.GetUploadSession(uploadID)
+	if errors.Is(err, dbwrapper.ErrUploadSessionNotFound) {
+		http.Error(w, "Upload session not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if err != nil {
+		logwrapper.Logger.Error("error querying upload session:", err)
+		http.Error(w, "Failed to query upload session", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	if session.Status != dto.UploadSessionUploading {
+		http.Error(w, fmt.Sprintf("Upload session already %s", session.Status), http.StatusConflict)
+		return nil, nil, false
+	}
+
+	return session, multipart, true
+}
+
+/**
+ * @description: 放弃上传会话并清理存储上的分片
+ * @param {osswrapper.MultipartStorage} multipart 分片上传存储
+ * @param {*dto.UploadSession} session 上传会话
+ * @return {*}
+ */
+func abortUploadSession(multipart osswrapper.MultipartStorage, session *dto.UploadSession) error {
+	// 先清理存储，失败时会话保持上传中，下次检查时重试
+	if err := multipart.AbortMultipart(session.ObjectKey, session.StorageUploadID); err != nil {
+		logwrapper.Logger.Error("error aborting multipart upload:", err)
+		return err
+	}
+
+	if err := dbwrapper.FinishUploadSession(session.UploadID, dto.UploadSessionAborted); err != nil {
+		logwrapper.Logger.Error("error updating upload session:", err)
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * @description: 定期放弃长时间无进展的上传会话
+ * @return {*}
+ */
+func runUploadSessionJanitor() {
+	// 运行时不会切换存储后端，不支持分片上传时不需要清理
+	if _, err := osswrapper.Multipart(); err != nil {
+		return
+	}
+
+	expire := defaultSessionExpire
+	if configwrapper.Cfg.Upload.SessionExpireSeconds > 0 {
+		expire = time.Duration(configwrapper.Cfg.Upload.SessionExpireSeconds) * time.Second
+	}
+
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+
+	for ; true; <-ticker.C {
+		sessions, err := dbwrapper.QueryStaleUploadSessions(time.Now().Add(-expire))
+		if err != nil {
+			logwrapper.Logger.Error("error querying stale upload sessions:", err)
+			continue
+		}
+
+		// 每次重新获取当前存储，轮换密钥后使用新的实例
+		multipart, err := osswrapper.Multipart()
+		if err != nil {
+			logwrapper.Logger.Error("error getting multipart storage:", err)
+			continue
+		}
+
+		for i := range sessions {
+			if err = abortUploadSession(multipart, &sessions[i]); err == nil {
+				logwrapper.Logger.Infof("aborted stale upload session %s", sessions[i].UploadID)
+			}
+		}
+	}
+}